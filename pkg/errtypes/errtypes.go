@@ -122,6 +122,15 @@ func (e InsufficientStorage) IsInsufficientStorage() {}
 // https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/507
 const StatusInssufficientStorage = 507
 
+// Aborted is the error to use when an operation was aborted because a precondition,
+// like the etag of a resource, did not hold anymore.
+type Aborted string
+
+func (e Aborted) Error() string { return "error: aborted: " + string(e) }
+
+// IsAborted implements the IsAborted interface.
+func (e Aborted) IsAborted() {}
+
 // IsNotFound is the interface to implement
 // to specify that an a resource is not found.
 type IsNotFound interface {
@@ -187,3 +196,9 @@ type IsChecksumMismatch interface {
 type IsInsufficientStorage interface {
 	IsInsufficientStorage()
 }
+
+// IsAborted is the interface to implement
+// to specify that an operation was aborted.
+type IsAborted interface {
+	IsAborted()
+}
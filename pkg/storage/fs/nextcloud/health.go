@@ -0,0 +1,94 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package nextcloud
+
+import (
+	"context"
+	"time"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+)
+
+// deepCheckTimeout bounds all the checks of DeepCheck together.
+const deepCheckTimeout = 5 * time.Second
+
+// HealthCheck is the outcome of one of the checks of DeepCheck.
+type HealthCheck struct {
+	Name    string
+	Err     error // nil if the check passed
+	Latency time.Duration
+}
+
+// HealthReport is the outcome of DeepCheck.
+type HealthReport struct {
+	Checks []HealthCheck
+}
+
+// Healthy tells whether all checks passed.
+func (r *HealthReport) Healthy() bool {
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// DeepCheck checks that the server answers the user in ctx, by asking for the
+// home (GetHome), the metadata of its root (GetMD) and the quota (GetQuota),
+// and reports the outcome and latency of each. A failing check does not stop
+// the others, nor does it make DeepCheck fail; see HealthReport.Healthy. The
+// checks together get at most a few seconds.
+func (nc *StorageDriver) DeepCheck(ctx context.Context) (*HealthReport, error) {
+	if _, err := getUser(ctx); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, deepCheckTimeout)
+	defer cancel()
+
+	root := &provider.Reference{Path: "/"}
+	checks := []struct {
+		name string
+		run  func() error
+	}{
+		{"GetHome", func() error {
+			_, err := nc.GetHome(ctx)
+			return err
+		}},
+		{"GetMD", func() error {
+			_, err := nc.GetMD(ctx, root, nil)
+			return err
+		}},
+		{"GetQuota", func() error {
+			_, _, err := nc.GetQuota(ctx, root)
+			return err
+		}},
+	}
+	report := &HealthReport{}
+	for _, c := range checks {
+		start := time.Now()
+		err := c.run()
+		report.Checks = append(report.Checks, HealthCheck{
+			Name:    c.name,
+			Err:     err,
+			Latency: time.Since(start),
+		})
+	}
+	return report, nil
+}
@@ -19,22 +19,39 @@
 package nextcloud
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	group "github.com/cs3org/go-cs3apis/cs3/identity/group/v1beta1"
 	user "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
 	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	types "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
 	"github.com/cs3org/reva/pkg/appctx"
 	ctxpkg "github.com/cs3org/reva/pkg/ctx"
 	"github.com/cs3org/reva/pkg/errtypes"
+	"github.com/cs3org/reva/pkg/mime"
 	"github.com/cs3org/reva/pkg/storage"
 	"github.com/cs3org/reva/pkg/storage/fs/registry"
+	"github.com/cs3org/reva/pkg/storage/utils/templates"
+	"github.com/cs3org/reva/pkg/utils"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 )
@@ -48,14 +65,203 @@ type StorageDriverConfig struct {
 	EndPoint     string `mapstructure:"endpoint"` // e.g. "http://nc/apps/sciencemesh/~alice/"
 	SharedSecret string `mapstructure:"shared_secret"`
 	MockHTTP     bool   `mapstructure:"mock_http"`
+	// SharePermissionsBitmask makes grants travel as a Nextcloud permissions
+	// bitmask instead of a CS3 ResourcePermissions object.
+	SharePermissionsBitmask bool `mapstructure:"share_permissions_bitmask"`
+	// SharePermissionsMapping maps CS3 permissions that have no default
+	// Nextcloud equivalent (e.g. "deny_grant") to a bitmask.
+	SharePermissionsMapping map[string]int `mapstructure:"share_permissions_mapping"`
+	// AllowedUploadMimeTypes restricts uploads to files whose mime type,
+	// inferred from the file name, is in this list. Empty means allow all.
+	AllowedUploadMimeTypes []string `mapstructure:"allowed_upload_mime_types"`
+	// EnableHome mounts the storage as the home of the user, like eosfs does:
+	// the server scopes every request to the user, so the root of the storage
+	// is the home. GetHome then returns "/" without asking the server, every
+	// path counts as within the home, and CreateHome also creates the share
+	// folder.
+	EnableHome bool `mapstructure:"enable_home"`
+	// ShareFolder is the folder in the home where received shares are
+	// mounted. It is only used with enable_home, where CreateHome creates it.
+	// ValidateShareFolder checks it. Defaults to "/Shares".
+	ShareFolder string `mapstructure:"share_folder"`
+	// CaseInsensitivePaths makes GetMD and ListFolder retry a reference that was
+	// not found with a case-insensitive lookup on the server. Every miss then
+	// costs an extra round-trip and a server-side search, so only enable this
+	// for clients that really depend on it.
+	CaseInsensitivePaths bool `mapstructure:"case_insensitive_paths"`
+	// MaxListEntries makes ListFolder fail instead of returning more entries
+	// than this. Zero, the default, means unlimited.
+	MaxListEntries int `mapstructure:"max_list_entries"`
+	// MaxRetries is how many times a call is retried after a network error or
+	// a 502, 503 or 504 response. Calls that change something are only retried
+	// if the server could not be connected to at all, as otherwise it may
+	// have done them already. Defaults to 0, no retries.
+	MaxRetries int `mapstructure:"max_retries"`
+	// RetryBackoffMs is how long, in milliseconds, the first retry waits; each
+	// further one waits about twice as long as the one before. Defaults to 100.
+	RetryBackoffMs int `mapstructure:"retry_backoff_ms"`
+	// RetryBudgetSize caps the retries of all calls together: at most this many
+	// can be done in a burst, after which calls fail without retrying until
+	// the budget refills. Zero means no cap.
+	RetryBudgetSize int `mapstructure:"retry_budget_size"`
+	// RetryBudgetRate is how many retries per second are added back to the budget.
+	RetryBudgetRate float64 `mapstructure:"retry_budget_rate"`
+	// ChunkSize is the size in bytes of the chunks UploadTUS sends. Defaults
+	// to the chunk size advertised in the server capabilities.
+	ChunkSize int64 `mapstructure:"chunk_size"`
+	// Language is sent as Accept-Language, so the server phrases its messages
+	// in it. A language set with ContextSetLanguage takes precedence.
+	Language string `mapstructure:"language"`
+	// Timeout is the timeout in seconds for a whole request to the server.
+	// Defaults to 0, no timeout.
+	Timeout int64 `mapstructure:"timeout"`
+	// DialTimeout is the timeout in seconds for connecting to the server, so
+	// that an unreachable server fails fast even if Timeout is generous.
+	// Defaults to 0, the timeout of the operating system.
+	DialTimeout int64 `mapstructure:"dial_timeout"`
+	// KeepTrailingSlash sends reference paths to the server as they come.
+	// By default a trailing slash is dropped, so that "/dir/" and "/dir" are
+	// the same to the server, whichever form a client uses.
+	KeepTrailingSlash bool `mapstructure:"keep_trailing_slash"`
+	// DownloadRetries is how many times Download resumes, with a ranged request,
+	// when the connection breaks off halfway. Defaults to 0, no resuming.
+	DownloadRetries int `mapstructure:"download_retries"`
+	// HomeQuota is the quota in bytes CreateHome gives a new home. Defaults to
+	// 0, which leaves it to the server.
+	HomeQuota uint64 `mapstructure:"home_quota"`
+	// AdminUsers are the usernames of the users allowed to call the methods
+	// that cover the whole server, like GetSystemStats. Defaults to none.
+	AdminUsers []string `mapstructure:"admin_users"`
+	// MaxErrorBodyLog is how many bytes of the body of an error response go
+	// into the error and the logs; the rest is cut off. Defaults to 1024. A
+	// negative value keeps the whole body.
+	MaxErrorBodyLog int `mapstructure:"max_error_body_log"`
+	// DisabledOperations are operations the driver refuses with an
+	// OperationDisabled error, without asking the server, e.g. "EmptyRecycle".
+	// They are named after the calls the driver sends to the server, which
+	// mostly match the methods. Disabling an operation disables all methods
+	// built on it, e.g. disabling "Move" disables MoveAndStat and MoveMulti
+	// too.
+	DisabledOperations []string `mapstructure:"disabled_operations"`
+	// UserPathTemplate is the template for the part of the request path that
+	// names the user, following the endpoint, e.g. "~{{.Username}}" or
+	// "remote.php/dav/files/{{.Id.OpaqueId}}". See the templates package for
+	// the placeholders. Defaults to "~" followed by the user id.
+	UserPathTemplate string `mapstructure:"user_path_template"`
+	// AutoCreateShareFolder makes ValidateShareFolder create the share folder
+	// if the server does not have it yet.
+	AutoCreateShareFolder bool `mapstructure:"auto_create_share_folder"`
+	// UnicodeNormalization is the unicode normalization form, "nfc" or "nfd",
+	// that reference paths are brought into before they are sent to the
+	// server, e.g. "nfc" for macOS clients that send decomposed filenames to
+	// a server that stores them composed. Defaults to "none", sending paths
+	// as they come.
+	UnicodeNormalization string `mapstructure:"unicode_normalization"`
+	// RequestServerCompression asks the server to store uploads compressed,
+	// which pays off for text-heavy files. It is only a hint; GetMD reports
+	// whether a file ended up compressed, see IsCompressed.
+	RequestServerCompression bool `mapstructure:"request_server_compression"`
+	// FollowSymlinks makes GetMD of a symlink, as external storages may have,
+	// return the metadata of its target instead. ListFolder always lists
+	// symlinks as such, with their target. Defaults to false.
+	FollowSymlinks bool `mapstructure:"follow_symlinks"`
+	// FallbackEndPoint is a second endpoint, e.g. of a standby server, to
+	// send a request to once when the endpoint cannot be reached at all.
+	// Requests that got a response, even an error, are not sent again.
+	FallbackEndPoint string `mapstructure:"fallback_endpoint"`
+	// UploadConflictPolicy tells the server what Upload does when a file with
+	// the same name exists: "overwrite" it, the default, "rename" the upload,
+	// e.g. to "file (2).txt", or "fail" with an AlreadyExists error. See
+	// UploadWithFinalPath for learning the name of a renamed upload.
+	UploadConflictPolicy string `mapstructure:"upload_conflict_policy"`
+}
+
+func (c *StorageDriverConfig) init() {
+	if c.ShareFolder == "" {
+		c.ShareFolder = "/Shares"
+	}
+	if c.MaxErrorBodyLog == 0 {
+		c.MaxErrorBodyLog = 1024
+	}
+}
+
+func (c *StorageDriverConfig) validate() error {
+	if c.EnableHome && !path.IsAbs(c.ShareFolder) {
+		return errors.New("nextcloud storage driver: 'share_folder' must be an absolute path, got " + c.ShareFolder)
+	}
+	if c.UserPathTemplate != "" {
+		if err := validateUserPathTemplate(c.UserPathTemplate); err != nil {
+			return err
+		}
+	}
+	if !isConflictPolicy(c.UploadConflictPolicy) {
+		return errors.New("nextcloud storage driver: 'upload_conflict_policy' must be overwrite, rename or fail, got " + c.UploadConflictPolicy)
+	}
+	switch c.UnicodeNormalization {
+	case "", "none", "nfc", "nfd":
+	default:
+		return errors.New("nextcloud storage driver: 'unicode_normalization' must be nfc, nfd or none, got " + c.UnicodeNormalization)
+	}
+	for _, op := range c.DisabledOperations {
+		if _, ok := operations[op]; !ok {
+			return errors.New("nextcloud storage driver: unknown operation in 'disabled_operations': " + op)
+		}
+	}
+	for name := range c.SharePermissionsMapping {
+		if !isKnownPermission(name) {
+			return errors.New("nextcloud storage driver: unknown permission in 'share_permissions_mapping': " + name)
+		}
+	}
+	return nil
+}
+
+// validateUserPathTemplate renders tpl for an empty user, to catch a broken
+// template at startup rather than on the first request.
+func validateUserPathTemplate(tpl string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("nextcloud storage driver: invalid 'user_path_template': %v", r)
+		}
+	}()
+	templates.WithUser(&user.User{Id: &user.UserId{}}, tpl)
+	return nil
 }
 
 // StorageDriver implements the storage.FS interface
 // and connects with a StorageDriver server as its backend.
 type StorageDriver struct {
-	endPoint     string
-	sharedSecret string
-	client       *http.Client
+	endPointMu      sync.RWMutex
+	endPoint        string
+	sharedSecret    string
+	client          *http.Client
+	permsBitmask    bool
+	permsMapper     *PermissionsMapper
+	uploadMimes     []string
+	enableHome      bool
+	shareFolder     string
+	autoShares      bool
+	caseInsens      bool
+	maxListEntries  int
+	maxRetries      int
+	retryBackoff    time.Duration
+	retryBudget     *retryBudget
+	chunkSize       int64
+	language        string
+	keepSlash       bool
+	userTemplate    string
+	downloadRetries int
+	homeQuota       uint64
+	adminUsers      []string
+	maxErrorBody    int
+	disabledOps     map[string]bool
+	unicodeForm     string
+	compress        bool
+	followLinks     bool
+	fallback        string
+	conflictPolicy  string
+	stats           stats
+	homes           sync.Map // user id -> home path, for WithinHome
+	capabilities    sync.Map // user id -> *serverCapabilities, for getCapabilities
 }
 
 func parseConfig(m map[string]interface{}) (*StorageDriverConfig, error) {
@@ -79,7 +285,13 @@ func New(m map[string]interface{}) (storage.FS, error) {
 }
 
 // NewStorageDriver returns a new NextcloudStorageDriver.
-func NewStorageDriver(c *StorageDriverConfig) (*StorageDriver, error) {
+func NewStorageDriver(conf *StorageDriverConfig) (*StorageDriver, error) {
+	// the defaults go into a copy, leaving the config of the caller alone
+	c := *conf
+	c.init()
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
 	var client *http.Client
 	if c.MockHTTP {
 		// called := make([]string, 0)
@@ -96,27 +308,377 @@ func NewStorageDriver(c *StorageDriverConfig) (*StorageDriver, error) {
 		if len(c.EndPoint) == 0 {
 			return nil, errors.New("Please specify 'endpoint' in '[grpc.services.storageprovider.drivers.nextcloud]'")
 		}
-		client = &http.Client{}
+		client = &http.Client{
+			Timeout: time.Duration(c.Timeout) * time.Second,
+		}
+		if c.DialTimeout > 0 {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.DialContext = (&net.Dialer{
+				Timeout:   time.Duration(c.DialTimeout) * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext
+			client.Transport = transport
+		}
+	}
+	disabledOps := make(map[string]bool, len(c.DisabledOperations))
+	for _, op := range c.DisabledOperations {
+		disabledOps[op] = true
+	}
+	return &StorageDriver{
+		endPoint:        c.EndPoint, // e.g. "http://nc/apps/sciencemesh/"
+		sharedSecret:    c.SharedSecret,
+		client:          client,
+		permsBitmask:    c.SharePermissionsBitmask,
+		permsMapper:     NewPermissionsMapper(c.SharePermissionsMapping),
+		uploadMimes:     c.AllowedUploadMimeTypes,
+		enableHome:      c.EnableHome,
+		shareFolder:     c.ShareFolder,
+		autoShares:      c.AutoCreateShareFolder,
+		caseInsens:      c.CaseInsensitivePaths,
+		maxListEntries:  c.MaxListEntries,
+		maxRetries:      c.MaxRetries,
+		retryBackoff:    time.Duration(c.RetryBackoffMs) * time.Millisecond,
+		retryBudget:     newRetryBudget(c.RetryBudgetRate, c.RetryBudgetSize),
+		chunkSize:       c.ChunkSize,
+		language:        c.Language,
+		keepSlash:       c.KeepTrailingSlash,
+		userTemplate:    c.UserPathTemplate,
+		downloadRetries: c.DownloadRetries,
+		homeQuota:       c.HomeQuota,
+		adminUsers:      c.AdminUsers,
+		maxErrorBody:    c.MaxErrorBodyLog,
+		disabledOps:     disabledOps,
+		unicodeForm:     c.UnicodeNormalization,
+		compress:        c.RequestServerCompression,
+		followLinks:     c.FollowSymlinks,
+		fallback:        c.FallbackEndPoint,
+		conflictPolicy:  c.UploadConflictPolicy,
+	}, nil
+}
+
+// WithEndpoint returns a driver like nc that talks to the Nextcloud instance at
+// endpoint instead, e.g. for a gateway in front of several instances. The new
+// driver shares the http client of nc, but has its own caches, stats and retry
+// budget, since those belong to an instance. It has no fallback_endpoint either,
+// as that is a standby of nc's instance, which must not get the new one's calls.
+func (nc *StorageDriver) WithEndpoint(endpoint string) (*StorageDriver, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errtypes.BadRequest("nextcloud storage driver: invalid endpoint " + endpoint)
+	}
+	if !strings.HasSuffix(endpoint, "/") {
+		endpoint += "/"
 	}
 	return &StorageDriver{
-		endPoint:     c.EndPoint, // e.g. "http://nc/apps/sciencemesh/"
-		sharedSecret: c.SharedSecret,
-		client:       client,
+		endPoint:        endpoint,
+		sharedSecret:    nc.sharedSecret,
+		client:          nc.client,
+		permsBitmask:    nc.permsBitmask,
+		permsMapper:     nc.permsMapper,
+		uploadMimes:     nc.uploadMimes,
+		enableHome:      nc.enableHome,
+		shareFolder:     nc.shareFolder,
+		autoShares:      nc.autoShares,
+		caseInsens:      nc.caseInsens,
+		maxListEntries:  nc.maxListEntries,
+		maxRetries:      nc.maxRetries,
+		retryBackoff:    nc.retryBackoff,
+		retryBudget:     nc.retryBudget.fresh(),
+		chunkSize:       nc.chunkSize,
+		language:        nc.language,
+		keepSlash:       nc.keepSlash,
+		userTemplate:    nc.userTemplate,
+		downloadRetries: nc.downloadRetries,
+		homeQuota:       nc.homeQuota,
+		adminUsers:      nc.adminUsers,
+		maxErrorBody:    nc.maxErrorBody,
+		disabledOps:     nc.disabledOps,
+		unicodeForm:     nc.unicodeForm,
+		compress:        nc.compress,
+		followLinks:     nc.followLinks,
+		conflictPolicy:  nc.conflictPolicy,
 	}, nil
 }
 
+// SpaceRootKey is the opaque key under which GetMD returns the json encoded
+// id of the root of the space a resource lives in.
+const SpaceRootKey = "space_root"
+
+// PurgeAfterKey is the opaque key under which ListRecycle returns when an item
+// will be purged from the recycle bin automatically, in seconds since the epoch.
+// Use PurgeAfter to read it.
+const PurgeAfterKey = "purge_after"
+
+// PurgeAfter returns when the recycle bin item will be purged automatically,
+// or the zero time if the server did not say.
+func PurgeAfter(item *provider.RecycleItem) time.Time {
+	entry, ok := item.GetOpaque().GetMap()[PurgeAfterKey]
+	if !ok {
+		return time.Time{}
+	}
+	secs, err := strconv.ParseInt(string(entry.Value), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// TrashedKey is the opaque key marking the trashed entries that ListFolder
+// returns for a context set with ContextSetIncludeTrashed. Use IsTrashed to
+// read it.
+const TrashedKey = "trashed"
+
+// IsTrashed reports whether the resource was listed from the trash.
+func IsTrashed(info *provider.ResourceInfo) bool {
+	entry, ok := info.GetOpaque().GetMap()[TrashedKey]
+	return ok && string(entry.Value) == "true"
+}
+
+// CompressedKey is the opaque key marking, in the result of GetMD, a file the
+// server stores compressed. Use IsCompressed to read it.
+const CompressedKey = "compressed"
+
+// IsCompressed reports whether the server stores the file compressed.
+func IsCompressed(info *provider.ResourceInfo) bool {
+	entry, ok := info.GetOpaque().GetMap()[CompressedKey]
+	return ok && string(entry.Value) == "true"
+}
+
+// BtimeKey is the opaque key holding, in the result of GetMD, the creation
+// time of a resource in seconds since the epoch, if the server reports it. Use
+// CreationTime to read it.
+const BtimeKey = "btime"
+
+// CreationTime returns the creation time of info, if the server reported it.
+func CreationTime(info *provider.ResourceInfo) (time.Time, bool) {
+	entry, ok := info.GetOpaque().GetMap()[BtimeKey]
+	if !ok {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(string(entry.Value), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
 // Action describes a REST request to forward to the Nextcloud backend.
 type Action struct {
 	verb string
 	argS string
 }
 
+// ErrNotModified is returned by conditional requests, like GetMDIfModifiedSince,
+// when the resource did not change.
+var ErrNotModified = errors.New("nextcloud storage driver: not modified")
+
+// spaceDisabledMsg starts the body of the 403 the server sends for operations on a disabled space.
+const spaceDisabledMsg = "space is disabled"
+
+// SpaceDisabled is the error returned for operations on a storage space that
+// was disabled with SetSpaceEnabled.
+type SpaceDisabled string
+
+func (e SpaceDisabled) Error() string { return "error: unavailable: " + string(e) }
+
+// IsPermissionDenied implements the errtypes.IsPermissionDenied interface.
+// errtypes has nothing for a resource that is unavailable for a while, and
+// the server refuses with a 403, so callers that only know errtypes treat it
+// like any other refusal.
+func (e SpaceDisabled) IsPermissionDenied() {}
+
+// OperationDisabled is the error returned for an operation that is one of the
+// disabled_operations.
+type OperationDisabled string
+
+func (e OperationDisabled) Error() string { return "error: operation disabled: " + string(e) }
+
+// IsPermissionDenied implements the errtypes.IsPermissionDenied interface.
+func (e OperationDisabled) IsPermissionDenied() {}
+
+// activeSharesMsg starts the body of the 409 the server sends when asked to
+// purge the data of a user who still has active shares.
+const activeSharesMsg = "user has active shares"
+
+// ActiveShares is the error returned by PurgeUserData, when not forced, for a
+// user who still has active shares.
+type ActiveShares string
+
+func (e ActiveShares) Error() string { return "error: user has active shares: " + string(e) }
+
+// Locked is the error returned for a resource that is locked, e.g. by another
+// user.
+type Locked string
+
+func (e Locked) Error() string { return "error: locked: " + string(e) }
+
+// InvalidShareFolder is the error returned by ValidateShareFolder when the
+// configured share folder is missing on the server or is not a folder.
+type InvalidShareFolder string
+
+func (e InvalidShareFolder) Error() string { return "error: invalid share folder: " + string(e) }
+
+// MultiError collects the errors of a bulk operation that failed for some
+// of the resources it was applied to.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors occurred: %s", len(e), strings.Join(msgs, "; "))
+}
+
+type languageKey struct{}
+
+// ContextSetLanguage stores the preferred language of the acting user in the
+// context, e.g. "de" or "fr-CH, fr;q=0.9".
+func ContextSetLanguage(ctx context.Context, lang string) context.Context {
+	return context.WithValue(ctx, languageKey{}, lang)
+}
+
+// ContextGetLanguage returns the preferred language if set in the given context.
+func ContextGetLanguage(ctx context.Context) (string, bool) {
+	lang, ok := ctx.Value(languageKey{}).(string)
+	return lang, ok
+}
+
+// setLanguage asks the server to respond in the language from the context,
+// or else the configured one.
+func (nc *StorageDriver) setLanguage(ctx context.Context, req *http.Request) {
+	lang, ok := ContextGetLanguage(ctx)
+	if !ok || lang == "" {
+		lang = nc.language
+	}
+	if lang != "" {
+		req.Header.Set("Accept-Language", lang)
+	}
+}
+
+type unmodifiedSinceKey struct{}
+
+// ContextSetUnmodifiedSince makes the calls done with the returned context
+// conditional: the server only applies them if the resource was not modified
+// after the given time, and otherwise they fail with an Aborted error. It is
+// meant for guarding writes, so only use the context for those.
+func ContextSetUnmodifiedSince(ctx context.Context, since time.Time) context.Context {
+	return context.WithValue(ctx, unmodifiedSinceKey{}, since)
+}
+
+// ContextGetUnmodifiedSince returns the time set with ContextSetUnmodifiedSince,
+// if any.
+func ContextGetUnmodifiedSince(ctx context.Context) (time.Time, bool) {
+	since, ok := ctx.Value(unmodifiedSinceKey{}).(time.Time)
+	return since, ok && !since.IsZero()
+}
+
+type creationTimeKey struct{}
+
+// ContextSetCreationTime makes Upload, called with the returned context, ask
+// the server to give the uploaded file the creation time t rather than the
+// current time, e.g. to keep it when migrating files. GetMD reports it back,
+// see CreationTime.
+func ContextSetCreationTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, creationTimeKey{}, t)
+}
+
+// ContextGetCreationTime returns the time set with ContextSetCreationTime, if
+// any.
+func ContextGetCreationTime(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(creationTimeKey{}).(time.Time)
+	return t, ok && !t.IsZero()
+}
+
+type warningsKey struct{}
+
+// Warnings collects the warnings the server sends along with successful
+// responses, in a "warnings" array, e.g. when part of the metadata was not
+// available. They do not make the calls fail.
+type Warnings struct {
+	mu   sync.Mutex
+	list []string
+}
+
+// List returns the warnings collected so far.
+func (w *Warnings) List() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.list...)
+}
+
+func (w *Warnings) add(warnings []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.list = append(w.list, warnings...)
+}
+
+// ContextSetWarnings makes the calls done with the returned context collect
+// the warnings of the server in w.
+func ContextSetWarnings(ctx context.Context, w *Warnings) context.Context {
+	return context.WithValue(ctx, warningsKey{}, w)
+}
+
+// collectWarnings logs the warnings in a response body, and adds them to the
+// Warnings set in ctx, if any.
+func collectWarnings(ctx context.Context, body []byte) {
+	if !bytes.Contains(body, []byte(`"warnings"`)) {
+		return
+	}
+	var respObj struct {
+		Warnings []string `json:"warnings"`
+	}
+	if err := json.Unmarshal(body, &respObj); err != nil || len(respObj.Warnings) == 0 {
+		return
+	}
+	appctx.GetLogger(ctx).Warn().Strs("warnings", respObj.Warnings).Msg("nextcloud storage driver: server sent warnings")
+	if w, ok := ctx.Value(warningsKey{}).(*Warnings); ok {
+		w.add(respObj.Warnings)
+	}
+}
+
+type includeTrashedKey struct{}
+
+// ContextSetIncludeTrashed makes ListFolder, called with the returned context,
+// also list the children of the folder that are in the trash, marked with
+// TrashedKey.
+func ContextSetIncludeTrashed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeTrashedKey{}, true)
+}
+
+func contextIncludeTrashed(ctx context.Context) bool {
+	include, _ := ctx.Value(includeTrashedKey{}).(bool)
+	return include
+}
+
+// authorize sets the headers that authenticate req to the server: the shared
+// secret of the driver, and the access token of the caller from ctx, both as
+// X-Access-Token and as X-Reva-Token. Without an access token, the request
+// is not sent at all; without a shared secret, X-Reva-Secret is left out.
+func (nc *StorageDriver) authorize(ctx context.Context, req *http.Request) error {
+	tkn, ok := ctxpkg.ContextGetToken(ctx)
+	if !ok || tkn == "" {
+		return errtypes.InvalidCredentials("nextcloud storage driver: no access token in ctx")
+	}
+	if nc.sharedSecret != "" {
+		req.Header.Set("X-Reva-Secret", nc.sharedSecret)
+	}
+	req.Header.Set("X-Access-Token", tkn)
+	req.Header.Set("X-Reva-Token", tkn)
+	return nil
+}
+
 func getUser(ctx context.Context) (*user.User, error) {
 	u, ok := ctxpkg.ContextGetUser(ctx)
 	if !ok {
 		err := errors.Wrap(errtypes.UserRequired(""), "nextcloud storage driver: error getting user from ctx")
 		return nil, err
 	}
+	// the request paths are built from the user id
+	if u.GetId().GetOpaqueId() == "" {
+		err := errors.Wrap(errtypes.UserRequired(u.GetUsername()), "nextcloud storage driver: user in ctx has no id")
+		return nil, err
+	}
 	return u, nil
 }
 
@@ -125,599 +687,3196 @@ func (nc *StorageDriver) SetHTTPClient(c *http.Client) {
 	nc.client = c
 }
 
-func (nc *StorageDriver) doUpload(ctx context.Context, filePath string, r io.ReadCloser) error {
-	// log := appctx.GetLogger(ctx)
-	// log.Error().Msgf("in doUpload!  %s", filePath)
+// SetRoundTripper layers middleware, e.g. for logging or tracing, onto the
+// transport of the HTTP client: wrap gets the current transport and returns
+// the one to use instead. Requests reach the middleware with all headers the
+// driver sets already in place. Call it after SetHTTPClient, which replaces
+// the client including its transport.
+func (nc *StorageDriver) SetRoundTripper(wrap func(next http.RoundTripper) http.RoundTripper) {
+	c := *nc.client
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	c.Transport = wrap(next)
+	nc.client = &c
+}
+
+// doUpload uploads the file and returns the id the server assigned to it, if
+// reported, and the path the file ended up at, which differs from filePath
+// when the server renamed it under the "rename" upload_conflict_policy.
+func (nc *StorageDriver) doUpload(ctx context.Context, filePath string, r io.ReadCloser) (*provider.ResourceId, string, error) {
+	// the http client closes r once it sent the request, but not if we bail
+	// out before that
+	defer r.Close()
 	user, err := getUser(ctx)
 	if err != nil {
-		// log.Error().Msg("error getting user!")
-		return err
+		return nil, "", err
+	}
+	if err := nc.checkEnabled("Upload"); err != nil {
+		return nil, "", err
 	}
-	// log.Error().Msgf("got user! %+v", user)
 
 	// See https://github.com/pondersource/nc-sciencemesh/issues/5
 	// url := nc.endPoint + "~" + user.Username + "/files/" + filePath
-	url := nc.endPoint + "~" + user.Id.OpaqueId + "/api/storage/Upload/home" + filePath
-	// log.Error().Msgf("sending PUT to NC/OC!  %s", url)
-	req, err := http.NewRequest(http.MethodPut, url, r)
+	url := nc.getEndPoint() + nc.userPath(user, "~"+user.Id.OpaqueId) + "/api/storage/Upload/home" + filePath
+	defer closeOnDone(ctx, r)()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, r)
 	if err != nil {
-		// log.Error().Msgf("error!  %s", err.Error())
-		panic(err)
+		return nil, "", err
 	}
 
-	req.Header.Set("X-Reva-Secret", nc.sharedSecret)
+	if err := nc.authorize(ctx, req); err != nil {
+		return nil, "", err
+	}
 	// set the request header Content-Type for the upload
 	// FIXME: get the actual content type from somewhere
 	req.Header.Set("Content-Type", "text/plain")
-	// log.Error().Msg("client req")
-	resp, err := nc.client.Do(req)
+	if nc.compress {
+		req.Header.Set("X-Reva-Compress", "true")
+	}
+	if nc.conflictPolicy != "" {
+		req.Header.Set("X-Reva-Conflict-Policy", nc.conflictPolicy)
+	}
+	if ctime, ok := ContextGetCreationTime(ctx); ok {
+		req.Header.Set("X-OC-CTime", strconv.FormatInt(ctime.Unix(), 10))
+	}
+	resp, err := nc.doRequest(req)
 	if err != nil {
-		// log.Error().Msgf("error!  %s", err.Error())
-		panic(err)
+		return nil, "", err
 	}
 
 	defer resp.Body.Close()
-	_, err = io.ReadAll(resp.Body)
-	return err
-}
-
-func (nc *StorageDriver) doDownload(ctx context.Context, filePath string) (io.ReadCloser, error) {
-	user, err := getUser(ctx)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	// See https://github.com/pondersource/nc-sciencemesh/issues/5
-	// url := nc.endPoint + "~" + user.Username + "/files/" + filePath
-	url := nc.endPoint + "~" + user.Username + "/api/storage/Download/" + filePath
-	req, err := http.NewRequest(http.MethodGet, url, strings.NewReader(""))
-	if err != nil {
-		panic(err)
+	if err := nc.responseError(resp.StatusCode, body); err != nil {
+		return nil, "", err
 	}
-
-	resp, err := nc.client.Do(req)
+	id, err := decodeUploadedID(body)
 	if err != nil {
-		panic(err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		panic("No 200 response code in download request")
+		return nil, "", err
 	}
+	return id, decodeFinalPath(body, filePath), nil
+}
 
-	return resp.Body, err
+// closeOnDone closes r once ctx is done, until the returned function is
+// called. The http client only aborts a cancelled request after the body
+// read in progress returns, which may be never if the source of the upload
+// stalled; closing it makes the read return.
+func closeOnDone(ctx context.Context, r io.ReadCloser) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
 }
 
-func (nc *StorageDriver) doDownloadRevision(ctx context.Context, filePath string, key string) (io.ReadCloser, error) {
-	user, err := getUser(ctx)
-	if err != nil {
-		return nil, err
+// decodeUploadedID extracts the id the server assigned to an uploaded file from
+// the upload response body. Servers that do not report it send an empty body.
+func decodeUploadedID(body []byte) (*provider.ResourceId, error) {
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return nil, nil
 	}
-	// See https://github.com/pondersource/nc-sciencemesh/issues/5
-	url := nc.endPoint + "~" + user.Username + "/api/storage/DownloadRevision/" + url.QueryEscape(key) + "/" + filePath
-	req, err := http.NewRequest(http.MethodGet, url, strings.NewReader(""))
-	if err != nil {
-		panic(err)
+	var respObj struct {
+		ID *provider.ResourceId `json:"id"`
+	}
+	if err := json.Unmarshal(body, &respObj); err != nil {
+		return nil, err
 	}
-	req.Header.Set("X-Reva-Secret", nc.sharedSecret)
+	return respObj.ID, nil
+}
 
-	resp, err := nc.client.Do(req)
-	if err != nil {
-		panic(err)
+// decodeFinalPath returns the path the server reports an uploaded or moved
+// resource ended up at, or filePath if it does not report one.
+func decodeFinalPath(body []byte, filePath string) string {
+	var respObj struct {
+		Path string `json:"path"`
 	}
-	if resp.StatusCode != http.StatusOK {
-		panic("No 200 response code in download request")
+	if err := json.Unmarshal(body, &respObj); err != nil || respObj.Path == "" {
+		return filePath
 	}
+	return respObj.Path
+}
 
-	return resp.Body, err
+// tusOffset asks the TUS endpoint at url how many bytes of the upload it already has.
+func (nc *StorageDriver) tusOffset(ctx context.Context, url string) (int64, error) {
+	offset, err := nc.GetUploadOffset(ctx, url)
+	if _, ok := err.(errtypes.IsNotFound); ok {
+		// nothing was uploaded yet
+		return 0, nil
+	}
+	return offset, err
 }
 
-func (nc *StorageDriver) do(ctx context.Context, a Action) (int, []byte, error) {
-	log := appctx.GetLogger(ctx)
-	user, err := getUser(ctx)
+// GetUploadOffset returns how many bytes of the TUS upload at uploadURL the
+// server has received so far, e.g. to show the progress of the upload or to
+// decide where to resume it. uploadURL may be relative to the endpoint. An
+// upload the server does not know gives a NotFound error.
+func (nc *StorageDriver) GetUploadOffset(ctx context.Context, uploadURL string) (int64, error) {
+	u, err := url.Parse(uploadURL)
 	if err != nil {
-		return 0, nil, err
+		return 0, errtypes.BadRequest("nextcloud storage driver: invalid upload url " + uploadURL)
 	}
-	// See https://github.com/cs3org/reva/issues/2377
-	// for discussion of user.Username vs user.Id.OpaqueId
-	url := nc.endPoint + "~" + user.Id.OpaqueId + "/api/storage/" + a.verb
-	log.Info().Msgf("nc.do req %s %s", url, a.argS)
-	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(a.argS))
+	if !u.IsAbs() {
+		uploadURL = nc.getEndPoint() + strings.TrimPrefix(uploadURL, "/")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, uploadURL, nil)
 	if err != nil {
-		return 0, nil, err
+		return 0, err
 	}
-	req.Header.Set("X-Reva-Secret", nc.sharedSecret)
-
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := nc.client.Do(req)
+	if err := nc.authorize(ctx, req); err != nil {
+		return 0, err
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	resp, err := nc.doRequest(req)
 	if err != nil {
-		return 0, nil, err
+		return 0, err
 	}
-
 	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
 
-	if err != nil {
-		return 0, nil, err
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, errtypes.NotFound(uploadURL)
 	}
-	log.Info().Msgf("nc.do res %s %s", url, string(body))
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNotFound {
-		return 0, nil, fmt.Errorf("Unexpected response code from EFSS API: " + strconv.Itoa(resp.StatusCode) + ":" + string(body))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return 0, fmt.Errorf("Unexpected response code from EFSS API: " + strconv.Itoa(resp.StatusCode))
 	}
-	return resp.StatusCode, body, nil
-}
-
-// GetHome as defined in the storage.FS interface.
-func (nc *StorageDriver) GetHome(ctx context.Context) (string, error) {
-	log := appctx.GetLogger(ctx)
-	log.Info().Msg("GetHome")
-
-	_, respBody, err := nc.do(ctx, Action{"GetHome", ""})
-	return string(respBody), err
-}
-
-// CreateHome as defined in the storage.FS interface.
-func (nc *StorageDriver) CreateHome(ctx context.Context) error {
-	log := appctx.GetLogger(ctx)
-	log.Info().Msg("CreateHome")
-
-	_, _, err := nc.do(ctx, Action{"CreateHome", ""})
-	return err
-}
-
-// CreateDir as defined in the storage.FS interface.
-func (nc *StorageDriver) CreateDir(ctx context.Context, ref *provider.Reference) error {
-	bodyStr, err := json.Marshal(ref)
-	if err != nil {
-		return err
+	offset := resp.Header.Get("Upload-Offset")
+	if offset == "" {
+		return 0, nil
 	}
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("CreateDir %s", bodyStr)
-
-	_, _, err = nc.do(ctx, Action{"CreateDir", string(bodyStr)})
-	return err
-}
-
-// TouchFile as defined in the storage.FS interface.
-func (nc *StorageDriver) TouchFile(ctx context.Context, ref *provider.Reference) error {
-	return fmt.Errorf("unimplemented: TouchFile")
+	return strconv.ParseInt(offset, 10, 64)
 }
 
-// Delete as defined in the storage.FS interface.
-func (nc *StorageDriver) Delete(ctx context.Context, ref *provider.Reference) error {
-	bodyStr, err := json.Marshal(ref)
+// uploadChunkSize returns the size of the chunks to upload in: the configured
+// chunk size, or else the one the server advertises, clamped to the server's
+// minimum and maximum. Zero means the upload is sent in one go.
+func (nc *StorageDriver) uploadChunkSize(ctx context.Context) (int64, error) {
+	caps, err := nc.getCapabilities(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("Delete %s", bodyStr)
-
-	_, _, err = nc.do(ctx, Action{"Delete", string(bodyStr)})
-	return err
-}
-
-// Move as defined in the storage.FS interface.
-func (nc *StorageDriver) Move(ctx context.Context, oldRef, newRef *provider.Reference) error {
-	type paramsObj struct {
-		OldRef *provider.Reference `json:"oldRef"`
-		NewRef *provider.Reference `json:"newRef"`
+	size := caps.ChunkSize
+	if nc.chunkSize > 0 {
+		size = nc.chunkSize
 	}
-	bodyObj := &paramsObj{
-		OldRef: oldRef,
-		NewRef: newRef,
+	if size <= 0 {
+		return 0, nil
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("Move %s", bodyStr)
-
-	_, _, err := nc.do(ctx, Action{"Move", string(bodyStr)})
-	return err
-}
-
-// GetMD as defined in the storage.FS interface.
-func (nc *StorageDriver) GetMD(ctx context.Context, ref *provider.Reference, mdKeys []string) (*provider.ResourceInfo, error) {
-	type paramsObj struct {
-		Ref    *provider.Reference `json:"ref"`
-		MdKeys []string            `json:"mdKeys"`
-		// MetaData provider.ResourceInfo `json:"metaData"`
+	if caps.MinChunkSize > 0 && size < caps.MinChunkSize {
+		size = caps.MinChunkSize
 	}
-	bodyObj := &paramsObj{
-		Ref:    ref,
-		MdKeys: mdKeys,
+	if caps.MaxChunkSize > 0 && size > caps.MaxChunkSize {
+		size = caps.MaxChunkSize
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("GetMD %s", bodyStr)
+	return size, nil
+}
 
-	status, body, err := nc.do(ctx, Action{"GetMD", string(bodyStr)})
+// serverCapabilities are what the server advertises about itself.
+type serverCapabilities struct {
+	UploadProtocols []string `json:"uploadProtocols"`
+	ChunkSize       int64    `json:"chunkSize"`
+	MinChunkSize    int64    `json:"minChunkSize"`
+	MaxChunkSize    int64    `json:"maxChunkSize"`
+}
+
+// getCapabilities returns the capabilities of the server, as seen by the user
+// in ctx. Older servers, which have no capabilities to tell, get empty ones.
+// The result is cached per user.
+func (nc *StorageDriver) getCapabilities(ctx context.Context) (*serverCapabilities, error) {
+	u, err := getUser(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if status == 404 {
-		return nil, errtypes.NotFound("")
+	if caps, ok := nc.capabilities.Load(u.Id.OpaqueId); ok {
+		return caps.(*serverCapabilities), nil
 	}
-	var respObj provider.ResourceInfo
-	err = json.Unmarshal(body, &respObj)
+	status, respBody, _, err := nc.doAllowingNotFound(ctx, Action{"GetCapabilities", ""}, nil)
 	if err != nil {
 		return nil, err
 	}
-	return &respObj, nil
+	caps := &serverCapabilities{}
+	if status != http.StatusNotFound {
+		if err := json.Unmarshal(respBody, caps); err != nil {
+			return nil, err
+		}
+	}
+	cached, _ := nc.capabilities.LoadOrStore(u.Id.OpaqueId, caps)
+	return cached.(*serverCapabilities), nil
 }
 
-// ListFolder as defined in the storage.FS interface.
-func (nc *StorageDriver) ListFolder(ctx context.Context, ref *provider.Reference, mdKeys []string) ([]*provider.ResourceInfo, error) {
-	type paramsObj struct {
-		Ref    *provider.Reference `json:"ref"`
-		MdKeys []string            `json:"mdKeys"`
+// SupportedUploadProtocols returns the upload protocols the server supports,
+// most preferred first, as advertised in its capabilities. Servers that don't
+// advertise any are assumed to only support simple uploads. The result is
+// cached per user.
+func (nc *StorageDriver) SupportedUploadProtocols(ctx context.Context) ([]string, error) {
+	caps, err := nc.getCapabilities(ctx)
+	if err != nil {
+		return nil, err
 	}
-	bodyObj := &paramsObj{
-		Ref:    ref,
-		MdKeys: mdKeys,
+	if len(caps.UploadProtocols) == 0 {
+		return []string{"simple"}, nil
 	}
-	bodyStr, err := json.Marshal(bodyObj)
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("ListFolder %s", bodyStr)
+	return caps.UploadProtocols, nil
+}
+
+func (nc *StorageDriver) doUploadTUS(ctx context.Context, filePath string, r io.ReadCloser) (id *provider.ResourceId, err error) {
+	defer r.Close()
+	defer closeOnDone(ctx, r)()
+	user, err := getUser(ctx)
 	if err != nil {
 		return nil, err
 	}
-	status, body, err := nc.do(ctx, Action{"ListFolder", string(bodyStr)})
+	if err := nc.checkEnabled("UploadTUS"); err != nil {
+		return nil, err
+	}
+	url := nc.getEndPoint() + nc.userPath(user, "~"+user.Id.OpaqueId) + "/api/storage/TusUpload/home" + filePath
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			// the caller gave up on the upload, so don't leave the part the
+			// server already got behind
+			nc.terminateTUS(ctx, url)
+		}
+	}()
+
+	offset, err := nc.tusOffset(ctx, url)
 	if err != nil {
 		return nil, err
 	}
-	if status == 404 {
-		return nil, errtypes.NotFound("")
+	if offset > 0 {
+		// the server already has the first part, resume from there
+		if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+			return nil, err
+		}
 	}
 
-	var respMapArr []provider.ResourceInfo
-	err = json.Unmarshal(body, &respMapArr)
+	chunkSize, err := nc.uploadChunkSize(ctx)
 	if err != nil {
 		return nil, err
 	}
-	var pointers = make([]*provider.ResourceInfo, len(respMapArr))
-	for i := 0; i < len(respMapArr); i++ {
-		pointers[i] = &respMapArr[i]
+	if chunkSize <= 0 {
+		return nc.patchTUS(ctx, url, offset, r)
 	}
-	return pointers, err
+	br := bufio.NewReader(r)
+	for {
+		chunk, err := io.ReadAll(io.LimitReader(br, chunkSize))
+		if err != nil {
+			return nil, err
+		}
+		id, err := nc.patchTUS(ctx, url, offset, bytes.NewReader(chunk))
+		if err != nil {
+			return nil, err
+		}
+		offset += int64(len(chunk))
+		if _, err := br.Peek(1); err == io.EOF {
+			return id, nil
+		}
+	}
+}
+
+// terminateTUS asks the TUS endpoint at url to throw away the upload. The
+// upload's own context is typically cancelled by then, so the request gets a
+// context of its own, which gives up after terminateTUSTimeout.
+func (nc *StorageDriver) terminateTUS(ctx context.Context, url string) {
+	log := appctx.GetLogger(ctx)
+	tctx, cancel := context.WithTimeout(context.Background(), terminateTUSTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(tctx, http.MethodDelete, url, nil)
+	if err != nil {
+		log.Warn().Err(err).Msgf("nextcloud storage driver: could not terminate upload %s", url)
+		return
+	}
+	if err := nc.authorize(ctx, req); err != nil {
+		log.Warn().Err(err).Msgf("nextcloud storage driver: could not terminate upload %s", url)
+		return
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	resp, err := nc.doRequest(req)
+	if err != nil {
+		log.Warn().Err(err).Msgf("nextcloud storage driver: could not terminate upload %s", url)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		log.Warn().Msgf("nextcloud storage driver: could not terminate upload %s: %d", url, resp.StatusCode)
+	}
+}
+
+// terminateTUSTimeout is how long terminateTUS waits for the server.
+const terminateTUSTimeout = 10 * time.Second
+
+// patchTUS sends the part of the upload in r, which starts at offset.
+func (nc *StorageDriver) patchTUS(ctx context.Context, url string, offset int64, r io.Reader) (*provider.ResourceId, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := nc.authorize(ctx, req); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	resp, err := nc.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("Unexpected response code from EFSS API: " + strconv.Itoa(resp.StatusCode))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// the server reports the id once the last chunk completes the upload
+	return decodeUploadedID(body)
+}
+
+func (nc *StorageDriver) doDownload(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	user, err := getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// See https://github.com/pondersource/nc-sciencemesh/issues/5
+	// url := nc.endPoint + "~" + user.Username + "/files/" + filePath
+	if err := nc.checkEnabled("Download"); err != nil {
+		return nil, err
+	}
+	url := nc.getEndPoint() + nc.userPath(user, "~"+user.Username) + "/api/storage/Download/" + filePath
+	body, err := nc.openDownload(ctx, url, filePath, 0)
+	if err != nil || nc.downloadRetries == 0 {
+		return body, err
+	}
+	return &resumingReader{
+		body:    body,
+		retries: nc.downloadRetries,
+		open: func(offset int64) (io.ReadCloser, error) {
+			appctx.GetLogger(ctx).Info().Msgf("nextcloud storage driver: resuming download of %s at %d", filePath, offset)
+			return nc.openDownload(ctx, url, filePath, offset)
+		},
+	}, nil
+}
+
+// openDownload GETs url, asking for the content from offset on. what names
+// the download, for a NotFound error. The caller owns the returned body.
+func (nc *StorageDriver) openDownload(ctx context.Context, url, what string, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, strings.NewReader(""))
+	if err != nil {
+		return nil, err
+	}
+	if err := nc.authorize(ctx, req); err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := nc.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		contentRange := resp.Header.Get("Content-Range")
+		if start, ok := rangeStart(contentRange); !ok || start != offset {
+			resp.Body.Close()
+			return nil, errtypes.InternalError(fmt.Sprintf("nextcloud storage driver: asked for %s from byte %d, got Content-Range %q", what, offset, contentRange))
+		}
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			// the server ignored the range, skip what was read already
+			if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+		return resp.Body, nil
+	default:
+		defer resp.Body.Close()
+		body, err := nc.readErrorBody(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errtypes.NotFound(what)
+		}
+		if err := nc.responseError(resp.StatusCode, body); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Unexpected response code from EFSS API: " + strconv.Itoa(resp.StatusCode))
+	}
+}
+
+// rangeStart returns the first byte of a Content-Range like "bytes 10-35/36".
+func rangeStart(contentRange string) (int64, bool) {
+	spec := strings.TrimPrefix(contentRange, "bytes ")
+	first, _, ok := strings.Cut(spec, "-")
+	if !ok || spec == contentRange {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	return start, err == nil
+}
+
+// readErrorBody reads the body of an error response, but no more of it than
+// truncateBody keeps.
+func (nc *StorageDriver) readErrorBody(r io.Reader) ([]byte, error) {
+	if nc.maxErrorBody < 0 {
+		return io.ReadAll(r)
+	}
+	return io.ReadAll(io.LimitReader(r, int64(nc.maxErrorBody)+1))
+}
+
+// resumingReader reads a download, and when the connection breaks, opens it
+// again from where it broke off, up to retries times.
+type resumingReader struct {
+	body    io.ReadCloser
+	open    func(offset int64) (io.ReadCloser, error)
+	offset  int64
+	retries int
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == nil || err == io.EOF || r.retries <= 0 {
+		return n, err
+	}
+	r.retries--
+	r.body.Close()
+	body, openErr := r.open(r.offset)
+	if openErr != nil {
+		return n, errors.Wrap(err, "nextcloud storage driver: download broke off and could not be resumed: "+openErr.Error())
+	}
+	r.body = body
+	if n > 0 {
+		return n, nil
+	}
+	return r.Read(p)
+}
+
+func (r *resumingReader) Close() error {
+	return r.body.Close()
+}
+
+func (nc *StorageDriver) doDownloadRevision(ctx context.Context, filePath string, key string) (io.ReadCloser, error) {
+	user, err := getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := nc.checkEnabled("DownloadRevision"); err != nil {
+		return nil, err
+	}
+	// See https://github.com/pondersource/nc-sciencemesh/issues/5
+	url := nc.getEndPoint() + nc.userPath(user, "~"+user.Username) + "/api/storage/DownloadRevision/" + url.QueryEscape(key) + "/" + filePath
+	return nc.openDownload(ctx, url, filePath, 0)
+}
+
+// doStream is like do, but hands back the response body for the caller to
+// stream from instead of reading it into memory.
+func (nc *StorageDriver) doStream(ctx context.Context, a Action) (io.ReadCloser, error) {
+	log := appctx.GetLogger(ctx)
+	user, err := getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := nc.checkEnabled(a.verb); err != nil {
+		return nil, err
+	}
+	url := nc.getEndPoint() + nc.userPath(user, "~"+user.Id.OpaqueId) + "/api/storage/" + a.verb
+	log.Info().Msgf("nc.doStream req %s %s", url, a.argS)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(a.argS))
+	if err != nil {
+		return nil, err
+	}
+	if err := nc.authorize(ctx, req); err != nil {
+		return nil, err
+	}
+	nc.setLanguage(ctx, req)
+
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := nc.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errtypes.NotFound(nc.truncateBody(body))
+		}
+		return nil, nc.responseError(resp.StatusCode, body)
+	}
+	return resp.Body, nil
+}
+
+// operations are the operations disabled_operations can name, which are the
+// calls the driver sends, by the operation that disables them along with it,
+// if any.
+var operations = map[string]string{
+	"AbortUpload":                      "",
+	"AddGrant":                         "",
+	"CheckRetentionLocks":              "",
+	"CompareAndSetMetadata":            "",
+	"Copy":                             "",
+	"CreateDir":                        "",
+	"CreateDirs":                       "CreateDir",
+	"CreateHome":                       "",
+	"CreateReference":                  "",
+	"CreateStorageSpace":               "",
+	"Delete":                           "",
+	"DeleteMulti":                      "Delete",
+	"DenyGrant":                        "",
+	"Download":                         "",
+	"DownloadArchive":                  "Download",
+	"DownloadRevision":                 "Download",
+	"EmptyRecycle":                     "",
+	"GetCapabilities":                  "",
+	"GetEffectivePermissionsExplained": "",
+	"GetHome":                          "",
+	"GetIDsByPaths":                    "",
+	"GetMD":                            "",
+	"GetPathByID":                      "",
+	"GetPermissions":                   "",
+	"GetQuota":                         "",
+	"GetRecycleItem":                   "",
+	"GetRecycleUsage":                  "",
+	"GetRetention":                     "",
+	"GetShareSummary":                  "",
+	"GetSystemStats":                   "",
+	"InitiateUpload":                   "",
+	"JobStatus":                        "",
+	"ListFolder":                       "",
+	"ListFolderPage":                   "ListFolder",
+	"ListGrants":                       "",
+	"ListRecycle":                      "",
+	"ListRevisions":                    "",
+	"ListStaleUploads":                 "",
+	"ListStorageSpaces":                "",
+	"ListStorageSpacesPage":            "ListStorageSpaces",
+	"Logs":                             "",
+	"Move":                             "",
+	"MoveMulti":                        "Move",
+	"PatchFile":                        "",
+	"PurgeRecycleItem":                 "",
+	"PurgeRevision":                    "",
+	"PurgeUserData":                    "",
+	"RemoveGrant":                      "",
+	"ResolveCaseInsensitive":           "",
+	"ResolvePublicShare":               "",
+	"RestoreRecycleItem":               "",
+	"RestoreRevision":                  "",
+	"SetArbitraryMetadata":             "",
+	"SetArbitraryMetadataMulti":        "SetArbitraryMetadata",
+	"SetSpaceEnabled":                  "",
+	"ShareRecipients":                  "",
+	"Shutdown":                         "",
+	"Sync":                             "",
+	"TransferOwnership":                "",
+	"UnsetArbitraryMetadata":           "",
+	"UpdateGrant":                      "",
+	"UpdateStorageSpace":               "",
+	"Upload":                           "",
+	"UploadArchive":                    "Upload",
+	"UploadTUS":                        "Upload",
+	"WriteAt":                          "",
+}
+
+// checkEnabled returns an OperationDisabled error if op, or the operation it
+// belongs to, is one of the disabled_operations. Unlike NotSupported, that
+// error makes no caller fall back to doing op some other way.
+func (nc *StorageDriver) checkEnabled(op string) error {
+	if nc.disabledOps[op] || nc.disabledOps[operations[op]] {
+		return OperationDisabled("nextcloud storage driver: " + op + " is disabled")
+	}
+	return nil
+}
+
+// getEndPoint returns the endpoint, which followRedirect may have updated.
+func (nc *StorageDriver) getEndPoint() string {
+	nc.endPointMu.RLock()
+	defer nc.endPointMu.RUnlock()
+	return nc.endPoint
+}
+
+// followRedirect moves the endpoint to where the server permanently
+// redirected the request for from to, so later calls go there directly.
+// Redirects to another host are never persisted.
+func (nc *StorageDriver) followRedirect(ctx context.Context, from, to *url.URL) {
+	log := appctx.GetLogger(ctx)
+	if from.Host != to.Host {
+		log.Warn().Msgf("nextcloud storage driver: not following permanent redirect from %s to another host: %s", from, to)
+		return
+	}
+	nc.endPointMu.Lock()
+	defer nc.endPointMu.Unlock()
+	suffix := strings.TrimPrefix(from.String(), nc.endPoint)
+	if suffix == from.String() || !strings.HasSuffix(to.String(), suffix) {
+		// the redirect does not keep the api path, so there is no new endpoint to derive
+		return
+	}
+	newEndPoint := strings.TrimSuffix(to.String(), suffix)
+	log.Info().Msgf("nextcloud storage driver: endpoint moved permanently from %s to %s", nc.endPoint, newEndPoint)
+	nc.endPoint = newEndPoint
+}
+
+// fallbackRequest returns req, addressed to the fallback endpoint, if req
+// failed with err because the endpoint could not be connected to, or nil if
+// it should not be sent there. Only dial errors count, as then the request
+// certainly did not reach the server. A body that cannot be read again, like
+// that of an upload, rules out the fallback too.
+func (nc *StorageDriver) fallbackRequest(req *http.Request, err error) *http.Request {
+	if nc.fallback == "" || req.Context().Err() != nil || !isDialError(err) {
+		return nil
+	}
+	endPoint := nc.getEndPoint()
+	suffix := strings.TrimPrefix(req.URL.String(), endPoint)
+	if suffix == req.URL.String() {
+		return nil
+	}
+	if req.GetBody == nil && req.Body != nil && req.Body != http.NoBody {
+		return nil
+	}
+	u, perr := url.Parse(nc.fallback + suffix)
+	if perr != nil {
+		return nil
+	}
+	r := req.Clone(req.Context())
+	r.URL = u
+	r.Host = ""
+	if req.GetBody != nil {
+		body, gerr := req.GetBody()
+		if gerr != nil {
+			return nil
+		}
+		r.Body = body
+	}
+	appctx.GetLogger(req.Context()).Warn().Err(err).Msgf("nextcloud storage driver: %s unreachable, trying fallback endpoint %s", endPoint, nc.fallback)
+	return r
+}
+
+// userPath returns the part of the request path that names u, rendered from
+// the user path template, or def if there is none.
+func (nc *StorageDriver) userPath(u *user.User, def string) string {
+	if nc.userTemplate == "" {
+		return def
+	}
+	return strings.TrimPrefix(templates.WithUser(u, nc.userTemplate), "/")
+}
+
+// normalizeRef applies the trailing slash normalization, unless it is turned
+// off, and the configured unicode normalization.
+func (nc *StorageDriver) normalizeRef(ref *provider.Reference) *provider.Reference {
+	if !nc.keepSlash {
+		ref = trimTrailingSlash(ref)
+	}
+	return normalizeUnicode(ref, nc.unicodeForm)
+}
+
+// normalizeRefs applies normalizeRef to each of refs.
+func (nc *StorageDriver) normalizeRefs(refs []*provider.Reference) []*provider.Reference {
+	normalized := make([]*provider.Reference, len(refs))
+	for i, ref := range refs {
+		normalized[i] = nc.normalizeRef(ref)
+	}
+	return normalized
+}
+
+// responseError maps an unsuccessful response from the EFSS API to an error.
+// It returns nil for success and for the status codes the callers of do handle
+// themselves. That includes 404, which do turns into NotFound, unless the
+// caller uses doAllowingNotFound.
+func (nc *StorageDriver) responseError(status int, body []byte) error {
+	msg := nc.truncateBody(body)
+	switch {
+	case status >= http.StatusOK && status < http.StatusMultipleChoices || status == http.StatusNotFound:
+		return nil
+	case status == http.StatusForbidden && strings.HasPrefix(string(body), spaceDisabledMsg):
+		return SpaceDisabled(msg)
+	case status == http.StatusConflict && strings.HasPrefix(string(body), activeSharesMsg):
+		return ActiveShares(msg)
+	case status == http.StatusConflict:
+		return errtypes.AlreadyExists(msg)
+	case status == http.StatusNotImplemented:
+		return errtypes.NotSupported(msg)
+	case status >= http.StatusInternalServerError:
+		return errtypes.InternalError("EFSS API responded " + strconv.Itoa(status) + ": " + msg)
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errtypes.PermissionDenied(msg)
+	case status == http.StatusPreconditionFailed:
+		return errtypes.Aborted(msg)
+	case status == http.StatusLocked:
+		return Locked(msg)
+	default:
+		return fmt.Errorf("Unexpected response code from EFSS API: " + strconv.Itoa(status) + ":" + msg)
+	}
+}
+
+// truncateBody returns body as a string for errors and logs, cut off after
+// max_error_body_log bytes.
+func (nc *StorageDriver) truncateBody(body []byte) string {
+	if nc.maxErrorBody < 0 || len(body) <= nc.maxErrorBody {
+		return string(body)
+	}
+	n := nc.maxErrorBody
+	for n > 0 && !utf8.RuneStart(body[n]) {
+		n--
+	}
+	return string(body[:n]) + "…"
+}
+
+func (nc *StorageDriver) do(ctx context.Context, a Action) (int, []byte, error) {
+	return nc.doWithHeaders(ctx, a, nil)
+}
+
+// loggable is implemented by request bodies that must not be logged as they
+// are, e.g. because they hold a password.
+type loggable interface {
+	logString() string
+}
+
+// doJSON sends req as JSON to the given verb and decodes the response into
+// resp. A nil req sends an empty body. Like do, it turns a 404 into NotFound
+// and other failures into the matching errtypes. A nil resp ignores the
+// response body; otherwise an empty one is an error, as it holds no result.
+func (nc *StorageDriver) doJSON(ctx context.Context, verb string, req, resp interface{}) error {
+	_, err := nc.doJSONWithResponseHeaders(ctx, verb, req, resp)
+	return err
+}
+
+// doJSONWithResponseHeaders is like doJSON, but also returns the headers of
+// the response.
+func (nc *StorageDriver) doJSONWithResponseHeaders(ctx context.Context, verb string, req, resp interface{}) (http.Header, error) {
+	var bodyStr []byte
+	if req != nil {
+		var err error
+		bodyStr, err = json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log := appctx.GetLogger(ctx)
+	if l, ok := req.(loggable); ok {
+		log.Info().Msgf("%s %s", verb, l.logString())
+	} else {
+		log.Info().Msgf("%s %s", verb, bodyStr)
+	}
+
+	_, respBody, respHeaders, err := nc.doWithResponseHeaders(ctx, Action{verb, string(bodyStr)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return respHeaders, nil
+	}
+	if len(bytes.TrimSpace(respBody)) == 0 {
+		return nil, errtypes.InternalError("nextcloud storage driver: empty " + verb + " response")
+	}
+	if err := json.Unmarshal(respBody, resp); err != nil {
+		return nil, errors.Wrapf(err, "nextcloud storage driver: could not decode %s response", verb)
+	}
+	return respHeaders, nil
+}
+
+// doWithHeaders is like do, but adds the given headers to the request.
+func (nc *StorageDriver) doWithHeaders(ctx context.Context, a Action, headers http.Header) (int, []byte, error) {
+	status, body, _, err := nc.doWithResponseHeaders(ctx, a, headers)
+	return status, body, err
+}
+
+// doWithResponseHeaders is like doWithHeaders, but also returns the headers
+// of the response.
+func (nc *StorageDriver) doWithResponseHeaders(ctx context.Context, a Action, headers http.Header) (int, []byte, http.Header, error) {
+	status, body, respHeaders, err := nc.doAllowingNotFound(ctx, a, headers)
+	if err == nil && status == http.StatusNotFound {
+		return 0, nil, nil, errtypes.NotFound(nc.truncateBody(body))
+	}
+	return status, body, respHeaders, err
+}
+
+// endpointMissing tells whether err means the server has no endpoint for the
+// call: it answered 501, or 404 as servers do for a route they don't know.
+// As a 404 may also mean a missing resource, the fallback for the call has
+// to report that itself.
+func endpointMissing(err error) bool {
+	switch err.(type) {
+	case errtypes.IsNotSupported, errtypes.IsNotFound:
+		return true
+	}
+	return false
+}
+
+// notFound returns err, or, if it is a NotFound error, one that names what was
+// not found instead of whatever the server said.
+func notFound(err error, what string) error {
+	if _, ok := err.(errtypes.IsNotFound); ok {
+		return errtypes.NotFound(what)
+	}
+	return err
+}
+
+// doAllowingNotFound is like doWithResponseHeaders, but a 404 is no error; it
+// is for the few calls for which a missing resource is fine.
+func (nc *StorageDriver) doAllowingNotFound(ctx context.Context, a Action, headers http.Header) (int, []byte, http.Header, error) {
+	user, err := getUser(ctx)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if err := nc.checkEnabled(a.verb); err != nil {
+		return 0, nil, nil, err
+	}
+	// See https://github.com/cs3org/reva/issues/2377
+	// for discussion of user.Username vs user.Id.OpaqueId
+	url := nc.getEndPoint() + nc.userPath(user, "~"+user.Id.OpaqueId) + "/api/storage/" + a.verb
+	return nc.doURL(ctx, http.MethodPost, url, a, headers)
+}
+
+// doGet GETs route, relative to the api of the user in ctx, for the calls that
+// are not under api/storage. verb names the call, for disabled_operations and
+// retries. Like do, it turns a 404 into NotFound.
+func (nc *StorageDriver) doGet(ctx context.Context, verb, route string) ([]byte, error) {
+	user, err := getUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := nc.checkEnabled(verb); err != nil {
+		return nil, err
+	}
+	url := nc.getEndPoint() + nc.userPath(user, "~"+user.Id.OpaqueId) + "/api/" + route
+	status, body, _, err := nc.doURL(ctx, http.MethodGet, url, Action{verb, ""}, nil)
+	if err == nil && status == http.StatusNotFound {
+		return nil, errtypes.NotFound(nc.truncateBody(body))
+	}
+	return body, err
+}
+
+// doURL sends the call a to url with the given method, retrying it where that
+// is safe, and maps the response to an error, except for a 404.
+func (nc *StorageDriver) doURL(ctx context.Context, method, url string, a Action, headers http.Header) (int, []byte, http.Header, error) {
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("nc.do req %s %s", url, a.argS)
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(a.argS))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	if err := nc.authorize(ctx, req); err != nil {
+		return 0, nil, nil, err
+	}
+	nc.setLanguage(ctx, req)
+	if since, ok := ContextGetUnmodifiedSince(ctx); ok {
+		req.Header.Set("If-Unmodified-Since", since.UTC().Format(http.TimeFormat))
+	}
+
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	status, body, respHeaders, err := nc.send(ctx, req, a.argS)
+	// a cancelled ctx fails every retry too, so there is no point in them
+	for attempt := 0; attempt < nc.maxRetries && ctx.Err() == nil && isTransient(a.verb, status, err); attempt++ {
+		if !nc.retryBudget.allow() {
+			log.Warn().Msgf("nc.do retry budget exhausted, not retrying %s", url)
+			break
+		}
+		if !sleepCtx(ctx, nc.backoff(attempt)) {
+			break
+		}
+		log.Info().Msgf("nc.do retry %d for %s", attempt+1, url)
+		nc.stats.retries.Add(1)
+		status, body, respHeaders, err = nc.send(ctx, req, a.argS)
+	}
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if status >= http.StatusBadRequest {
+		log.Info().Msgf("nc.do res %s %d %s", url, status, nc.truncateBody(body))
+	} else {
+		log.Info().Msgf("nc.do res %s %s", url, string(body))
+	}
+	if status == http.StatusNotModified {
+		return status, nil, respHeaders, ErrNotModified
+	}
+	if err := nc.responseError(status, body); err != nil {
+		return 0, nil, nil, err
+	}
+	collectWarnings(ctx, body)
+	return status, body, respHeaders, nil
+}
+
+// send does req with the given body, and reads the response.
+func (nc *StorageDriver) send(ctx context.Context, req *http.Request, body string) (int, []byte, http.Header, error) {
+	req.Body = io.NopCloser(strings.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(body)), nil
+	}
+	resp, err := nc.doRequest(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	if redirect := resp.Request.Response; redirect != nil && redirect.StatusCode == http.StatusPermanentRedirect {
+		nc.followRedirect(ctx, req.URL, resp.Request.URL)
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return resp.StatusCode, respBody, resp.Header, nil
+}
+
+// idempotentOps are the calls that can safely be sent twice, as they only
+// read, or set something to a given value.
+var idempotentOps = map[string]bool{
+	"CheckRetentionLocks":              true,
+	"GetCapabilities":                  true,
+	"GetEffectivePermissionsExplained": true,
+	"GetHome":                          true,
+	"GetIDsByPaths":                    true,
+	"GetMD":                            true,
+	"GetPathByID":                      true,
+	"GetPermissions":                   true,
+	"GetQuota":                         true,
+	"GetRecycleItem":                   true,
+	"GetRecycleUsage":                  true,
+	"GetRetention":                     true,
+	"GetShareSummary":                  true,
+	"GetSystemStats":                   true,
+	"JobStatus":                        true,
+	"ListFolder":                       true,
+	"ListFolderPage":                   true,
+	"ListGrants":                       true,
+	"ListRecycle":                      true,
+	"ListRevisions":                    true,
+	"ListStaleUploads":                 true,
+	"ListStorageSpaces":                true,
+	"ListStorageSpacesPage":            true,
+	"ResolveCaseInsensitive":           true,
+	"ResolvePublicShare":               true,
+	"SetArbitraryMetadata":             true,
+	"SetArbitraryMetadataMulti":        true,
+	"SetSpaceEnabled":                  true,
+	"ShareRecipients":                  true,
+	"UnsetArbitraryMetadata":           true,
+}
+
+// isTransient tells whether the call verb that ended with this status or
+// error may succeed when retried. Calls that are not idempotent are only
+// retried when they never reached the server.
+func isTransient(verb string, status int, err error) bool {
+	if isDialError(err) {
+		return true
+	}
+	if !idempotentOps[verb] {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// isDialError tells whether err means the server could not be connected to,
+// so that the request certainly did not reach it.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// backoff returns how long to wait before retry attempt, counting from 0: the
+// retry_backoff_ms, doubled for every attempt, of which a random part, up to
+// half, is left out so that clients don't all retry at once.
+func (nc *StorageDriver) backoff(attempt int) time.Duration {
+	base := nc.retryBackoff
+	if base <= 0 {
+		base = defaultRetryBackoff
+	}
+	d := base << attempt
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// defaultRetryBackoff is how long the first retry waits without a
+// retry_backoff_ms.
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// sleepCtx waits for d, or until ctx is done, and tells whether it waited the
+// whole time.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// GetHome as defined in the storage.FS interface.
+func (nc *StorageDriver) GetHome(ctx context.Context) (string, error) {
+	log := appctx.GetLogger(ctx)
+	log.Info().Msg("GetHome")
+
+	if nc.enableHome {
+		// every request is scoped to the home of the user
+		return "/", nil
+	}
+	_, respBody, err := nc.do(ctx, Action{"GetHome", ""})
+	return string(respBody), err
+}
+
+// WithinHome tells whether ref lies within the home of the acting user. With
+// enable_home, that is the whole storage, share folder included. Otherwise the
+// home is asked from the server once per user, and then cached.
+func (nc *StorageDriver) WithinHome(ctx context.Context, ref *provider.Reference) (bool, error) {
+	u, err := getUser(ctx)
+	if err != nil {
+		return false, err
+	}
+	home, ok := nc.homes.Load(u.Id.OpaqueId)
+	if !ok {
+		h, err := nc.GetHome(ctx)
+		if err != nil {
+			return false, err
+		}
+		home, _ = nc.homes.LoadOrStore(u.Id.OpaqueId, path.Clean(h))
+	}
+
+	p, err := nc.resolvePath(ctx, ref)
+	if err != nil {
+		return false, err
+	}
+	if !path.IsAbs(p) {
+		return false, errtypes.BadRequest("nextcloud storage driver: cannot tell where " + FormatReference(ref) + " is")
+	}
+	p = path.Clean(p)
+	return isWithin(p, home.(string)), nil
+}
+
+// isWithin tells whether p is dir or inside it. Both must be clean.
+func isWithin(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// CreateHome as defined in the storage.FS interface.
+func (nc *StorageDriver) CreateHome(ctx context.Context) error {
+	return nc.CreateHomeWithQuota(ctx, nc.homeQuota)
+}
+
+// CreateHomeWithQuota is like CreateHome, but gives the home a quota of the
+// given number of bytes, or the server default if it is 0.
+func (nc *StorageDriver) CreateHomeWithQuota(ctx context.Context, quota uint64) error {
+	var bodyObj interface{}
+	if quota > 0 {
+		type paramsObj struct {
+			Quota uint64 `json:"quota"`
+		}
+		bodyObj = &paramsObj{Quota: quota}
+	}
+	err := nc.doJSON(ctx, "CreateHome", bodyObj, nil)
+	if err != nil || !nc.enableHome {
+		return err
+	}
+	return nc.CreateDir(ctx, NewReference("", "", nc.shareFolder))
+}
+
+// ValidateShareFolder checks that the configured share folder exists in the
+// home of the user in ctx and is a folder. A missing share folder is created
+// if auto_create_share_folder is set, and otherwise gives an InvalidShareFolder
+// error, as does a share folder that is not a folder.
+func (nc *StorageDriver) ValidateShareFolder(ctx context.Context) error {
+	ref := NewReference("", "", nc.shareFolder)
+	md, err := nc.GetMD(ctx, ref, nil)
+	if _, ok := err.(errtypes.IsNotFound); ok {
+		if !nc.autoShares {
+			return InvalidShareFolder(nc.shareFolder + " does not exist")
+		}
+		return nc.CreateDir(ctx, ref)
+	}
+	if err != nil {
+		return err
+	}
+	if md.GetType() != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+		return InvalidShareFolder(nc.shareFolder + " is not a folder")
+	}
+	return nil
+}
+
+// CreateDir as defined in the storage.FS interface.
+func (nc *StorageDriver) CreateDir(ctx context.Context, ref *provider.Reference) error {
+	_, err := nc.CreateDirWithResourceID(ctx, ref)
+	return err
+}
+
+// CreateDirWithResourceID is like CreateDir, but also returns the id of the
+// new folder, which the server may send along in a Location header. This saves
+// a GetMD to look it up. If the server did not send it, the id is nil.
+func (nc *StorageDriver) CreateDirWithResourceID(ctx context.Context, ref *provider.Reference) (*provider.ResourceId, error) {
+	ref = nc.normalizeRef(ref)
+	bodyStr, err := json.Marshal(ref)
+	if err != nil {
+		return nil, err
+	}
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("CreateDir %s", bodyStr)
+
+	_, _, respHeaders, err := nc.doWithResponseHeaders(ctx, Action{"CreateDir", string(bodyStr)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return nc.locatedResourceID(respHeaders.Get("Location"))
+}
+
+// CreateDirs creates all of the given folders in one call. The server creates
+// them parents first, whatever their order in refs. Folders that exist already
+// are left as they are. If creating some of them fails, a MultiError with one
+// error per failed folder is returned.
+func (nc *StorageDriver) CreateDirs(ctx context.Context, refs []*provider.Reference) error {
+	normalized := nc.normalizeRefs(refs)
+	type paramsObj struct {
+		Refs []*provider.Reference `json:"refs"`
+	}
+	bodyStr, _ := json.Marshal(&paramsObj{Refs: normalized})
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("CreateDirs %s", bodyStr)
+
+	_, respBody, err := nc.do(ctx, Action{"CreateDirs", string(bodyStr)})
+	if err != nil {
+		return err
+	}
+	return nc.multiResultError(refs, respBody, func(err error) bool {
+		_, ok := err.(errtypes.IsAlreadyExists)
+		return ok
+	})
+}
+
+// locatedResourceID returns the id of the resource a Location header points
+// to, which is "resources/<storage id>!<opaque id>" under the endpoint; the
+// header may be relative to the endpoint. A missing header gives a nil id.
+func (nc *StorageDriver) locatedResourceID(location string) (*provider.ResourceId, error) {
+	if location == "" {
+		return nil, nil
+	}
+	endPoint, err := url.Parse(nc.getEndPoint())
+	if err != nil {
+		return nil, err
+	}
+	loc, err := endPoint.Parse(location)
+	if err != nil {
+		return nil, errtypes.InternalError("nextcloud storage driver: malformed Location header " + location)
+	}
+	_, id, ok := strings.Cut(loc.Path, "/resources/")
+	if !ok || loc.Host != endPoint.Host {
+		return nil, errtypes.InternalError("nextcloud storage driver: Location header does not point to a resource: " + location)
+	}
+	ref, err := ParseReference(id)
+	if err != nil || ref.GetResourceId() == nil {
+		return nil, errtypes.InternalError("nextcloud storage driver: Location header does not point to a resource: " + location)
+	}
+	return ref.GetResourceId(), nil
+}
+
+// TouchFile as defined in the storage.FS interface.
+func (nc *StorageDriver) TouchFile(ctx context.Context, ref *provider.Reference) error {
+	return fmt.Errorf("unimplemented: TouchFile")
+}
+
+// Delete as defined in the storage.FS interface.
+func (nc *StorageDriver) Delete(ctx context.Context, ref *provider.Reference) error {
+	ref = nc.normalizeRef(ref)
+	return nc.doJSON(ctx, "Delete", ref, nil)
+}
+
+// Move as defined in the storage.FS interface.
+func (nc *StorageDriver) Move(ctx context.Context, oldRef, newRef *provider.Reference) error {
+	_, err := nc.move(ctx, oldRef, newRef)
+	return err
+}
+
+// MoveWithOverwrite is like Move, but with overwrite replaces whatever exists
+// at newRef. Move itself never overwrites; it fails with an AlreadyExists
+// error instead.
+func (nc *StorageDriver) MoveWithOverwrite(ctx context.Context, oldRef, newRef *provider.Reference, overwrite bool) error {
+	policy := "fail"
+	if overwrite {
+		policy = "overwrite"
+	}
+	_, err := nc.moveWithPolicy(ctx, oldRef, newRef, policy)
+	return err
+}
+
+// MoveAndStat is like Move, but also returns the metadata of the resource at its
+// new location. If the server does not send that along, it is fetched with GetMD.
+func (nc *StorageDriver) MoveAndStat(ctx context.Context, oldRef, newRef *provider.Reference) (*provider.ResourceInfo, error) {
+	respBody, err := nc.move(ctx, oldRef, newRef)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(respBody))) == 0 {
+		return nc.GetMD(ctx, newRef, nil)
+	}
+	var respObj provider.ResourceInfo
+	err = json.Unmarshal(respBody, &respObj)
+	if err != nil {
+		return nil, err
+	}
+	return &respObj, nil
+}
+
+// MoveWithConflictPolicy is like Move, but tells the server what to do if
+// something exists at newRef already: "overwrite" it, "rename" the moved
+// resource, e.g. to "file (2).txt", or "fail" with an AlreadyExists error. It
+// returns the path the resource ended up at, which is the path of newRef unless
+// it was renamed.
+func (nc *StorageDriver) MoveWithConflictPolicy(ctx context.Context, oldRef, newRef *provider.Reference, policy string) (string, error) {
+	if !isConflictPolicy(policy) {
+		return "", errtypes.BadRequest("nextcloud storage driver: unknown conflict policy " + policy)
+	}
+	respBody, err := nc.moveWithPolicy(ctx, oldRef, newRef, policy)
+	if err != nil {
+		return "", err
+	}
+	return decodeFinalPath(respBody, nc.normalizeRef(newRef).GetPath()), nil
+}
+
+// isConflictPolicy tells whether policy is one of the policies the server
+// knows for a name that is taken, or empty for its default.
+func isConflictPolicy(policy string) bool {
+	switch policy {
+	case "", "overwrite", "rename", "fail":
+		return true
+	}
+	return false
+}
+
+// move moves without overwriting: something at newRef makes it fail with an
+// AlreadyExists error.
+func (nc *StorageDriver) move(ctx context.Context, oldRef, newRef *provider.Reference) ([]byte, error) {
+	return nc.moveWithPolicy(ctx, oldRef, newRef, "fail")
+}
+
+func (nc *StorageDriver) moveWithPolicy(ctx context.Context, oldRef, newRef *provider.Reference, policy string) ([]byte, error) {
+	oldRef, newRef = nc.normalizeRef(oldRef), nc.normalizeRef(newRef)
+	if err := checkMoveTarget(oldRef, newRef); err != nil {
+		return nil, err
+	}
+	type paramsObj struct {
+		OldRef         *provider.Reference `json:"oldRef"`
+		NewRef         *provider.Reference `json:"newRef"`
+		ConflictPolicy string              `json:"conflictPolicy,omitempty"`
+	}
+	bodyObj := &paramsObj{
+		OldRef:         oldRef,
+		NewRef:         newRef,
+		ConflictPolicy: policy,
+	}
+	bodyStr, _ := json.Marshal(bodyObj)
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("Move %s", bodyStr)
+
+	_, respBody, err := nc.do(ctx, Action{"Move", string(bodyStr)})
+	return respBody, err
+}
+
+// BlockReason tells why a bulk operation left a resource alone.
+type BlockReason string
+
+// The reasons a Blocker can have.
+const (
+	BlockedLocked     BlockReason = "locked"
+	BlockedPermission BlockReason = "permission"
+	BlockedNotFound   BlockReason = "not-found"
+	BlockedConflict   BlockReason = "conflict"
+	BlockedOther      BlockReason = "other"
+)
+
+// Blocker is a resource that DeleteMulti or MoveMulti could not be applied
+// to, with the reason and the message of the server.
+type Blocker struct {
+	Ref     *provider.Reference
+	Reason  BlockReason
+	Message string
+}
+
+// MoveItem is one of the moves of MoveMulti.
+type MoveItem struct {
+	OldRef *provider.Reference `json:"oldRef"`
+	NewRef *provider.Reference `json:"newRef"`
+}
+
+// DeleteMulti deletes all of the given resources in one call. Those that could
+// not be deleted, e.g. because they are locked, are returned as blockers; the
+// others are deleted regardless. An error means the call as a whole failed.
+func (nc *StorageDriver) DeleteMulti(ctx context.Context, refs []*provider.Reference) ([]Blocker, error) {
+	normalized := nc.normalizeRefs(refs)
+	type paramsObj struct {
+		Refs []*provider.Reference `json:"refs"`
+	}
+	bodyStr, _ := json.Marshal(&paramsObj{Refs: normalized})
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("DeleteMulti %s", bodyStr)
+
+	_, respBody, err := nc.do(ctx, Action{"DeleteMulti", string(bodyStr)})
+	if err != nil {
+		return nil, err
+	}
+	return nc.decodeBlockers(refs, respBody)
+}
+
+// MoveMulti does all of the given moves in one call, like Move, so without
+// overwriting. Moves that could not be done are returned as blockers, by the
+// reference of the resource to move; the others are done regardless. An error
+// means the call as a whole failed.
+func (nc *StorageDriver) MoveMulti(ctx context.Context, moves []MoveItem) ([]Blocker, error) {
+	normalized := make([]MoveItem, len(moves))
+	for i, m := range moves {
+		normalized[i] = MoveItem{OldRef: nc.normalizeRef(m.OldRef), NewRef: nc.normalizeRef(m.NewRef)}
+		if err := checkMoveTarget(normalized[i].OldRef, normalized[i].NewRef); err != nil {
+			return nil, err
+		}
+	}
+	type paramsObj struct {
+		Moves          []MoveItem `json:"moves"`
+		ConflictPolicy string     `json:"conflictPolicy"`
+	}
+	bodyStr, _ := json.Marshal(&paramsObj{Moves: normalized, ConflictPolicy: "fail"})
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("MoveMulti %s", bodyStr)
+
+	_, respBody, err := nc.do(ctx, Action{"MoveMulti", string(bodyStr)})
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]*provider.Reference, len(moves))
+	for i, m := range moves {
+		refs[i] = m.OldRef
+	}
+	return nc.decodeBlockers(refs, respBody)
+}
+
+// decodeBlockers returns the blockers among refs according to respBody, which
+// holds the outcome for each ref, in the same order.
+func (nc *StorageDriver) decodeBlockers(refs []*provider.Reference, respBody []byte) ([]Blocker, error) {
+	results, err := nc.decodeResults(refs, respBody)
+	if err != nil {
+		return nil, err
+	}
+	blockers := []Blocker{}
+	for i, res := range results {
+		var reason BlockReason
+		switch res.Err.(type) {
+		case nil:
+			continue
+		case Locked:
+			reason = BlockedLocked
+		case errtypes.IsPermissionDenied:
+			reason = BlockedPermission
+		case errtypes.IsNotFound:
+			reason = BlockedNotFound
+		case errtypes.IsAlreadyExists, ActiveShares:
+			reason = BlockedConflict
+		default:
+			reason = BlockedOther
+		}
+		blockers = append(blockers, Blocker{Ref: refs[i], Reason: reason, Message: res.Message})
+	}
+	return blockers, nil
+}
+
+// Copy copies a resource. With reflink, it asks the server for a fast copy that
+// shares the data with the source until either is changed; if the server cannot
+// do that, a normal copy is made. It returns whether a reflink was used.
+func (nc *StorageDriver) Copy(ctx context.Context, srcRef, dstRef *provider.Reference, reflink bool) (bool, error) {
+	srcRef, dstRef = nc.normalizeRef(srcRef), nc.normalizeRef(dstRef)
+	if err := checkMoveTarget(srcRef, dstRef); err != nil {
+		return false, err
+	}
+	respBody, err := nc.copy(ctx, srcRef, dstRef, reflink)
+	if _, ok := err.(errtypes.IsNotSupported); ok && reflink {
+		// the server does not know the hint at all
+		respBody, err = nc.copy(ctx, srcRef, dstRef, false)
+	}
+	if err != nil {
+		return false, err
+	}
+	var respObj struct {
+		Reflink bool `json:"reflink"`
+	}
+	if len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, &respObj); err != nil {
+			return false, err
+		}
+	}
+	return respObj.Reflink, nil
+}
+
+func (nc *StorageDriver) copy(ctx context.Context, srcRef, dstRef *provider.Reference, reflink bool) ([]byte, error) {
+	type paramsObj struct {
+		SrcRef  *provider.Reference `json:"srcRef"`
+		DstRef  *provider.Reference `json:"dstRef"`
+		Reflink bool                `json:"reflink,omitempty"`
+	}
+	bodyObj := &paramsObj{
+		SrcRef:  srcRef,
+		DstRef:  dstRef,
+		Reflink: reflink,
+	}
+	bodyStr, _ := json.Marshal(bodyObj)
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("Copy %s", bodyStr)
+
+	_, respBody, err := nc.do(ctx, Action{"Copy", string(bodyStr)})
+	if err != nil {
+		return nil, notFound(err, srcRef.GetPath())
+	}
+	return respBody, nil
+}
+
+// checkMoveTarget rejects moving or copying a resource to itself or into one of its
+// descendants. It can only tell for references that are relative to the same
+// resource, or both absolute paths.
+func checkMoveTarget(oldRef, newRef *provider.Reference) error {
+	if oldRef.GetResourceId() != nil || newRef.GetResourceId() != nil {
+		if !utils.ResourceIDEqual(oldRef.GetResourceId(), newRef.GetResourceId()) {
+			return nil
+		}
+	}
+	if oldRef.GetPath() == "" || newRef.GetPath() == "" {
+		return nil
+	}
+	oldPath := path.Clean(oldRef.GetPath())
+	newPath := path.Clean(newRef.GetPath())
+	if newPath == oldPath || strings.HasPrefix(newPath, oldPath+"/") || oldPath == "." || oldPath == "/" {
+		return errtypes.BadRequest("invalid move or copy: " + newRef.GetPath() + " is inside " + oldRef.GetPath())
+	}
+	return nil
+}
+
+// resolveCaseInsensitive asks the server for the path that matches the path of ref
+// when ignoring case. It returns a NotFound error if there is no such path.
+func (nc *StorageDriver) resolveCaseInsensitive(ctx context.Context, ref *provider.Reference) (*provider.Reference, error) {
+	bodyStr, _ := json.Marshal(ref)
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("ResolveCaseInsensitive %s", bodyStr)
+
+	_, respBody, err := nc.do(ctx, Action{"ResolveCaseInsensitive", string(bodyStr)})
+	if err != nil {
+		return nil, notFound(err, ref.GetPath())
+	}
+	if len(respBody) == 0 {
+		return nil, errtypes.NotFound(ref.GetPath())
+	}
+	id := ref.GetResourceId()
+	return NewReference(id.GetStorageId(), id.GetOpaqueId(), string(respBody)), nil
+}
+
+// GetMD as defined in the storage.FS interface.
+// With follow_symlinks, GetMD of a symlink returns the metadata of the resource
+// it points to.
+func (nc *StorageDriver) GetMD(ctx context.Context, ref *provider.Reference, mdKeys []string) (*provider.ResourceInfo, error) {
+	info, err := nc.GetMDIfModifiedSince(ctx, ref, mdKeys, time.Time{})
+	if err != nil || !nc.followLinks {
+		return info, err
+	}
+	return nc.followSymlinks(ctx, info, mdKeys)
+}
+
+// maxSymlinkHops is how many symlinks in a row followSymlinks follows before
+// it gives up.
+const maxSymlinkHops = 8
+
+// followSymlinks resolves info, as long as it is a symlink, to the resource its
+// target points to. A relative target is relative to the folder of the symlink.
+func (nc *StorageDriver) followSymlinks(ctx context.Context, info *provider.ResourceInfo, mdKeys []string) (*provider.ResourceInfo, error) {
+	seen := map[string]bool{}
+	for info.GetType() == provider.ResourceType_RESOURCE_TYPE_SYMLINK {
+		if seen[info.GetPath()] || len(seen) == maxSymlinkHops {
+			return nil, errtypes.BadRequest("nextcloud storage driver: too many levels of symlinks at " + info.GetPath())
+		}
+		seen[info.GetPath()] = true
+		target := info.GetTarget()
+		if target == "" {
+			return nil, errtypes.InternalError("nextcloud storage driver: symlink without target at " + info.GetPath())
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(info.GetPath()), target)
+		}
+		next, err := nc.GetMDIfModifiedSince(ctx, &provider.Reference{Path: target}, mdKeys, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		info = next
+	}
+	return info, nil
+}
+
+// GetMDIfModifiedSince is like GetMD, but returns ErrNotModified if the resource
+// did not change since the given time. A zero time always fetches the metadata.
+func (nc *StorageDriver) GetMDIfModifiedSince(ctx context.Context, ref *provider.Reference, mdKeys []string, since time.Time) (*provider.ResourceInfo, error) {
+	ref = nc.normalizeRef(ref)
+	var headers http.Header
+	if !since.IsZero() {
+		headers = http.Header{"If-Modified-Since": {since.UTC().Format(http.TimeFormat)}}
+	}
+	info, err := nc.getMD(ctx, ref, mdKeys, headers)
+	if _, ok := err.(errtypes.IsNotFound); ok && nc.caseInsens && ref.GetPath() != "" {
+		resolved, rerr := nc.resolveCaseInsensitive(ctx, ref)
+		if rerr != nil {
+			return nil, err
+		}
+		return nc.getMD(ctx, resolved, mdKeys, headers)
+	}
+	return info, err
+}
+
+func (nc *StorageDriver) getMD(ctx context.Context, ref *provider.Reference, mdKeys []string, headers http.Header) (*provider.ResourceInfo, error) {
+	type paramsObj struct {
+		Ref    *provider.Reference `json:"ref"`
+		MdKeys []string            `json:"mdKeys"`
+		// MetaData provider.ResourceInfo `json:"metaData"`
+	}
+	bodyObj := &paramsObj{
+		Ref:    ref,
+		MdKeys: mdKeys,
+	}
+	bodyStr, _ := json.Marshal(bodyObj)
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("GetMD %s", bodyStr)
+
+	_, body, err := nc.doWithHeaders(ctx, Action{"GetMD", string(bodyStr)}, headers)
+	if err != nil {
+		return nil, notFound(err, ref.GetPath())
+	}
+	var respObj provider.ResourceInfo
+	err = unmarshalResourceInfo(ctx, body, &respObj)
+	if err != nil {
+		return nil, err
+	}
+	err = decodeSpaceRoot(body, &respObj)
+	if err != nil {
+		return nil, err
+	}
+	err = decodeCompressed(body, &respObj)
+	if err != nil {
+		return nil, err
+	}
+	err = decodeBtime(body, &respObj)
+	if err != nil {
+		return nil, err
+	}
+	return &respObj, nil
+}
+
+// unmarshalResourceInfo decodes a ResourceInfo from body. A null or malformed
+// arbitrary_metadata field does not fail the decoding, it just results in empty
+// arbitrary metadata.
+func unmarshalResourceInfo(ctx context.Context, body []byte, ri *provider.ResourceInfo) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return err
+	}
+	rawMd, hasMd := fields["arbitrary_metadata"]
+	delete(fields, "arbitrary_metadata")
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(rest, ri); err != nil {
+		return err
+	}
+	if !hasMd {
+		return nil
+	}
+
+	md := &provider.ArbitraryMetadata{}
+	if err := json.Unmarshal(rawMd, md); err != nil || string(rawMd) == "null" {
+		appctx.GetLogger(ctx).Warn().Str("arbitrary_metadata", string(rawMd)).Msg("nextcloud storage driver: ignoring malformed arbitrary_metadata")
+		md = &provider.ArbitraryMetadata{}
+	}
+	if md.Metadata == nil {
+		md.Metadata = map[string]string{}
+	}
+	ri.ArbitraryMetadata = md
+	return nil
+}
+
+// decodeSpaceRoot copies the root id of the space containing the resource,
+// which the server sends either as "root" or as "space.root", into the
+// SpaceRootKey opaque entry of ri.
+func decodeSpaceRoot(body []byte, ri *provider.ResourceInfo) error {
+	var respObj struct {
+		Root  *provider.ResourceId `json:"root"`
+		Space *struct {
+			Root *provider.ResourceId `json:"root"`
+		} `json:"space"`
+	}
+	if err := json.Unmarshal(body, &respObj); err != nil {
+		return err
+	}
+	root := respObj.Root
+	if root == nil && respObj.Space != nil {
+		root = respObj.Space.Root
+	}
+	if root == nil {
+		return nil
+	}
+	value, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+	setOpaqueEntry(ri, SpaceRootKey, &types.OpaqueEntry{
+		Decoder: "json",
+		Value:   value,
+	})
+	return nil
+}
+
+// decodeCompressed marks ri with the CompressedKey opaque entry if the server
+// reports that it stores the file compressed.
+func decodeCompressed(body []byte, ri *provider.ResourceInfo) error {
+	var respObj struct {
+		Compressed bool `json:"compressed"`
+	}
+	if err := json.Unmarshal(body, &respObj); err != nil {
+		return err
+	}
+	if respObj.Compressed {
+		setOpaqueEntry(ri, CompressedKey, &types.OpaqueEntry{
+			Decoder: "plain",
+			Value:   []byte("true"),
+		})
+	}
+	return nil
+}
+
+// decodeBtime stores the creation time the server reports for ri, as
+// "btime":{"seconds":...}, in the BtimeKey opaque entry.
+func decodeBtime(body []byte, ri *provider.ResourceInfo) error {
+	var respObj struct {
+		Btime *types.Timestamp `json:"btime"`
+	}
+	if err := json.Unmarshal(body, &respObj); err != nil {
+		return err
+	}
+	if respObj.Btime != nil {
+		setOpaqueEntry(ri, BtimeKey, &types.OpaqueEntry{
+			Decoder: "plain",
+			Value:   []byte(strconv.FormatUint(respObj.Btime.Seconds, 10)),
+		})
+	}
+	return nil
+}
+
+// setOpaqueEntry sets the opaque entry key of ri, creating the opaque map if
+// needed.
+func setOpaqueEntry(ri *provider.ResourceInfo, key string, entry *types.OpaqueEntry) {
+	if ri.Opaque == nil {
+		ri.Opaque = &types.Opaque{}
+	}
+	if ri.Opaque.Map == nil {
+		ri.Opaque.Map = map[string]*types.OpaqueEntry{}
+	}
+	ri.Opaque.Map[key] = entry
+}
+
+// ListFolder as defined in the storage.FS interface.
+func (nc *StorageDriver) ListFolder(ctx context.Context, ref *provider.Reference, mdKeys []string) ([]*provider.ResourceInfo, error) {
+	ref = nc.normalizeRef(ref)
+	infos, err := nc.listFolder(ctx, ref, mdKeys)
+	if _, ok := err.(errtypes.IsNotFound); ok && nc.caseInsens && ref.GetPath() != "" {
+		resolved, rerr := nc.resolveCaseInsensitive(ctx, ref)
+		if rerr != nil {
+			return nil, err
+		}
+		return nc.listFolder(ctx, resolved, mdKeys)
+	}
+	return infos, err
+}
+
+// ListReferences returns the references (mount points) directly in the folder
+// at ref, leaving out regular files and folders. Their targets can be read
+// with ReferenceTarget.
+func (nc *StorageDriver) ListReferences(ctx context.Context, ref *provider.Reference) ([]*provider.ResourceInfo, error) {
+	infos, err := nc.ListFolder(ctx, ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	refs := []*provider.ResourceInfo{}
+	for _, info := range infos {
+		if info.Type != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
+			continue
+		}
+		if _, err := ReferenceTarget(info); err != nil {
+			return nil, err
+		}
+		refs = append(refs, info)
+	}
+	return refs, nil
+}
+
+// GetRecursiveEtag returns an etag over the whole subtree of a folder, which
+// changes whenever anything beneath the folder changes. It is computed by
+// walking the subtree, so it costs one ListFolder per folder in it.
+func (nc *StorageDriver) GetRecursiveEtag(ctx context.Context, ref *provider.Reference) (string, error) {
+	infos, err := nc.ListFolder(ctx, ref, nil)
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].GetPath() < infos[j].GetPath()
+	})
+	h := sha1.New()
+	for _, info := range infos {
+		etag := info.GetEtag()
+		if info.GetType() == provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+			etag, err = nc.GetRecursiveEtag(ctx, childReference(ref, info.GetPath()))
+			if err != nil {
+				return "", err
+			}
+		}
+		fmt.Fprintf(h, "%s\x00%s\n", info.GetPath(), etag)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// listCursor is what a ListFolderPage cursor holds: the token of the next page,
+// and the path of the last entry returned, for the server to continue after
+// it should the token have expired.
+type listCursor struct {
+	PageToken string `json:"pageToken"`
+	LastPath  string `json:"lastPath"`
+}
+
+// ListFolderPage lists one page of at most pageSize entries of a folder,
+// starting at cursor, which is empty for the first page. Along with the
+// entries, it returns the cursor of the next page, or "" after the last one.
+// If listing a page fails, calling ListFolderPage again with the same cursor
+// resumes the listing, without skipping or repeating entries.
+func (nc *StorageDriver) ListFolderPage(ctx context.Context, ref *provider.Reference, mdKeys []string, pageSize int, cursor string) ([]*provider.ResourceInfo, string, error) {
+	ref = nc.normalizeRef(ref)
+	var c listCursor
+	if cursor != "" {
+		j, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", errtypes.BadRequest("nextcloud storage driver: invalid cursor")
+		}
+		if err := json.Unmarshal(j, &c); err != nil {
+			return nil, "", errtypes.BadRequest("nextcloud storage driver: invalid cursor")
+		}
+	}
+	type paramsObj struct {
+		Ref       *provider.Reference `json:"ref"`
+		MdKeys    []string            `json:"mdKeys"`
+		PageSize  int                 `json:"pageSize"`
+		PageToken string              `json:"pageToken,omitempty"`
+		After     string              `json:"after,omitempty"`
+	}
+	bodyObj := &paramsObj{
+		Ref:       ref,
+		MdKeys:    mdKeys,
+		PageSize:  pageSize,
+		PageToken: c.PageToken,
+		After:     c.LastPath,
+	}
+	bodyStr, _ := json.Marshal(bodyObj)
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("ListFolderPage %s", bodyStr)
+
+	_, respBody, err := nc.do(ctx, Action{"ListFolderPage", string(bodyStr)})
+	if err != nil {
+		return nil, "", notFound(err, ref.GetPath())
+	}
+	var respObj struct {
+		Entries       []*provider.ResourceInfo `json:"entries"`
+		NextPageToken string                   `json:"nextPageToken"`
+	}
+	err = json.Unmarshal(respBody, &respObj)
+	if err != nil {
+		return nil, "", err
+	}
+	if respObj.NextPageToken == "" {
+		return respObj.Entries, "", nil
+	}
+	next := listCursor{
+		PageToken: respObj.NextPageToken,
+		LastPath:  c.LastPath,
+	}
+	if len(respObj.Entries) > 0 {
+		next.LastPath = respObj.Entries[len(respObj.Entries)-1].GetPath()
+	}
+	j, _ := json.Marshal(next)
+	return respObj.Entries, base64.RawURLEncoding.EncodeToString(j), nil
+}
+
+func (nc *StorageDriver) listFolder(ctx context.Context, ref *provider.Reference, mdKeys []string) ([]*provider.ResourceInfo, error) {
+	type paramsObj struct {
+		Ref            *provider.Reference `json:"ref"`
+		MdKeys         []string            `json:"mdKeys"`
+		IncludeTrashed bool                `json:"includeTrashed,omitempty"`
+	}
+	includeTrashed := contextIncludeTrashed(ctx)
+	bodyObj := &paramsObj{
+		Ref:            ref,
+		MdKeys:         mdKeys,
+		IncludeTrashed: includeTrashed,
+	}
+	bodyStr, err := json.Marshal(bodyObj)
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("ListFolder %s", bodyStr)
+	if err != nil {
+		return nil, err
+	}
+	body, err := nc.doStream(ctx, Action{"ListFolder", string(bodyStr)})
+	if err != nil {
+		if _, ok := err.(errtypes.IsNotFound); ok {
+			return nil, errtypes.NotFound(ref.GetPath())
+		}
+		return nil, err
+	}
+	defer body.Close()
+
+	// decode the entries one by one, so that max_list_entries can stop
+	// an oversized listing before all of it is read
+	dec := json.NewDecoder(body)
+	if _, err := dec.Token(); err != nil {
+		if err == io.EOF {
+			return []*provider.ResourceInfo{}, nil
+		}
+		return nil, err
+	}
+	pointers := []*provider.ResourceInfo{}
+	for dec.More() {
+		if nc.maxListEntries > 0 && len(pointers) == nc.maxListEntries {
+			return nil, errtypes.BadRequest(fmt.Sprintf("nextcloud storage driver: folder has more than %d entries, result too large, use paging", nc.maxListEntries))
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		var info provider.ResourceInfo
+		if err := json.Unmarshal(raw, &info); err != nil {
+			return nil, err
+		}
+		if includeTrashed {
+			var flag struct {
+				Trashed bool `json:"trashed"`
+			}
+			if err := json.Unmarshal(raw, &flag); err != nil {
+				return nil, err
+			}
+			if flag.Trashed {
+				setOpaqueEntry(&info, TrashedKey, &types.OpaqueEntry{
+					Decoder: "plain",
+					Value:   []byte("true"),
+				})
+			}
+		}
+		pointers = append(pointers, &info)
+	}
+	return pointers, nil
+}
+
+// checkUploadMimeType returns a PermissionDenied error if the mime type
+// inferred from filePath is not in the configured allowed_upload_mime_types.
+func (nc *StorageDriver) checkUploadMimeType(filePath string) error {
+	if len(nc.uploadMimes) == 0 {
+		return nil
+	}
+	mimeType := mime.Detect(false, filePath)
+	for _, allowed := range nc.uploadMimes {
+		if mimeType == allowed {
+			return nil
+		}
+	}
+	return errtypes.PermissionDenied("nextcloud storage driver: upload of mime type " + mimeType + " is not allowed")
+}
+
+// InitiateUpload as defined in the storage.FS interface.
+func (nc *StorageDriver) InitiateUpload(ctx context.Context, ref *provider.Reference, uploadLength int64, metadata map[string]string) (map[string]string, error) {
+	ref = nc.normalizeRef(ref)
+	if err := nc.checkUploadMimeType(ref.GetPath()); err != nil {
+		return nil, err
+	}
+	type paramsObj struct {
+		Ref          *provider.Reference `json:"ref"`
+		UploadLength int64               `json:"uploadLength"`
+		Metadata     map[string]string   `json:"metadata"`
+		Compress     bool                `json:"compress,omitempty"`
+	}
+	bodyObj := &paramsObj{
+		Ref:          ref,
+		UploadLength: uploadLength,
+		Metadata:     metadata,
+		Compress:     nc.compress,
+	}
+	respMap := make(map[string]string)
+	if err := nc.doJSON(ctx, "InitiateUpload", bodyObj, &respMap); err != nil {
+		return nil, err
+	}
+	return respMap, nil
+}
+
+// Upload as defined in the storage.FS interface.
+func (nc *StorageDriver) Upload(ctx context.Context, ref *provider.Reference, r io.ReadCloser) error {
+	_, err := nc.UploadWithResourceID(ctx, ref, r)
+	return err
+}
+
+// UploadWithResourceID is like Upload, but also returns the id the server
+// assigned to the uploaded file, or nil if the server did not report one.
+func (nc *StorageDriver) UploadWithResourceID(ctx context.Context, ref *provider.Reference, r io.ReadCloser) (*provider.ResourceId, error) {
+	id, _, err := nc.upload(ctx, ref, r)
+	return id, err
+}
+
+// UploadWithFinalPath is like Upload, but also returns the path the file ended
+// up at. That is the path of ref, unless the upload_conflict_policy is
+// "rename" and a file with that name existed, e.g. "/file (2).txt".
+func (nc *StorageDriver) UploadWithFinalPath(ctx context.Context, ref *provider.Reference, r io.ReadCloser) (string, error) {
+	_, p, err := nc.upload(ctx, ref, r)
+	return p, err
+}
+
+func (nc *StorageDriver) upload(ctx context.Context, ref *provider.Reference, r io.ReadCloser) (*provider.ResourceId, string, error) {
+	if err := nc.checkUploadMimeType(ref.GetPath()); err != nil {
+		return nil, "", err
+	}
+	ref = nc.normalizeRef(ref)
+	return nc.doUpload(ctx, ref.Path, r)
+}
+
+// Sync asks the server to commit the file at ref to stable storage, and returns
+// once it is durable. Servers that do not support this are assumed to write
+// durably anyway, so for them Sync does nothing.
+func (nc *StorageDriver) Sync(ctx context.Context, ref *provider.Reference) error {
+	ref = nc.normalizeRef(ref)
+	err := nc.doJSON(ctx, "Sync", ref, nil)
+	if _, ok := err.(errtypes.IsNotSupported); ok {
+		log := appctx.GetLogger(ctx)
+		log.Debug().Msgf("nextcloud storage driver: server does not support Sync, skipping it for %s", FormatReference(ref))
+		return nil
+	}
+	return err
+}
+
+// UploadSession is an upload that was started but never finished.
+type UploadSession struct {
+	ID   string
+	Size uint64 // bytes received so far
+	Age  time.Duration
+}
+
+// ListStaleUploads returns the upload sessions that were not touched for
+// longer than olderThan. They can be cleaned up with AbortUpload.
+func (nc *StorageDriver) ListStaleUploads(ctx context.Context, olderThan time.Duration) ([]UploadSession, error) {
+	type paramsObj struct {
+		OlderThan int64 `json:"olderThan"`
+	}
+	bodyObj := &paramsObj{
+		OlderThan: int64(olderThan.Seconds()),
+	}
+	var respArr []struct {
+		ID   string `json:"id"`
+		Size uint64 `json:"size"`
+		Age  int64  `json:"age"` // in seconds
+	}
+	if err := nc.doJSON(ctx, "ListStaleUploads", bodyObj, &respArr); err != nil {
+		return nil, err
+	}
+	sessions := make([]UploadSession, len(respArr))
+	for i, s := range respArr {
+		sessions[i] = UploadSession{
+			ID:   s.ID,
+			Size: s.Size,
+			Age:  time.Duration(s.Age) * time.Second,
+		}
+	}
+	return sessions, nil
+}
+
+// AbortUpload cancels an unfinished upload session, discarding what the
+// server received of it.
+func (nc *StorageDriver) AbortUpload(ctx context.Context, sessionID string) error {
+	type paramsObj struct {
+		ID string `json:"id"`
+	}
+	bodyObj := &paramsObj{
+		ID: sessionID,
+	}
+	bodyStr, _ := json.Marshal(bodyObj)
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("AbortUpload %s", bodyStr)
+
+	_, _, err := nc.do(ctx, Action{"AbortUpload", string(bodyStr)})
+	if err != nil {
+		return notFound(err, sessionID)
+	}
+	return nil
+}
+
+// UploadTUS uploads the content of r with the TUS protocol. If the server
+// already received part of the upload, it resumes from the reported offset.
+// Once the upload is complete, it returns the id the server assigned to the file.
+func (nc *StorageDriver) UploadTUS(ctx context.Context, ref *provider.Reference, r io.ReadCloser) (*provider.ResourceId, error) {
+	if err := nc.checkUploadMimeType(ref.GetPath()); err != nil {
+		return nil, err
+	}
+	ref = nc.normalizeRef(ref)
+	return nc.doUploadTUS(ctx, ref.GetPath(), r)
+}
+
+// WriteAt writes the content of r into an existing file, starting at offset,
+// leaving the rest of the file untouched.
+func (nc *StorageDriver) WriteAt(ctx context.Context, ref *provider.Reference, offset int64, r io.Reader) error {
+	user, err := getUser(ctx)
+	if err != nil {
+		return err
+	}
+	if err := nc.checkEnabled("WriteAt"); err != nil {
+		return err
+	}
+	// the range end has to be known up front for the Content-Range header
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	p, err := nc.resolvePath(ctx, nc.normalizeRef(ref))
+	if err != nil {
+		return err
+	}
+	url := nc.getEndPoint() + nc.userPath(user, "~"+user.Id.OpaqueId) + "/api/storage/WriteAt/home" + path.Join("/", p)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := nc.authorize(ctx, req); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, offset+int64(len(data))-1))
+	resp, err := nc.doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		return errtypes.NotFound(p)
+	case resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
+		return errtypes.NotSupported("nextcloud storage driver: the server does not support range writes")
+	default:
+		return nc.responseError(resp.StatusCode, body)
+	}
+}
+
+// Download as defined in the storage.FS interface.
+func (nc *StorageDriver) Download(ctx context.Context, ref *provider.Reference) (io.ReadCloser, error) {
+	ref = nc.normalizeRef(ref)
+	return nc.doDownload(ctx, ref.Path)
+}
+
+// DownloadArchive streams an archive, in "zip" or "tar" format, of the given resources.
+func (nc *StorageDriver) DownloadArchive(ctx context.Context, refs []*provider.Reference, format string) (io.ReadCloser, error) {
+	if format != "zip" && format != "tar" {
+		return nil, errtypes.BadRequest("nextcloud storage driver: unsupported archive format " + format)
+	}
+	type paramsObj struct {
+		Refs   []*provider.Reference `json:"refs"`
+		Format string                `json:"format"`
+	}
+	bodyObj := &paramsObj{
+		Refs:   nc.normalizeRefs(refs),
+		Format: format,
+	}
+	bodyStr, _ := json.Marshal(bodyObj)
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("DownloadArchive %s", bodyStr)
+
+	return nc.doStream(ctx, Action{"DownloadArchive", string(bodyStr)})
+}
+
+// UploadArchive uploads an archive, in "zip" or "tar" format, for the server to
+// extract into the folder at ref, all in one request.
+func (nc *StorageDriver) UploadArchive(ctx context.Context, ref *provider.Reference, format string, r io.ReadCloser) error {
+	defer r.Close()
+	mimeType, ok := map[string]string{"zip": "application/zip", "tar": "application/x-tar"}[format]
+	if !ok {
+		return errtypes.BadRequest("nextcloud storage driver: unsupported archive format " + format)
+	}
+	user, err := getUser(ctx)
+	if err != nil {
+		return err
+	}
+	if err := nc.checkEnabled("UploadArchive"); err != nil {
+		return err
+	}
+	ref = nc.normalizeRef(ref)
+	url := nc.getEndPoint() + nc.userPath(user, "~"+user.Id.OpaqueId) + "/api/storage/UploadArchive/home" + ref.GetPath() + "?format=" + format
+	defer closeOnDone(ctx, r)()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, r)
+	if err != nil {
+		return err
+	}
+	if err := nc.authorize(ctx, req); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mimeType)
+	resp, err := nc.doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return errtypes.NotFound(ref.GetPath())
+	case http.StatusUnsupportedMediaType:
+		return errtypes.BadRequest("nextcloud storage driver: the server cannot extract " + format + " archives")
+	default:
+		return nc.responseError(resp.StatusCode, body)
+	}
+}
+
+// PatchFile applies a unified diff to a text file on the server, provided the
+// file still has the etag baseEtag. It returns the etag of the patched file, or
+// an Aborted error if the file changed in the meantime.
+func (nc *StorageDriver) PatchFile(ctx context.Context, ref *provider.Reference, patch []byte, baseEtag string) (string, error) {
+	type paramsObj struct {
+		Ref      *provider.Reference `json:"ref"`
+		Patch    string              `json:"patch"`
+		BaseEtag string              `json:"baseEtag"`
+	}
+	bodyObj := &paramsObj{
+		Ref:      nc.normalizeRef(ref),
+		Patch:    string(patch),
+		BaseEtag: baseEtag,
+	}
+	var respObj struct {
+		Etag string `json:"etag"`
+	}
+	if err := nc.doJSON(ctx, "PatchFile", bodyObj, &respObj); err != nil {
+		return "", notFound(err, ref.GetPath())
+	}
+	return respObj.Etag, nil
+}
+
+// ListRevisions as defined in the storage.FS interface.
+// The opaque map of each revision is kept as the server sent it, with the
+// base64 values decoded, and encodes back to the same json.
+func (nc *StorageDriver) ListRevisions(ctx context.Context, ref *provider.Reference) ([]*provider.FileVersion, error) {
+	ref = nc.normalizeRef(ref)
+	var respMapArr []provider.FileVersion
+	if err := nc.doJSON(ctx, "ListRevisions", ref, &respMapArr); err != nil {
+		return nil, err
+	}
+	revs := make([]*provider.FileVersion, len(respMapArr))
+	for i := 0; i < len(respMapArr); i++ {
+		revs[i] = &respMapArr[i]
+	}
+	return revs, nil
+}
+
+// GetVersionsSize returns how many bytes the version history of a file takes,
+// summing up the sizes from ListRevisions. ListRevisions does not include the
+// current version; with includeCurrent, its size is added too.
+func (nc *StorageDriver) GetVersionsSize(ctx context.Context, ref *provider.Reference, includeCurrent bool) (uint64, error) {
+	revs, err := nc.ListRevisions(ctx, ref)
+	if err != nil {
+		return 0, err
+	}
+	var total uint64
+	for _, rev := range revs {
+		total += rev.Size
+	}
+	if includeCurrent {
+		md, err := nc.GetMD(ctx, ref, nil)
+		if err != nil {
+			return 0, err
+		}
+		total += md.Size
+	}
+	return total, nil
+}
+
+// DownloadRevision as defined in the storage.FS interface.
+func (nc *StorageDriver) DownloadRevision(ctx context.Context, ref *provider.Reference, key string) (io.ReadCloser, error) {
+	ref = nc.normalizeRef(ref)
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("DownloadRevision %s %s", ref.Path, key)
+
+	readCloser, err := nc.doDownloadRevision(ctx, ref.Path, key)
+	return readCloser, err
+}
+
+// RestoreRevision as defined in the storage.FS interface.
+func (nc *StorageDriver) RestoreRevision(ctx context.Context, ref *provider.Reference, key string) error {
+	type paramsObj struct {
+		Ref *provider.Reference `json:"ref"`
+		Key string              `json:"key"`
+	}
+	bodyObj := &paramsObj{
+		Ref: nc.normalizeRef(ref),
+		Key: key,
+	}
+	return nc.doJSON(ctx, "RestoreRevision", bodyObj, nil)
+}
+
+// PurgeRevision deletes the old version of the file at ref with the given key,
+// as listed by ListRevisions. The server refuses to purge the current version
+// of the file, which gives a BadRequest error, and an unknown key gives a
+// NotFound error.
+func (nc *StorageDriver) PurgeRevision(ctx context.Context, ref *provider.Reference, key string) error {
+	if key == "" {
+		return errtypes.BadRequest("nextcloud storage driver: missing revision key")
+	}
+	type paramsObj struct {
+		Ref *provider.Reference `json:"ref"`
+		Key string              `json:"key"`
+	}
+	bodyObj := &paramsObj{
+		Ref: nc.normalizeRef(ref),
+		Key: key,
+	}
+	bodyStr, _ := json.Marshal(bodyObj)
+	_, _, err := nc.do(ctx, Action{"PurgeRevision", string(bodyStr)})
+	if _, ok := err.(errtypes.IsAlreadyExists); ok {
+		return errtypes.BadRequest("nextcloud storage driver: cannot purge the current version of " + ref.GetPath())
+	}
+	return notFound(err, key)
+}
+
+// ListRecycle as defined in the storage.FS interface.
+func (nc *StorageDriver) ListRecycle(ctx context.Context, basePath, key string, relativePath string) ([]*provider.RecycleItem, error) {
+	log := appctx.GetLogger(ctx)
+	log.Info().Msg("ListRecycle")
+	type paramsObj struct {
+		Key  string `json:"key"`
+		Path string `json:"path"`
+	}
+	bodyObj := &paramsObj{
+		Key:  key,
+		Path: relativePath,
+	}
+	bodyStr, _ := json.Marshal(bodyObj)
+
+	_, respBody, err := nc.do(ctx, Action{"ListRecycle", string(bodyStr)})
+
+	if err != nil {
+		return nil, err
+	}
+	var respMapArr []provider.RecycleItem
+	err = json.Unmarshal(respBody, &respMapArr)
+	if err != nil {
+		return nil, err
+	}
+	var expiries []struct {
+		PurgeAfter uint64 `json:"purge_after"`
+	}
+	err = json.Unmarshal(respBody, &expiries)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*provider.RecycleItem, len(respMapArr))
+	for i := 0; i < len(respMapArr); i++ {
+		items[i] = &respMapArr[i]
+		if expiries[i].PurgeAfter == 0 {
+			continue
+		}
+		if items[i].Opaque == nil {
+			items[i].Opaque = &types.Opaque{}
+		}
+		if items[i].Opaque.Map == nil {
+			items[i].Opaque.Map = map[string]*types.OpaqueEntry{}
+		}
+		items[i].Opaque.Map[PurgeAfterKey] = &types.OpaqueEntry{
+			Decoder: "plain",
+			Value:   []byte(strconv.FormatUint(expiries[i].PurgeAfter, 10)),
+		}
+	}
+	return items, err
+}
+
+// RestoreRecycleItem as defined in the storage.FS interface.
+func (nc *StorageDriver) RestoreRecycleItem(ctx context.Context, basePath, key, relativePath string, restoreRef *provider.Reference) error {
+	type paramsObj struct {
+		Key        string              `json:"key"`
+		Path       string              `json:"path"`
+		RestoreRef *provider.Reference `json:"restoreRef"`
+	}
+	bodyObj := &paramsObj{
+		Key:        key,
+		Path:       relativePath,
+		RestoreRef: restoreRef,
+	}
+	bodyStr, _ := json.Marshal(bodyObj)
+
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("RestoreRecycleItem %s", bodyStr)
+
+	_, _, err := nc.do(ctx, Action{"RestoreRecycleItem", string(bodyStr)})
+
+	return err
+}
+
+// RestoreRecycleItemToOriginal restores an item from the recycle bin to the
+// location it was deleted from, as tracked by the server, and returns where
+// it landed.
+func (nc *StorageDriver) RestoreRecycleItemToOriginal(ctx context.Context, key string) (*provider.Reference, error) {
+	// without a path and restoreRef, the server restores the item to where it
+	// was deleted from
+	type paramsObj struct {
+		Key string `json:"key"`
+	}
+	bodyObj := &paramsObj{
+		Key: key,
+	}
+	bodyStr, _ := json.Marshal(bodyObj)
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("RestoreRecycleItemToOriginal %s", bodyStr)
+
+	_, respBody, err := nc.do(ctx, Action{"RestoreRecycleItem", string(bodyStr)})
+	if err != nil {
+		return nil, notFound(err, key)
+	}
+	var respObj struct {
+		OriginalLocation string `json:"originalLocation"`
+	}
+	err = json.Unmarshal(respBody, &respObj)
+	if err != nil {
+		return nil, err
+	}
+	if respObj.OriginalLocation == "" {
+		return nil, errors.New("nextcloud storage driver: server did not report the original location of " + key)
+	}
+	return &provider.Reference{Path: respObj.OriginalLocation}, nil
+}
+
+// PurgeRecycleItem as defined in the storage.FS interface.
+func (nc *StorageDriver) PurgeRecycleItem(ctx context.Context, basePath, key, relativePath string) error {
+	type paramsObj struct {
+		Key  string `json:"key"`
+		Path string `json:"path"`
+	}
+	bodyObj := &paramsObj{
+		Key:  key,
+		Path: relativePath,
+	}
+	return nc.doJSON(ctx, "PurgeRecycleItem", bodyObj, nil)
+}
+
+// EmptyRecycle as defined in the storage.FS interface.
+func (nc *StorageDriver) EmptyRecycle(ctx context.Context) error {
+	return nc.doJSON(ctx, "EmptyRecycle", nil, nil)
+}
+
+// GetRecycleUsage returns how many bytes and items the recycle bin of the given
+// storage space holds. An empty spaceID stands for the user's personal space.
+func (nc *StorageDriver) GetRecycleUsage(ctx context.Context, spaceID string) (uint64, uint64, error) {
+	if spaceID == "" {
+		u, err := getUser(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		spaceID = u.Id.OpaqueId
+	}
+	type paramsObj struct {
+		SpaceID string `json:"spaceId"`
+	}
+	bodyObj := &paramsObj{
+		SpaceID: spaceID,
+	}
+	var respObj struct {
+		Bytes uint64 `json:"bytes"`
+		Items uint64 `json:"items"`
+	}
+	if err := nc.doJSON(ctx, "GetRecycleUsage", bodyObj, &respObj); err != nil {
+		return 0, 0, err
+	}
+	return respObj.Bytes, respObj.Items, nil
+}
+
+// GetRecycleItem returns the metadata of a single item in the recycle bin,
+// without listing the whole bin.
+func (nc *StorageDriver) GetRecycleItem(ctx context.Context, key, path string) (*provider.RecycleItem, error) {
+	type paramsObj struct {
+		Key  string `json:"key"`
+		Path string `json:"path"`
+	}
+	bodyObj := &paramsObj{
+		Key:  key,
+		Path: path,
+	}
+	var item provider.RecycleItem
+	if err := nc.doJSON(ctx, "GetRecycleItem", bodyObj, &item); err != nil {
+		return nil, notFound(err, key)
+	}
+	return &item, nil
+}
+
+// GetIDsByPaths looks up the ids of many resources in one call. The result maps
+// each ref, as formatted by FormatReference, to its id; resources that do not
+// exist are left out.
+func (nc *StorageDriver) GetIDsByPaths(ctx context.Context, refs []*provider.Reference) (map[string]*provider.ResourceId, error) {
+	normalized := nc.normalizeRefs(refs)
+	// one id per ref, null for those that don't exist
+	var respArr []*provider.ResourceId
+	if err := nc.doJSON(ctx, "GetIDsByPaths", normalized, &respArr); err != nil {
+		return nil, err
+	}
+	if len(respArr) != len(refs) {
+		return nil, errtypes.InternalError(fmt.Sprintf("nextcloud storage driver: asked for %d ids, got %d", len(refs), len(respArr)))
+	}
+	ids := make(map[string]*provider.ResourceId, len(refs))
+	for i, id := range respArr {
+		if id != nil {
+			ids[FormatReference(refs[i])] = id
+		}
+	}
+	return ids, nil
+}
+
+// SystemStats is the storage usage of the whole server.
+type SystemStats struct {
+	TotalBytes uint64 `json:"totalBytes"`
+	UsedBytes  uint64 `json:"usedBytes"`
+	FreeBytes  uint64 `json:"freeBytes"`
+	Users      uint64 `json:"users"`
 }
 
-// InitiateUpload as defined in the storage.FS interface.
-func (nc *StorageDriver) InitiateUpload(ctx context.Context, ref *provider.Reference, uploadLength int64, metadata map[string]string) (map[string]string, error) {
-	type paramsObj struct {
-		Ref          *provider.Reference `json:"ref"`
-		UploadLength int64               `json:"uploadLength"`
-		Metadata     map[string]string   `json:"metadata"`
+// requireAdmin returns a PermissionDenied error unless the user in ctx is one
+// of the configured admin_users.
+func (nc *StorageDriver) requireAdmin(ctx context.Context) error {
+	u, err := getUser(ctx)
+	if err != nil {
+		return err
 	}
-	bodyObj := &paramsObj{
-		Ref:          ref,
-		UploadLength: uploadLength,
-		Metadata:     metadata,
+	for _, admin := range nc.adminUsers {
+		if u.Username == admin {
+			return nil
+		}
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("InitiateUpload %s", bodyStr)
+	return errtypes.PermissionDenied("nextcloud storage driver: " + u.Username + " is not an admin")
+}
 
-	_, respBody, err := nc.do(ctx, Action{"InitiateUpload", string(bodyStr)})
-	if err != nil {
+// GetSystemStats returns the storage usage of all users together. Only the
+// admin_users may call it.
+func (nc *StorageDriver) GetSystemStats(ctx context.Context) (*SystemStats, error) {
+	if err := nc.requireAdmin(ctx); err != nil {
 		return nil, err
 	}
-	respMap := make(map[string]string)
-	err = json.Unmarshal(respBody, &respMap)
-	if err != nil {
+	var stats SystemStats
+	if err := nc.doJSON(ctx, "GetSystemStats", nil, &stats); err != nil {
 		return nil, err
 	}
-	return respMap, err
+	return &stats, nil
 }
 
-// Upload as defined in the storage.FS interface.
-func (nc *StorageDriver) Upload(ctx context.Context, ref *provider.Reference, r io.ReadCloser) error {
-	return nc.doUpload(ctx, ref.Path, r)
-}
+// Job statuses reported by the server for async operations.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
 
-// Download as defined in the storage.FS interface.
-func (nc *StorageDriver) Download(ctx context.Context, ref *provider.Reference) (io.ReadCloser, error) {
-	return nc.doDownload(ctx, ref.Path)
+// JobResult is the state of an async operation on the server, like a copy,
+// delete or export, that was started with a job id.
+type JobResult struct {
+	ID     string          `json:"id"`
+	Status string          `json:"status"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
 }
 
-// ListRevisions as defined in the storage.FS interface.
-func (nc *StorageDriver) ListRevisions(ctx context.Context, ref *provider.Reference) ([]*provider.FileVersion, error) {
-	bodyStr, _ := json.Marshal(ref)
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("ListRevisions %s", bodyStr)
+// GetJobStatus returns the current state of the job, from api/JobStatus/<id>.
+func (nc *StorageDriver) GetJobStatus(ctx context.Context, jobID string) (*JobResult, error) {
+	respBody, err := nc.doGet(ctx, "JobStatus", "JobStatus/"+url.PathEscape(jobID))
+	if err != nil {
+		return nil, notFound(err, jobID)
+	}
+	var job JobResult
+	if err := json.Unmarshal(respBody, &job); err != nil {
+		return nil, errors.Wrap(err, "nextcloud storage driver: could not decode JobStatus response")
+	}
+	return &job, nil
+}
 
-	_, respBody, err := nc.do(ctx, Action{"ListRevisions", string(bodyStr)})
+// WaitForJob polls the status of the job every pollInterval until it is done
+// or failed, and returns its final state. A failed job also gives an error with
+// the message from the server. It gives up with the error of ctx when ctx is
+// cancelled or its deadline passes.
+func (nc *StorageDriver) WaitForJob(ctx context.Context, jobID string, pollInterval time.Duration) (*JobResult, error) {
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := nc.GetJobStatus(ctx, jobID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		switch job.Status {
+		case JobDone:
+			return job, nil
+		case JobFailed:
+			return job, errtypes.InternalError("nextcloud storage driver: job " + jobID + " failed: " + job.Error)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
 
+// StreamServerLogs streams the log lines the app on the server wrote since the
+// given time, or all it kept if since is zero, from api/Logs?since=<time>.
+// Only the admin_users may call it. The stream ends when ctx is cancelled;
+// close it when done.
+func (nc *StorageDriver) StreamServerLogs(ctx context.Context, since time.Time) (io.ReadCloser, error) {
+	user, err := getUser(ctx)
 	if err != nil {
 		return nil, err
 	}
-	var respMapArr []provider.FileVersion
-	err = json.Unmarshal(respBody, &respMapArr)
-	if err != nil {
+	if err := nc.requireAdmin(ctx); err != nil {
 		return nil, err
 	}
-	revs := make([]*provider.FileVersion, len(respMapArr))
-	for i := 0; i < len(respMapArr); i++ {
-		revs[i] = &respMapArr[i]
+	if err := nc.checkEnabled("Logs"); err != nil {
+		return nil, err
 	}
-	return revs, err
+	logsURL := nc.getEndPoint() + nc.userPath(user, "~"+user.Id.OpaqueId) + "/api/Logs"
+	if !since.IsZero() {
+		logsURL += "?since=" + url.QueryEscape(since.UTC().Format(time.RFC3339))
+	}
+	return nc.openDownload(ctx, logsURL, "Logs", 0)
 }
 
-// DownloadRevision as defined in the storage.FS interface.
-func (nc *StorageDriver) DownloadRevision(ctx context.Context, ref *provider.Reference, key string) (io.ReadCloser, error) {
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("DownloadRevision %s %s", ref.Path, key)
+// resolvePath returns the path of ref. A ref with a resource id is looked up
+// with GetPathByID, and its path taken as relative to that.
+func (nc *StorageDriver) resolvePath(ctx context.Context, ref *provider.Reference) (string, error) {
+	if ref.GetResourceId() == nil {
+		return ref.GetPath(), nil
+	}
+	base, err := nc.GetPathByID(ctx, ref.GetResourceId())
+	if err != nil {
+		return "", err
+	}
+	return path.Join(base, ref.GetPath()), nil
+}
 
-	readCloser, err := nc.doDownloadRevision(ctx, ref.Path, key)
-	return readCloser, err
+// GetPathByID as defined in the storage.FS interface.
+func (nc *StorageDriver) GetPathByID(ctx context.Context, id *provider.ResourceId) (string, error) {
+	bodyStr, _ := json.Marshal(id)
+	_, respBody, err := nc.do(ctx, Action{"GetPathByID", string(bodyStr)})
+	return string(respBody), err
 }
 
-// RestoreRevision as defined in the storage.FS interface.
-func (nc *StorageDriver) RestoreRevision(ctx context.Context, ref *provider.Reference, key string) error {
+// bitmaskGrant is how a grant is sent when share_permissions_bitmask is enabled.
+type bitmaskGrant struct {
+	Grantee     *provider.Grantee `json:"grantee"`
+	Permissions int               `json:"permissions"`
+}
+
+// grantParam returns the grant as it should be sent to the Nextcloud backend.
+func (nc *StorageDriver) grantParam(g *provider.Grant) (interface{}, error) {
+	if !nc.permsBitmask || g == nil {
+		return g, nil
+	}
+	bitmask, err := nc.permsMapper.ToBitmask(g.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	return &bitmaskGrant{
+		Grantee:     g.Grantee,
+		Permissions: bitmask,
+	}, nil
+}
+
+// AddGrant as defined in the storage.FS interface.
+func (nc *StorageDriver) AddGrant(ctx context.Context, ref *provider.Reference, g *provider.Grant) error {
+	ref = nc.normalizeRef(ref)
 	type paramsObj struct {
 		Ref *provider.Reference `json:"ref"`
-		Key string              `json:"key"`
+		G   interface{}         `json:"g"`
+	}
+	grant, err := nc.grantParam(g)
+	if err != nil {
+		return err
 	}
 	bodyObj := &paramsObj{
 		Ref: ref,
-		Key: key,
+		G:   grant,
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("RestoreRevision %s", bodyStr)
+	return nc.doJSON(ctx, "AddGrant", bodyObj, nil)
+}
 
-	_, _, err := nc.do(ctx, Action{"RestoreRevision", string(bodyStr)})
-	return err
+// DenyGrant as defined in the storage.FS interface.
+func (nc *StorageDriver) DenyGrant(ctx context.Context, ref *provider.Reference, g *provider.Grantee) error {
+	ref = nc.normalizeRef(ref)
+	type paramsObj struct {
+		Ref *provider.Reference `json:"ref"`
+		G   *provider.Grantee   `json:"g"`
+	}
+	bodyObj := &paramsObj{
+		Ref: ref,
+		G:   g,
+	}
+	return nc.doJSON(ctx, "DenyGrant", bodyObj, nil)
 }
 
-// ListRecycle as defined in the storage.FS interface.
-func (nc *StorageDriver) ListRecycle(ctx context.Context, basePath, key string, relativePath string) ([]*provider.RecycleItem, error) {
-	log := appctx.GetLogger(ctx)
-	log.Info().Msg("ListRecycle")
+// RemoveGrant as defined in the storage.FS interface.
+func (nc *StorageDriver) RemoveGrant(ctx context.Context, ref *provider.Reference, g *provider.Grant) error {
+	ref = nc.normalizeRef(ref)
 	type paramsObj struct {
-		Key  string `json:"key"`
-		Path string `json:"path"`
+		Ref *provider.Reference `json:"ref"`
+		G   *provider.Grant     `json:"g"`
 	}
 	bodyObj := &paramsObj{
-		Key:  key,
-		Path: relativePath,
+		Ref: ref,
+		G:   g,
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
+	return nc.doJSON(ctx, "RemoveGrant", bodyObj, nil)
+}
 
-	_, respBody, err := nc.do(ctx, Action{"ListRecycle", string(bodyStr)})
+// UpdateGrant as defined in the storage.FS interface.
+func (nc *StorageDriver) UpdateGrant(ctx context.Context, ref *provider.Reference, g *provider.Grant) error {
+	ref = nc.normalizeRef(ref)
+	type paramsObj struct {
+		Ref *provider.Reference `json:"ref"`
+		G   interface{}         `json:"g"`
+	}
+	grant, err := nc.grantParam(g)
+	if err != nil {
+		return err
+	}
+	bodyObj := &paramsObj{
+		Ref: ref,
+		G:   grant,
+	}
+	return nc.doJSON(ctx, "UpdateGrant", bodyObj, nil)
+}
+
+// ListGrants as defined in the storage.FS interface.
+func (nc *StorageDriver) ListGrants(ctx context.Context, ref *provider.Reference) ([]*provider.Grant, error) {
+	roleGrants, err := nc.ListGrantsWithRoles(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	grants := make([]*provider.Grant, len(roleGrants))
+	for i, g := range roleGrants {
+		grants[i] = g.Grant
+	}
+	return grants, nil
+}
+
+// RoleGrant is a grant along with the name of the share role its permissions
+// correspond to, as shown to users.
+type RoleGrant struct {
+	*provider.Grant
+	Role string
+}
+
+// ListGrantsWithRoles works like ListGrants, but also names the share role
+// of each grant, see RoleName.
+func (nc *StorageDriver) ListGrantsWithRoles(ctx context.Context, ref *provider.Reference) ([]*RoleGrant, error) {
+	ref = nc.normalizeRef(ref)
+	bodyStr, _ := json.Marshal(ref)
+	log := appctx.GetLogger(ctx)
+	log.Info().Msgf("ListGrants %s", bodyStr)
 
+	_, respBody, err := nc.do(ctx, Action{"ListGrants", string(bodyStr)})
 	if err != nil {
 		return nil, err
 	}
-	var respMapArr []provider.RecycleItem
+
+	// To avoid this error:
+	// json: cannot unmarshal object into Go struct field Grantee.grantee.Id of type providerv1beta1.isGrantee_Id
+	// To test:
+	// bodyStr, _ := json.Marshal(provider.Grant{
+	// 	 Grantee: &provider.Grantee{
+	// 		 Type: provider.GranteeType_GRANTEE_TYPE_USER,
+	// 		 Id: &provider.Grantee_UserId{
+	// 			 UserId: &user.UserId{
+	// 				 Idp:      "some-idp",
+	// 				 OpaqueId: "some-opaque-id",
+	// 				 Type:     user.UserType_USER_TYPE_PRIMARY,
+	// 			 },
+	// 		 },
+	// 	 },
+	// 	 Permissions: &provider.ResourcePermissions{},
+	// })
+	// JSON example:
+	// [{"grantee":{"Id":{"UserId":{"idp":"some-idp","opaque_id":"some-opaque-id","type":1}}},"permissions":{"add_grant":true,"create_container":true,"delete":true,"get_path":true,"get_quota":true,"initiate_file_download":true,"initiate_file_upload":true,"list_grants":true}}]
+	var respMapArr []map[string]interface{}
 	err = json.Unmarshal(respBody, &respMapArr)
 	if err != nil {
 		return nil, err
 	}
-	items := make([]*provider.RecycleItem, len(respMapArr))
+	grants := make([]*RoleGrant, len(respMapArr))
 	for i := 0; i < len(respMapArr); i++ {
-		items[i] = &respMapArr[i]
+		granteeMap := respMapArr[i]["grantee"].(map[string]interface{})
+		granteeIDMap := granteeMap["Id"].(map[string]interface{})
+		var grantee *provider.Grantee
+		if granteeIDGroupIDMap, ok := granteeIDMap["GroupId"].(map[string]interface{}); ok {
+			grantee = &provider.Grantee{
+				Type: provider.GranteeType_GRANTEE_TYPE_GROUP,
+				Id: &provider.Grantee_GroupId{
+					GroupId: &group.GroupId{
+						Idp:      granteeIDGroupIDMap["idp"].(string),
+						OpaqueId: granteeIDGroupIDMap["opaque_id"].(string),
+					},
+				},
+			}
+		} else {
+			granteeIDUserIDMap := granteeIDMap["UserId"].(map[string]interface{})
+			grantee = &provider.Grantee{
+				Type: provider.GranteeType_GRANTEE_TYPE_USER,
+				Id: &provider.Grantee_UserId{
+					UserId: &user.UserId{
+						Idp:      granteeIDUserIDMap["idp"].(string),
+						OpaqueId: granteeIDUserIDMap["opaque_id"].(string),
+						Type:     user.UserType(granteeIDUserIDMap["type"].(float64)),
+					},
+				},
+			}
+		}
+
+		var perms *provider.ResourcePermissions
+		switch p := respMapArr[i]["permissions"].(type) {
+		case float64:
+			// a Nextcloud share permissions bitmask
+			perms, err = nc.permsMapper.FromBitmask(int(p))
+			if err != nil {
+				return nil, err
+			}
+		case map[string]interface{}:
+			perms = permissionsFromObject(p)
+		default:
+			return nil, fmt.Errorf("unexpected permissions in ListGrants response: %v", p)
+		}
+		grant := &provider.Grant{
+			Grantee:     grantee,
+			Permissions: perms,
+		}
+		grants[i] = &RoleGrant{
+			Grant: grant,
+			Role:  RoleName(perms),
+		}
 	}
-	return items, err
+	return grants, err
 }
 
-// RestoreRecycleItem as defined in the storage.FS interface.
-func (nc *StorageDriver) RestoreRecycleItem(ctx context.Context, basePath, key, relativePath string, restoreRef *provider.Reference) error {
+// PermissionExplanation tells which permissions a grantee has on a resource,
+// and where each of them comes from.
+type PermissionExplanation struct {
+	// Permissions are all the permissions of the grantee on the resource.
+	Permissions *provider.ResourcePermissions `json:"permissions"`
+	// Sources maps the json name of each permission the grantee has, e.g.
+	// "initiate_file_download", to the paths of the resources whose grants
+	// give it, nearest first. The path of the resource itself is a direct
+	// grant, any other path a grant inherited from that ancestor.
+	Sources map[string][]string `json:"sources"`
+}
+
+// GetEffectivePermissionsExplained returns the permissions grantee has on the
+// resource at ref, explaining for each permission which direct or inherited
+// grant contributes it. Servers without a dedicated endpoint for this get
+// their grants listed on the resource and on each of its ancestors instead.
+func (nc *StorageDriver) GetEffectivePermissionsExplained(ctx context.Context, ref *provider.Reference, grantee *provider.Grantee) (*PermissionExplanation, error) {
+	ref = nc.normalizeRef(ref)
 	type paramsObj struct {
-		Key        string              `json:"key"`
-		Path       string              `json:"path"`
-		RestoreRef *provider.Reference `json:"restoreRef"`
+		Ref     *provider.Reference `json:"ref"`
+		Grantee *provider.Grantee   `json:"grantee"`
 	}
 	bodyObj := &paramsObj{
-		Key:        key,
-		Path:       relativePath,
-		RestoreRef: restoreRef,
+		Ref:     ref,
+		Grantee: grantee,
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
-
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("RestoreRecycleItem %s", bodyStr)
-
-	_, _, err := nc.do(ctx, Action{"RestoreRecycleItem", string(bodyStr)})
-
-	return err
+	var explanation PermissionExplanation
+	err := nc.doJSON(ctx, "GetEffectivePermissionsExplained", bodyObj, &explanation)
+	if endpointMissing(err) {
+		explained, err := nc.explainPermissions(ctx, ref, grantee)
+		return explained, notFound(err, ref.GetPath())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if explanation.Permissions == nil {
+		return nil, errtypes.NotFound(ref.GetPath())
+	}
+	return &explanation, nil
 }
 
-// PurgeRecycleItem as defined in the storage.FS interface.
-func (nc *StorageDriver) PurgeRecycleItem(ctx context.Context, basePath, key, relativePath string) error {
-	type paramsObj struct {
-		Key  string `json:"key"`
-		Path string `json:"path"`
+// GetAncestors returns the path of the resource at ref followed by those of
+// its ancestors, up to the root. The server has no endpoint for this, so they
+// are derived from the path of the resource, which is only looked up if ref
+// has a resource id.
+func (nc *StorageDriver) GetAncestors(ctx context.Context, ref *provider.Reference) ([]string, error) {
+	p := ref.GetPath()
+	if ref.GetResourceId() != nil {
+		md, err := nc.GetMD(ctx, ref, nil)
+		if err != nil {
+			return nil, err
+		}
+		p = md.GetPath()
 	}
-	bodyObj := &paramsObj{
-		Key:  key,
-		Path: relativePath,
+	ancestors := []string{p}
+	for {
+		parent := path.Dir(p)
+		if parent == p || parent == "." {
+			return ancestors, nil
+		}
+		p = parent
+		ancestors = append(ancestors, p)
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("PurgeRecycleItem %s", bodyStr)
-
-	_, _, err := nc.do(ctx, Action{"PurgeRecycleItem", string(bodyStr)})
-	return err
 }
 
-// EmptyRecycle as defined in the storage.FS interface.
-func (nc *StorageDriver) EmptyRecycle(ctx context.Context) error {
-	log := appctx.GetLogger(ctx)
-	log.Info().Msg("EmptyRecycle")
+// explainPermissions collects the grants for grantee on the resource at ref
+// and on its ancestors, up to the root.
+func (nc *StorageDriver) explainPermissions(ctx context.Context, ref *provider.Reference, grantee *provider.Grantee) (*PermissionExplanation, error) {
+	ancestors, err := nc.GetAncestors(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	explanation := &PermissionExplanation{Sources: map[string][]string{}}
+	for _, p := range ancestors {
+		grants, err := nc.ListGrants(ctx, NewReference("", "", p))
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range grants {
+			if !sameGrantee(g.GetGrantee(), grantee) {
+				continue
+			}
+			set, err := permissionsToMap(g.GetPermissions())
+			if err != nil {
+				return nil, err
+			}
+			for name, ok := range set {
+				if ok {
+					explanation.Sources[name] = append(explanation.Sources[name], p)
+				}
+			}
+		}
+	}
+	set := make(map[string]bool, len(explanation.Sources))
+	for name := range explanation.Sources {
+		set[name] = true
+	}
+	perms, err := permissionsFromMap(set)
+	if err != nil {
+		return nil, err
+	}
+	explanation.Permissions = perms
+	return explanation, nil
+}
 
-	_, _, err := nc.do(ctx, Action{"EmptyRecycle", ""})
-	return err
+// sameGrantee tells whether a and b are the same user or group.
+func sameGrantee(a, b *provider.Grantee) bool {
+	if a.GetUserId() != nil || b.GetUserId() != nil {
+		return a.GetUserId().GetOpaqueId() == b.GetUserId().GetOpaqueId() && a.GetUserId().GetIdp() == b.GetUserId().GetIdp()
+	}
+	return a.GetGroupId().GetOpaqueId() == b.GetGroupId().GetOpaqueId() && a.GetGroupId().GetIdp() == b.GetGroupId().GetIdp()
 }
 
-// GetPathByID as defined in the storage.FS interface.
-func (nc *StorageDriver) GetPathByID(ctx context.Context, id *provider.ResourceId) (string, error) {
-	bodyStr, _ := json.Marshal(id)
-	_, respBody, err := nc.do(ctx, Action{"GetPathByID", string(bodyStr)})
-	return string(respBody), err
+func permissionsFromObject(permsMap map[string]interface{}) *provider.ResourcePermissions {
+	return &provider.ResourcePermissions{
+		AddGrant:             permsMap["add_grant"].(bool),
+		CreateContainer:      permsMap["create_container"].(bool),
+		Delete:               permsMap["delete"].(bool),
+		GetPath:              permsMap["get_path"].(bool),
+		GetQuota:             permsMap["get_quota"].(bool),
+		InitiateFileDownload: permsMap["initiate_file_download"].(bool),
+		InitiateFileUpload:   permsMap["initiate_file_upload"].(bool),
+		ListGrants:           permsMap["list_grants"].(bool),
+		ListContainer:        permsMap["list_container"].(bool),
+		ListFileVersions:     permsMap["list_file_versions"].(bool),
+		ListRecycle:          permsMap["list_recycle"].(bool),
+		Move:                 permsMap["move"].(bool),
+		RemoveGrant:          permsMap["remove_grant"].(bool),
+		PurgeRecycle:         permsMap["purge_recycle"].(bool),
+		RestoreFileVersion:   permsMap["restore_file_version"].(bool),
+		RestoreRecycleItem:   permsMap["restore_recycle_item"].(bool),
+		Stat:                 permsMap["stat"].(bool),
+		UpdateGrant:          permsMap["update_grant"].(bool),
+	}
 }
 
-// AddGrant as defined in the storage.FS interface.
-func (nc *StorageDriver) AddGrant(ctx context.Context, ref *provider.Reference, g *provider.Grant) error {
+// GetShareRecipientSuggestions returns the users and groups the server suggests
+// for sharing the resource at ref with, matching the partial name in query.
+// At most limit suggestions are returned; zero leaves it to the server.
+func (nc *StorageDriver) GetShareRecipientSuggestions(ctx context.Context, ref *provider.Reference, query string, limit int) ([]*provider.Grantee, error) {
 	type paramsObj struct {
-		Ref *provider.Reference `json:"ref"`
-		G   *provider.Grant     `json:"g"`
+		Ref   *provider.Reference `json:"ref"`
+		Query string              `json:"query"`
+		Limit int                 `json:"limit,omitempty"`
 	}
 	bodyObj := &paramsObj{
-		Ref: ref,
-		G:   g,
+		Ref:   nc.normalizeRef(ref),
+		Query: query,
+		Limit: limit,
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("AddGrant %s", bodyStr)
-
-	_, _, err := nc.do(ctx, Action{"AddGrant", string(bodyStr)})
-	return err
+	// the grantees come as in ListGrants, which encoding/json cannot decode
+	// into a provider.Grantee directly
+	var respArr []struct {
+		Type provider.GranteeType `json:"type"`
+		ID   struct {
+			UserID  *user.UserId   `json:"UserId"`
+			GroupID *group.GroupId `json:"GroupId"`
+		} `json:"Id"`
+	}
+	if err := nc.doJSON(ctx, "ShareRecipients", bodyObj, &respArr); err != nil {
+		return nil, err
+	}
+	grantees := make([]*provider.Grantee, 0, len(respArr))
+	for _, r := range respArr {
+		switch {
+		case r.ID.UserID != nil:
+			grantees = append(grantees, &provider.Grantee{
+				Type: provider.GranteeType_GRANTEE_TYPE_USER,
+				Id:   &provider.Grantee_UserId{UserId: r.ID.UserID},
+			})
+		case r.ID.GroupID != nil:
+			grantees = append(grantees, &provider.Grantee{
+				Type: provider.GranteeType_GRANTEE_TYPE_GROUP,
+				Id:   &provider.Grantee_GroupId{GroupId: r.ID.GroupID},
+			})
+		}
+		if limit > 0 && len(grantees) == limit {
+			break
+		}
+	}
+	return grantees, nil
 }
 
-// DenyGrant as defined in the storage.FS interface.
-func (nc *StorageDriver) DenyGrant(ctx context.Context, ref *provider.Reference, g *provider.Grantee) error {
-	type paramsObj struct {
-		Ref *provider.Reference `json:"ref"`
-		G   *provider.Grantee   `json:"g"`
+// ResolvePublicShare resolves a public link token, protected by the given
+// password if any, to the metadata of the shared resource.
+func (nc *StorageDriver) ResolvePublicShare(ctx context.Context, token, password string) (*provider.ResourceInfo, error) {
+	bodyObj := &publicShareParams{
+		Token:    token,
+		Password: password,
 	}
-	bodyObj := &paramsObj{
-		Ref: ref,
-		G:   g,
+	var respObj provider.ResourceInfo
+	if err := nc.doJSON(ctx, "ResolvePublicShare", bodyObj, &respObj); err != nil {
+		return nil, notFound(err, token)
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("DenyGrant %s", bodyStr)
+	return &respObj, nil
+}
 
-	_, _, err := nc.do(ctx, Action{"DenyGrant", string(bodyStr)})
-	return err
+// publicShareParams is the request body of ResolvePublicShare.
+type publicShareParams struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
 }
 
-// RemoveGrant as defined in the storage.FS interface.
-func (nc *StorageDriver) RemoveGrant(ctx context.Context, ref *provider.Reference, g *provider.Grant) error {
-	type paramsObj struct {
-		Ref *provider.Reference `json:"ref"`
-		G   *provider.Grant     `json:"g"`
+// logString leaves out the password.
+func (p *publicShareParams) logString() string { return p.Token }
+
+// ShareSummary tells whether and how a resource is shared.
+type ShareSummary struct {
+	UserShares   int  `json:"userShares"`
+	GroupShares  int  `json:"groupShares"`
+	LinkShares   int  `json:"linkShares"`
+	SharedWithMe bool `json:"sharedWithMe"` // someone else shared it with the user
+	SharedByMe   bool `json:"sharedByMe"`   // the user shared it with others
+}
+
+// GetShareSummary returns how many user, group and link shares a resource has,
+// in one call. Servers without a GetShareSummary endpoint get it derived from
+// ListGrants instead, which knows nothing of link shares. There, a grant that
+// someone else created, or that names the user as grantee, makes it shared with
+// the user; any other grant makes it shared by the user.
+func (nc *StorageDriver) GetShareSummary(ctx context.Context, ref *provider.Reference) (*ShareSummary, error) {
+	ref = nc.normalizeRef(ref)
+	var summary ShareSummary
+	err := nc.doJSON(ctx, "GetShareSummary", ref, &summary)
+	if endpointMissing(err) {
+		u, err := getUser(ctx)
+		if err != nil {
+			return nil, err
+		}
+		grants, err := nc.ListGrants(ctx, ref)
+		if err != nil {
+			return nil, notFound(err, ref.GetPath())
+		}
+		summary := &ShareSummary{}
+		for _, g := range grants {
+			switch g.GetGrantee().GetType() {
+			case provider.GranteeType_GRANTEE_TYPE_USER:
+				summary.UserShares++
+			case provider.GranteeType_GRANTEE_TYPE_GROUP:
+				summary.GroupShares++
+			}
+			creator := g.GetCreator().GetOpaqueId()
+			if (creator != "" && creator != u.Id.OpaqueId) || g.GetGrantee().GetUserId().GetOpaqueId() == u.Id.OpaqueId {
+				summary.SharedWithMe = true
+			} else {
+				summary.SharedByMe = true
+			}
+		}
+		return summary, nil
 	}
-	bodyObj := &paramsObj{
-		Ref: ref,
-		G:   g,
+	if err != nil {
+		return nil, notFound(err, ref.GetPath())
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("RemoveGrant %s", bodyStr)
-
-	_, _, err := nc.do(ctx, Action{"RemoveGrant", string(bodyStr)})
-	return err
+	return &summary, nil
 }
 
-// UpdateGrant as defined in the storage.FS interface.
-func (nc *StorageDriver) UpdateGrant(ctx context.Context, ref *provider.Reference, g *provider.Grant) error {
-	type paramsObj struct {
-		Ref *provider.Reference `json:"ref"`
-		G   *provider.Grant     `json:"g"`
+// CheckRetentionLocks returns those of refs that are under retention, and so
+// cannot be deleted yet, e.g. to warn before a bulk delete. Servers without a
+// batch endpoint for this are asked about each resource in turn.
+func (nc *StorageDriver) CheckRetentionLocks(ctx context.Context, refs []*provider.Reference) ([]*provider.Reference, error) {
+	normalized := nc.normalizeRefs(refs)
+	var locked []bool
+	err := nc.doJSON(ctx, "CheckRetentionLocks", normalized, &locked)
+	if _, ok := err.(errtypes.IsNotSupported); ok {
+		locked, err = nc.checkRetentionLocksOneByOne(ctx, normalized)
 	}
-	bodyObj := &paramsObj{
-		Ref: ref,
-		G:   g,
+	if err != nil {
+		return nil, err
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
-	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("UpdateGrant %s", bodyStr)
+	if len(locked) != len(refs) {
+		return nil, errtypes.InternalError(fmt.Sprintf("nextcloud storage driver: asked about %d retention locks, got %d", len(refs), len(locked)))
+	}
+	lockedRefs := []*provider.Reference{}
+	for i, l := range locked {
+		if l {
+			lockedRefs = append(lockedRefs, refs[i])
+		}
+	}
+	return lockedRefs, nil
+}
 
-	_, _, err := nc.do(ctx, Action{"UpdateGrant", string(bodyStr)})
-	return err
+func (nc *StorageDriver) checkRetentionLocksOneByOne(ctx context.Context, refs []*provider.Reference) ([]bool, error) {
+	locked := make([]bool, len(refs))
+	for i, ref := range refs {
+		bodyStr, _ := json.Marshal(ref)
+		_, respBody, err := nc.do(ctx, Action{"GetRetention", string(bodyStr)})
+		if err != nil {
+			return nil, notFound(err, FormatReference(ref))
+		}
+		var respObj struct {
+			Locked bool `json:"locked"`
+		}
+		if err := json.Unmarshal(respBody, &respObj); err != nil {
+			return nil, err
+		}
+		locked[i] = respObj.Locked
+	}
+	return locked, nil
 }
 
-// ListGrants as defined in the storage.FS interface.
-func (nc *StorageDriver) ListGrants(ctx context.Context, ref *provider.Reference) ([]*provider.Grant, error) {
+// GetPermissions returns the effective permissions the user has on a resource.
+func (nc *StorageDriver) GetPermissions(ctx context.Context, ref *provider.Reference) (*provider.ResourcePermissions, error) {
+	ref = nc.normalizeRef(ref)
 	bodyStr, _ := json.Marshal(ref)
 	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("ListGrants %s", bodyStr)
+	log.Info().Msgf("GetPermissions %s", bodyStr)
 
-	_, respBody, err := nc.do(ctx, Action{"ListGrants", string(bodyStr)})
+	_, respBody, err := nc.do(ctx, Action{"GetPermissions", string(bodyStr)})
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, ref.GetPath())
 	}
-
-	// To avoid this error:
-	// json: cannot unmarshal object into Go struct field Grantee.grantee.Id of type providerv1beta1.isGrantee_Id
-	// To test:
-	// bodyStr, _ := json.Marshal(provider.Grant{
-	// 	 Grantee: &provider.Grantee{
-	// 		 Type: provider.GranteeType_GRANTEE_TYPE_USER,
-	// 		 Id: &provider.Grantee_UserId{
-	// 			 UserId: &user.UserId{
-	// 				 Idp:      "some-idp",
-	// 				 OpaqueId: "some-opaque-id",
-	// 				 Type:     user.UserType_USER_TYPE_PRIMARY,
-	// 			 },
-	// 		 },
-	// 	 },
-	// 	 Permissions: &provider.ResourcePermissions{},
-	// })
-	// JSON example:
-	// [{"grantee":{"Id":{"UserId":{"idp":"some-idp","opaque_id":"some-opaque-id","type":1}}},"permissions":{"add_grant":true,"create_container":true,"delete":true,"get_path":true,"get_quota":true,"initiate_file_download":true,"initiate_file_upload":true,"list_grants":true}}]
-	var respMapArr []map[string]interface{}
-	err = json.Unmarshal(respBody, &respMapArr)
+	var perms provider.ResourcePermissions
+	err = json.Unmarshal(respBody, &perms)
 	if err != nil {
 		return nil, err
 	}
-	grants := make([]*provider.Grant, len(respMapArr))
-	for i := 0; i < len(respMapArr); i++ {
-		granteeMap := respMapArr[i]["grantee"].(map[string]interface{})
-		granteeIDMap := granteeMap["Id"].(map[string]interface{})
-		granteeIDUserIDMap := granteeIDMap["UserId"].(map[string]interface{})
+	return &perms, nil
+}
 
-		// if (granteeMap["Id"])
-		permsMap := respMapArr[i]["permissions"].(map[string]interface{})
-		grants[i] = &provider.Grant{
-			Grantee: &provider.Grantee{
-				Type: provider.GranteeType_GRANTEE_TYPE_USER, // FIXME: support groups too
-				Id: &provider.Grantee_UserId{
-					UserId: &user.UserId{
-						Idp:      granteeIDUserIDMap["idp"].(string),
-						OpaqueId: granteeIDUserIDMap["opaque_id"].(string),
-						Type:     user.UserType(granteeIDUserIDMap["type"].(float64)),
-					},
-				},
-			},
-			Permissions: &provider.ResourcePermissions{
-				AddGrant:             permsMap["add_grant"].(bool),
-				CreateContainer:      permsMap["create_container"].(bool),
-				Delete:               permsMap["delete"].(bool),
-				GetPath:              permsMap["get_path"].(bool),
-				GetQuota:             permsMap["get_quota"].(bool),
-				InitiateFileDownload: permsMap["initiate_file_download"].(bool),
-				InitiateFileUpload:   permsMap["initiate_file_upload"].(bool),
-				ListGrants:           permsMap["list_grants"].(bool),
-				ListContainer:        permsMap["list_container"].(bool),
-				ListFileVersions:     permsMap["list_file_versions"].(bool),
-				ListRecycle:          permsMap["list_recycle"].(bool),
-				Move:                 permsMap["move"].(bool),
-				RemoveGrant:          permsMap["remove_grant"].(bool),
-				PurgeRecycle:         permsMap["purge_recycle"].(bool),
-				RestoreFileVersion:   permsMap["restore_file_version"].(bool),
-				RestoreRecycleItem:   permsMap["restore_recycle_item"].(bool),
-				Stat:                 permsMap["stat"].(bool),
-				UpdateGrant:          permsMap["update_grant"].(bool),
-			},
-		}
+// CanPerform tells whether the user may perform action on a resource. The action
+// is named after the permission it requires, e.g. "move", "delete" or "add_grant".
+func (nc *StorageDriver) CanPerform(ctx context.Context, ref *provider.Reference, action string) (bool, error) {
+	if !isKnownPermission(action) {
+		return false, errtypes.BadRequest("nextcloud storage driver: unknown action " + action)
 	}
-	return grants, err
+	perms, err := nc.GetPermissions(ctx, ref)
+	if err != nil {
+		return false, err
+	}
+	set, err := permissionsToMap(perms)
+	if err != nil {
+		return false, err
+	}
+	return set[action], nil
 }
 
 // GetQuota as defined in the storage.FS interface.
 func (nc *StorageDriver) GetQuota(ctx context.Context, ref *provider.Reference) (uint64, uint64, error) {
-	log := appctx.GetLogger(ctx)
-	log.Info().Msg("GetQuota")
+	total, used, _, err := nc.GetQuotaWithWarning(ctx, ref)
+	return total, used, err
+}
 
-	_, respBody, err := nc.do(ctx, Action{"GetQuota", ""})
+// GetQuotaWithWarning is like GetQuota, but also returns the warning the
+// server gives once the usage crosses its soft limit, so that users can be
+// told before they hit the hard one. The warning is empty below the soft
+// limit. Servers send it in an X-Quota-Warning header or a "warning" field.
+func (nc *StorageDriver) GetQuotaWithWarning(ctx context.Context, ref *provider.Reference) (uint64, uint64, string, error) {
+	var respObj struct {
+		TotalBytes float64 `json:"totalBytes"`
+		UsedBytes  float64 `json:"usedBytes"`
+		Warning    string  `json:"warning"`
+	}
+	respHeaders, err := nc.doJSONWithResponseHeaders(ctx, "GetQuota", nil, &respObj)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, "", err
+	}
+	warning := respHeaders.Get("X-Quota-Warning")
+	if warning == "" {
+		warning = respObj.Warning
 	}
+	return uint64(respObj.TotalBytes), uint64(respObj.UsedBytes), warning, nil
+}
 
-	var respMap map[string]interface{}
-	err = json.Unmarshal(respBody, &respMap)
+// CheckQuotaForUpload tells whether an upload of size bytes to ref fits in the
+// quota of the user, so that a big upload can be refused before it starts.
+// If it does not fit, it returns false along with an InsufficientStorage error
+// that says how many bytes are available. A quota of zero means unlimited.
+func (nc *StorageDriver) CheckQuotaForUpload(ctx context.Context, ref *provider.Reference, size int64) (bool, error) {
+	total, used, err := nc.GetQuota(ctx, ref)
 	if err != nil {
-		return 0, 0, err
+		return false, err
+	}
+	if total == 0 || size <= 0 {
+		return true, nil
+	}
+	var available uint64
+	if used < total {
+		available = total - used
 	}
-	return uint64(respMap["totalBytes"].(float64)), uint64(respMap["usedBytes"].(float64)), err
+	if uint64(size) > available {
+		return false, errtypes.InsufficientStorage(fmt.Sprintf("nextcloud storage driver: upload of %d bytes does not fit, %d bytes available", size, available))
+	}
+	return true, nil
 }
 
 // CreateReference as defined in the storage.FS interface.
@@ -730,23 +3889,41 @@ func (nc *StorageDriver) CreateReference(ctx context.Context, path string, targe
 		Path: path,
 		URL:  targetURI.String(),
 	}
-	bodyStr, _ := json.Marshal(bodyObj)
-
-	_, _, err := nc.do(ctx, Action{"CreateReference", string(bodyStr)})
-	return err
+	return nc.doJSON(ctx, "CreateReference", bodyObj, nil)
 }
 
 // Shutdown as defined in the storage.FS interface.
 func (nc *StorageDriver) Shutdown(ctx context.Context) error {
-	log := appctx.GetLogger(ctx)
-	log.Info().Msg("Shutdown")
-
-	_, _, err := nc.do(ctx, Action{"Shutdown", ""})
-	return err
+	return nc.doJSON(ctx, "Shutdown", nil, nil)
 }
 
 // SetArbitraryMetadata as defined in the storage.FS interface.
 func (nc *StorageDriver) SetArbitraryMetadata(ctx context.Context, ref *provider.Reference, md *provider.ArbitraryMetadata) error {
+	_, err := nc.setArbitraryMetadata(ctx, ref, md)
+	return err
+}
+
+// SetArbitraryMetadataAndStat is like SetArbitraryMetadata, but also returns
+// the metadata of the resource afterwards, with its new etag and mtime. If the
+// server does not send that along, it is fetched with GetMD.
+func (nc *StorageDriver) SetArbitraryMetadataAndStat(ctx context.Context, ref *provider.Reference, md *provider.ArbitraryMetadata) (*provider.ResourceInfo, error) {
+	respBody, err := nc.setArbitraryMetadata(ctx, ref, md)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(respBody))) == 0 {
+		return nc.GetMD(ctx, ref, nil)
+	}
+	var respObj provider.ResourceInfo
+	err = unmarshalResourceInfo(ctx, respBody, &respObj)
+	if err != nil {
+		return nil, err
+	}
+	return &respObj, nil
+}
+
+func (nc *StorageDriver) setArbitraryMetadata(ctx context.Context, ref *provider.Reference, md *provider.ArbitraryMetadata) ([]byte, error) {
+	ref = nc.normalizeRef(ref)
 	type paramsObj struct {
 		Ref *provider.Reference         `json:"ref"`
 		Md  *provider.ArbitraryMetadata `json:"md"`
@@ -756,15 +3933,93 @@ func (nc *StorageDriver) SetArbitraryMetadata(ctx context.Context, ref *provider
 		Md:  md,
 	}
 	bodyStr, _ := json.Marshal(bodyObj)
+	_, respBody, err := nc.do(ctx, Action{"SetArbitraryMetadata", string(bodyStr)})
+	if err != nil {
+		return nil, notFound(err, ref.GetPath())
+	}
+	return respBody, nil
+}
+
+// SetArbitraryMetadataMulti sets the same arbitrary metadata on all of the
+// given resources in one call. If it fails for some of them, a MultiError
+// with one error per failed resource is returned.
+func (nc *StorageDriver) SetArbitraryMetadataMulti(ctx context.Context, refs []*provider.Reference, md *provider.ArbitraryMetadata) error {
+	type paramsObj struct {
+		Refs []*provider.Reference       `json:"refs"`
+		Md   *provider.ArbitraryMetadata `json:"md"`
+	}
+	bodyObj := &paramsObj{
+		Refs: nc.normalizeRefs(refs),
+		Md:   md,
+	}
+	bodyStr, _ := json.Marshal(bodyObj)
 	log := appctx.GetLogger(ctx)
-	log.Info().Msgf("SetArbitraryMetadata %s", bodyStr)
+	log.Info().Msgf("SetArbitraryMetadataMulti %s", bodyStr)
 
-	_, _, err := nc.do(ctx, Action{"SetArbitraryMetadata", string(bodyStr)})
-	return err
+	_, respBody, err := nc.do(ctx, Action{"SetArbitraryMetadataMulti", string(bodyStr)})
+	if err != nil {
+		return err
+	}
+	return nc.multiResultError(refs, respBody, nil)
+}
+
+// multiResult is the outcome of a bulk call for one of its resources.
+type multiResult struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// Err is the error for Status, or nil if it is a success.
+	Err error `json:"-"`
+}
+
+// decodeResults decodes respBody, which holds the outcome of a bulk call for
+// each of refs, in the same order, and gives each its error. A 404 gives
+// NotFound.
+func (nc *StorageDriver) decodeResults(refs []*provider.Reference, respBody []byte) ([]multiResult, error) {
+	var results []multiResult
+	if err := json.Unmarshal(respBody, &results); err != nil {
+		return nil, err
+	}
+	if len(results) != len(refs) {
+		return nil, errtypes.InternalError(fmt.Sprintf("nextcloud storage driver: sent %d resources, got %d results", len(refs), len(results)))
+	}
+	for i := range results {
+		if results[i].Status == http.StatusNotFound {
+			results[i].Err = errtypes.NotFound(FormatReference(refs[i]))
+			continue
+		}
+		results[i].Err = nc.responseError(results[i].Status, []byte(results[i].Message))
+	}
+	return results, nil
+}
+
+// multiResultError returns a MultiError for the refs of a bulk call that
+// failed, according to respBody, which holds the outcome for each ref in the
+// same order. Errors for which ignore returns true count as success.
+func (nc *StorageDriver) multiResultError(refs []*provider.Reference, respBody []byte, ignore func(err error) bool) error {
+	results, err := nc.decodeResults(refs, respBody)
+	if err != nil {
+		return err
+	}
+	var errs MultiError
+	for i, res := range results {
+		if res.Err == nil || ignore != nil && ignore(res.Err) {
+			continue
+		}
+		if _, ok := res.Err.(errtypes.IsNotFound); ok {
+			errs = append(errs, res.Err)
+			continue
+		}
+		errs = append(errs, errors.Wrap(res.Err, FormatReference(refs[i])))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 // UnsetArbitraryMetadata as defined in the storage.FS interface.
 func (nc *StorageDriver) UnsetArbitraryMetadata(ctx context.Context, ref *provider.Reference, keys []string) error {
+	ref = nc.normalizeRef(ref)
 	type paramsObj struct {
 		Ref  *provider.Reference `json:"ref"`
 		Keys []string            `json:"keys"`
@@ -777,10 +4032,150 @@ func (nc *StorageDriver) UnsetArbitraryMetadata(ctx context.Context, ref *provid
 	log := appctx.GetLogger(ctx)
 	log.Info().Msgf("UnsetArbitraryMetadata %s", bodyStr)
 
-	_, _, err := nc.do(ctx, Action{"UnsetArbitraryMetadata", string(bodyStr)})
+	// keys that are not set, or a resource without any, are unset already
+	_, _, _, err := nc.doAllowingNotFound(ctx, Action{"UnsetArbitraryMetadata", string(bodyStr)}, nil)
 	return err
 }
 
+// metadataDocumentVersion is the version of the document format written by
+// ExportMetadata. ImportMetadata only accepts documents of this version.
+const metadataDocumentVersion = 1
+
+// metadataDocument is the document ExportMetadata writes and ImportMetadata
+// reads. Entry paths are relative to the exported folder, which is ".".
+type metadataDocument struct {
+	Version int             `json:"version"`
+	Entries []metadataEntry `json:"entries"`
+}
+
+type metadataEntry struct {
+	Path     string            `json:"path"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// ExportMetadata returns a JSON document with the arbitrary metadata of ref
+// and everything beneath it, for ImportMetadata to apply to a copy of the
+// subtree, e.g. on another instance. Resources without arbitrary metadata are
+// left out. Like GetRecursiveEtag, it costs one ListFolder per folder.
+func (nc *StorageDriver) ExportMetadata(ctx context.Context, ref *provider.Reference) ([]byte, error) {
+	root, err := nc.GetMD(ctx, ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	doc := metadataDocument{Version: metadataDocumentVersion, Entries: []metadataEntry{}}
+	if err := nc.exportMetadata(ctx, ref, root, root.GetPath(), &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func (nc *StorageDriver) exportMetadata(ctx context.Context, ref *provider.Reference, info *provider.ResourceInfo, rootPath string, doc *metadataDocument) error {
+	if md := info.GetArbitraryMetadata().GetMetadata(); len(md) > 0 {
+		rel := strings.TrimPrefix(strings.TrimPrefix(info.GetPath(), rootPath), "/")
+		if rel == "" {
+			rel = "."
+		}
+		doc.Entries = append(doc.Entries, metadataEntry{Path: rel, Metadata: md})
+	}
+	if info.GetType() != provider.ResourceType_RESOURCE_TYPE_CONTAINER {
+		return nil
+	}
+	children, err := nc.ListFolder(ctx, ref, nil)
+	if err != nil {
+		return err
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].GetPath() < children[j].GetPath()
+	})
+	for _, child := range children {
+		if err := nc.exportMetadata(ctx, childReference(ref, child.GetPath()), child, rootPath, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportMetadata sets the arbitrary metadata of a document from ExportMetadata
+// on ref and the resources beneath it, which must exist already. The whole
+// document is checked before anything is set; an invalid one gives a
+// BadRequest error.
+func (nc *StorageDriver) ImportMetadata(ctx context.Context, ref *provider.Reference, doc []byte) error {
+	var d metadataDocument
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&d); err != nil {
+		return errtypes.BadRequest("nextcloud storage driver: invalid metadata document: " + err.Error())
+	}
+	if err := d.validate(); err != nil {
+		return err
+	}
+	rootPath := ref.GetPath()
+	if rootPath == "" {
+		root, err := nc.GetMD(ctx, ref, nil)
+		if err != nil {
+			return err
+		}
+		rootPath = root.GetPath()
+	}
+	for _, e := range d.Entries {
+		target := &provider.Reference{Path: path.Join(rootPath, e.Path)}
+		if err := nc.SetArbitraryMetadata(ctx, target, &provider.ArbitraryMetadata{Metadata: e.Metadata}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *metadataDocument) validate() error {
+	invalid := func(msg string) error {
+		return errtypes.BadRequest("nextcloud storage driver: invalid metadata document: " + msg)
+	}
+	if d.Version != metadataDocumentVersion {
+		return invalid(fmt.Sprintf("unsupported version %d", d.Version))
+	}
+	seen := map[string]bool{}
+	for _, e := range d.Entries {
+		if e.Path == "" || path.IsAbs(e.Path) || path.Clean(e.Path) != e.Path || e.Path == ".." || strings.HasPrefix(e.Path, "../") {
+			return invalid(fmt.Sprintf("path %q is not relative to the folder", e.Path))
+		}
+		if seen[e.Path] {
+			return invalid(fmt.Sprintf("path %q occurs twice", e.Path))
+		}
+		seen[e.Path] = true
+		if len(e.Metadata) == 0 {
+			return invalid(fmt.Sprintf("no metadata for %q", e.Path))
+		}
+		for k := range e.Metadata {
+			if k == "" {
+				return invalid(fmt.Sprintf("empty key for %q", e.Path))
+			}
+		}
+	}
+	return nil
+}
+
+// CompareAndSetMetadata sets the arbitrary metadata key of ref to newVal, but
+// only if its current value is expectedOld; an empty expectedOld means the key
+// must not be set yet. If the value changed in the meantime, nothing is set
+// and an Aborted error is returned, so the caller can read it again and retry.
+func (nc *StorageDriver) CompareAndSetMetadata(ctx context.Context, ref *provider.Reference, key, expectedOld, newVal string) error {
+	ref = nc.normalizeRef(ref)
+	type paramsObj struct {
+		Ref         *provider.Reference `json:"ref"`
+		Key         string              `json:"key"`
+		ExpectedOld string              `json:"expectedOld"`
+		NewVal      string              `json:"newVal"`
+	}
+	bodyObj := &paramsObj{
+		Ref:         ref,
+		Key:         key,
+		ExpectedOld: expectedOld,
+		NewVal:      newVal,
+	}
+	err := nc.doJSON(ctx, "CompareAndSetMetadata", bodyObj, nil)
+	return notFound(err, ref.GetPath())
+}
+
 // GetLock returns an existing lock on the given reference.
 func (nc *StorageDriver) GetLock(ctx context.Context, ref *provider.Reference) (*provider.Lock, error) {
 	return nil, errtypes.NotSupported("unimplemented")
@@ -803,35 +4198,137 @@ func (nc *StorageDriver) Unlock(ctx context.Context, ref *provider.Reference, lo
 
 // ListStorageSpaces as defined in the storage.FS interface.
 func (nc *StorageDriver) ListStorageSpaces(ctx context.Context, f []*provider.ListStorageSpacesRequest_Filter) ([]*provider.StorageSpace, error) {
-	bodyStr, _ := json.Marshal(f)
-	_, respBody, err := nc.do(ctx, Action{"ListStorageSpaces", string(bodyStr)})
+	var respBody json.RawMessage
+	if err := nc.doJSON(ctx, "ListStorageSpaces", f, &respBody); err != nil {
+		return nil, err
+	}
+	spaces, cursor, err := decodeSpacesPage(respBody)
 	if err != nil {
 		return nil, err
 	}
+	// servers with many spaces may only send the first page
+	seen := map[string]bool{}
+	for pages := 1; cursor != ""; pages++ {
+		if seen[cursor] || pages >= maxSpacesPages {
+			return nil, errtypes.InternalError(fmt.Sprintf("nextcloud storage driver: ListStorageSpaces does not end, at page %d with cursor %q", pages, cursor))
+		}
+		seen[cursor] = true
+		var page []*provider.StorageSpace
+		page, cursor, err = nc.ListStorageSpacesPage(ctx, f, 0, cursor)
+		if err != nil {
+			return nil, err
+		}
+		spaces = append(spaces, page...)
+	}
+	return spaces, nil
+}
+
+// maxSpacesPages is how many pages ListStorageSpaces fetches at most.
+const maxSpacesPages = 1000
+
+// ListStorageSpacesPage lists one page of at most limit storage spaces, or as
+// many as the server sends if limit is 0, starting at cursor, which is empty
+// for the first page. Along with the spaces, it returns the cursor of the next
+// page, or "" after the last one.
+func (nc *StorageDriver) ListStorageSpacesPage(ctx context.Context, f []*provider.ListStorageSpacesRequest_Filter, limit int, cursor string) ([]*provider.StorageSpace, string, error) {
+	type paramsObj struct {
+		Filters []*provider.ListStorageSpacesRequest_Filter `json:"filters"`
+		Limit   int                                         `json:"limit,omitempty"`
+		Cursor  string                                      `json:"cursor,omitempty"`
+	}
+	bodyObj := &paramsObj{
+		Filters: f,
+		Limit:   limit,
+		Cursor:  cursor,
+	}
+	var respBody json.RawMessage
+	if err := nc.doJSON(ctx, "ListStorageSpacesPage", bodyObj, &respBody); err != nil {
+		return nil, "", err
+	}
+	return decodeSpacesPage(respBody)
+}
 
+// decodeSpacesPage decodes a list of storage spaces, which is either a plain
+// array or, if the server pages it, an object with the spaces and the cursor of
+// the next page.
+func decodeSpacesPage(body []byte) ([]*provider.StorageSpace, string, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return []*provider.StorageSpace{}, "", nil
+	}
 	// https://github.com/cs3org/go-cs3apis/blob/970eec3/cs3/storage/provider/v1beta1/resources.pb.go#L1341-L1366
-	var respMapArr []provider.StorageSpace
-	err = json.Unmarshal(respBody, &respMapArr)
-	if err != nil {
-		return nil, err
+	if body[0] == '[' {
+		var spaces []*provider.StorageSpace
+		if err := json.Unmarshal(body, &spaces); err != nil {
+			return nil, "", err
+		}
+		return spaces, "", nil
 	}
-	var spaces = make([]*provider.StorageSpace, len(respMapArr))
-	for i := 0; i < len(respMapArr); i++ {
-		spaces[i] = &respMapArr[i]
+	var page struct {
+		Spaces     []*provider.StorageSpace `json:"spaces"`
+		NextCursor string                   `json:"nextCursor"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, "", err
+	}
+	if page.Spaces == nil {
+		page.Spaces = []*provider.StorageSpace{}
+	}
+	return page.Spaces, page.NextCursor, nil
+}
+
+// SetSpaceEnabled disables or re-enables a storage space. While a space is
+// disabled, the server rejects operations on it, which the driver reports
+// with a SpaceDisabled error. Disabling a space does not delete anything.
+func (nc *StorageDriver) SetSpaceEnabled(ctx context.Context, spaceID string, enabled bool) error {
+	type paramsObj struct {
+		SpaceID string `json:"spaceId"`
+		Enabled bool   `json:"enabled"`
+	}
+	bodyObj := &paramsObj{
+		SpaceID: spaceID,
+		Enabled: enabled,
+	}
+	err := nc.doJSON(ctx, "SetSpaceEnabled", bodyObj, nil)
+	return notFound(err, spaceID)
+}
+
+// TransferOwnership makes newOwner the owner of the resource. If newOwner
+// already has a resource by the same name, it fails with an AlreadyExists error.
+func (nc *StorageDriver) TransferOwnership(ctx context.Context, ref *provider.Reference, newOwner *user.UserId) error {
+	ref = nc.normalizeRef(ref)
+	type paramsObj struct {
+		Ref      *provider.Reference `json:"ref"`
+		NewOwner *user.UserId        `json:"newOwner"`
+	}
+	bodyObj := &paramsObj{
+		Ref:      ref,
+		NewOwner: newOwner,
 	}
-	return spaces, err
+	err := nc.doJSON(ctx, "TransferOwnership", bodyObj, nil)
+	return notFound(err, ref.GetPath())
+}
+
+// PurgeUserData irrevocably deletes all data of a user: their home, their
+// storage spaces and their recycle bin. Unless force is set, it refuses with
+// an ActiveShares error if the user still has active shares.
+func (nc *StorageDriver) PurgeUserData(ctx context.Context, userID *user.UserId, force bool) error {
+	type paramsObj struct {
+		UserID *user.UserId `json:"userId"`
+		Force  bool         `json:"force"`
+	}
+	bodyObj := &paramsObj{
+		UserID: userID,
+		Force:  force,
+	}
+	err := nc.doJSON(ctx, "PurgeUserData", bodyObj, nil)
+	return notFound(err, userID.GetOpaqueId())
 }
 
 // CreateStorageSpace creates a storage space.
 func (nc *StorageDriver) CreateStorageSpace(ctx context.Context, req *provider.CreateStorageSpaceRequest) (*provider.CreateStorageSpaceResponse, error) {
-	bodyStr, _ := json.Marshal(req)
-	_, respBody, err := nc.do(ctx, Action{"CreateStorageSpace", string(bodyStr)})
-	if err != nil {
-		return nil, err
-	}
 	var respObj provider.CreateStorageSpaceResponse
-	err = json.Unmarshal(respBody, &respObj)
-	if err != nil {
+	if err := nc.doJSON(ctx, "CreateStorageSpace", req, &respObj); err != nil {
 		return nil, err
 	}
 	return &respObj, nil
@@ -839,14 +4336,8 @@ func (nc *StorageDriver) CreateStorageSpace(ctx context.Context, req *provider.C
 
 // UpdateStorageSpace updates a storage space.
 func (nc *StorageDriver) UpdateStorageSpace(ctx context.Context, req *provider.UpdateStorageSpaceRequest) (*provider.UpdateStorageSpaceResponse, error) {
-	bodyStr, _ := json.Marshal(req)
-	_, respBody, err := nc.do(ctx, Action{"UpdateStorageSpace", string(bodyStr)})
-	if err != nil {
-		return nil, err
-	}
 	var respObj provider.UpdateStorageSpaceResponse
-	err = json.Unmarshal(respBody, &respObj)
-	if err != nil {
+	if err := nc.doJSON(ctx, "UpdateStorageSpace", req, &respObj); err != nil {
 		return nil, err
 	}
 	return &respObj, nil
@@ -49,9 +49,40 @@ const serverStateGrantRemoved = "GRANT-REMOVED"
 const serverStateRecycle = "RECYCLE"
 const serverStateReference = "REFERENCE"
 const serverStateMetadata = "METADATA"
+const serverStateTransferred = "TRANSFERRED"
+const serverStateListingFlaky = "LISTING-FLAKY"
+const serverStateListingRecovered = "LISTING-RECOVERED"
+const serverStateTreeChanged = "TREE-CHANGED"
+const serverStateHomeQuota = "HOME-QUOTA"
+const serverStateJobRunning = "JOB-RUNNING"
+const serverStateJobDone = "JOB-DONE"
 
 var serverState = serverStateEmpty
 
+// hugeErrorBody is the body of an error response that is too big to log whole.
+var hugeErrorBody = strings.Repeat("<p>Internal Server Error</p>", 200)
+
+// recordedHeaders are request headers that, when present, become part of the request key,
+// as "METHOD URL [Header: value] BODY", so tests can check they were sent.
+var recordedHeaders = []string{"Content-Range", "Accept-Language", "Range", "If-Unmodified-Since", "X-Reva-Compress", "X-Reva-Conflict-Policy", "X-OC-CTime", "If-Modified-Since"}
+
+// responseHeaders holds extra headers for some of the responses below, by request key.
+var responseHeaders = map[string]http.Header{
+	`POST /apps/sciencemesh/~nearfull/api/storage/GetQuota `:                                   {"X-Quota-Warning": {"You have used 95% of your storage"}},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/moved"},"mdKeys":null}`: {"Location": {"/apps/sciencemesh-moved/~tester/api/storage/GetMD"}},
+	`HEAD /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/resumed.txt `:         {"Upload-Offset": {"3"}},
+	`POST /apps/sciencemesh/~tester/api/storage/CreateDir {"path":"/located"}`:                 {"Location": {"../resources/storage-1!fileid-42"}},
+	`GET /apps/sciencemesh/~tester/api/storage/Download/some/big.bin [Range: bytes=10-] `:      {"Content-Range": {"bytes 10-35/36"}},
+	`GET /apps/sciencemesh/~tester/api/storage/Download/some/shifted.bin [Range: bytes=10-] `:  {"Content-Range": {"bytes 5-35/36"}},
+}
+
+// droppedResponses are responses, by request key, of which only the first
+// so many bytes are sent before the connection is dropped.
+var droppedResponses = map[string]int{
+	`GET /apps/sciencemesh/~tester/api/storage/Download/some/big.bin `:     10,
+	`GET /apps/sciencemesh/~tester/api/storage/Download/some/shifted.bin `: 10,
+}
+
 var responses = map[string]Response{
 	`POST /apps/sciencemesh/~f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c/api/storage/AddGrant {"ref":{"path":"/subdir"},"g":{"grantee":{"type":1,"Id":{"UserId":{"opaque_id":"4c510ada-c86b-4815-8820-42cdf82c3d51"}}},"permissions":{"move":true,"stat":true}}} EMPTY`: {200, ``, serverStateGrantAdded},
 
@@ -122,7 +153,7 @@ var responses = map[string]Response{
 	`POST /apps/sciencemesh/~f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c/api/storage/ListRevisions {"path":"/versionedFile"} EMPTY`:         {200, `[{"opaque":{"map":{"some":{"value":"ZGF0YQ=="}}},"key":"version-12","size":1,"mtime":1234567890,"etag":"deadb00f"}]`, serverStateEmpty},
 	`POST /apps/sciencemesh/~f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c/api/storage/ListRevisions {"path":"/versionedFile"} FILE-RESTORED`: {200, `[{"opaque":{"map":{"some":{"value":"ZGF0YQ=="}}},"key":"version-12","size":1,"mtime":1234567890,"etag":"deadb00f"},{"opaque":{"map":{"different":{"value":"c3R1ZmY="}}},"key":"asdf","size":2,"mtime":1234567890,"etag":"deadbeef"}]`, serverStateFileRestored},
 
-	`POST /apps/sciencemesh/~f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c/api/storage/Move {"oldRef":{"path":"/subdir"},"newRef":{"path":"/new_subdir"}}`: {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c/api/storage/Move {"oldRef":{"path":"/subdir"},"newRef":{"path":"/new_subdir"},"conflictPolicy":"fail"}`: {200, ``, serverStateEmpty},
 
 	`POST /apps/sciencemesh/~f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c/api/storage/RemoveGrant {"ref":{"path":"/subdir"},"g":{"grantee":{"type":1,"Id":{"UserId":{"idp":"some-idp","opaque_id":"some-opaque-id","type":1}}},"permissions":{"add_grant":true,"create_container":true,"delete":true,"get_path":true,"get_quota":true,"initiate_file_download":true,"initiate_file_upload":true,"list_grants":true,"list_container":true,"list_file_versions":true,"list_recycle":true,"move":true,"remove_grant":true,"purge_recycle":true,"restore_file_version":true,"restore_recycle_item":true,"stat":true,"update_grant":true}}} EMPTY`:       {200, ``, serverStateGrantRemoved},
 	`POST /apps/sciencemesh/~f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c/api/storage/RemoveGrant {"ref":{"path":"/subdir"},"g":{"grantee":{"type":1,"Id":{"UserId":{"idp":"some-idp","opaque_id":"some-opaque-id","type":1}}},"permissions":{"add_grant":true,"create_container":true,"delete":true,"get_path":true,"get_quota":true,"initiate_file_download":true,"initiate_file_upload":true,"list_grants":true,"list_container":true,"list_file_versions":true,"list_recycle":true,"move":true,"remove_grant":true,"purge_recycle":true,"restore_file_version":true,"restore_recycle_item":true,"stat":true,"update_grant":true}}} GRANT-ADDED`: {200, ``, serverStateGrantRemoved},
@@ -140,17 +171,30 @@ var responses = map[string]Response{
 
 	`POST /apps/sciencemesh/~f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c/api/storage/UpdateGrant {"ref":{"path":"/subdir"},"g":{"grantee":{"type":1,"Id":{"UserId":{"opaque_id":"4c510ada-c86b-4815-8820-42cdf82c3d51"}}},"permissions":{"delete":true,"move":true,"stat":true}}}`: {200, ``, serverStateGrantUpdated},
 
-	`POST /apps/sciencemesh/~tester/api/storage/GetHome `:    {200, `yes we are`, serverStateHome},
-	`POST /apps/sciencemesh/~tester/api/storage/CreateHome `: {201, ``, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/CreateDir {"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some/path"}`:                                                                                                                        {201, ``, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/Delete {"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some/path"}`:                                                                                                                           {200, ``, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"resource_id":{"storage_id":"storage-id-1","opaque_id":"opaque-id-1"},"path":"/some/old/path"},"newRef":{"resource_id":{"storage_id":"storage-id-2","opaque_id":"opaque-id-2"},"path":"/some/new/path"}}`: {200, ``, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some/path"},"mdKeys":["val1","val2","val3"]}`:                                                                                    {200, `{"opaque":{},"type":1,"id":{"opaque_id":"fileid-/some/path"},"checksum":{},"etag":"deadbeef","mime_type":"text/plain","mtime":{"seconds":1234567890},"path":"/some/path","permission_set":{},"size":12345,"canonical_metadata":{},"arbitrary_metadata":{"metadata":{"da":"ta","some":"arbi","trary":"meta"}}}`, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some"},"mdKeys":["val1","val2","val3"]}`:                                                                                    {200, `[{"opaque":{},"type":1,"id":{"opaque_id":"fileid-/some/path"},"checksum":{},"etag":"deadbeef","mime_type":"text/plain","mtime":{"seconds":1234567890},"path":"/some/path","permission_set":{},"size":12345,"canonical_metadata":{},"arbitrary_metadata":{"metadata":{"da":"ta","some":"arbi","trary":"meta"}}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetHome `:                                                                                          {200, `yes we are`, serverStateHome},
+	`POST /apps/sciencemesh/~tester/api/storage/CreateHome `:                                                                                       {201, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/CreateDir {"path":"/MyShares"}`:                                                                    {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/CreateDir {"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some/path"}`: {201, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Delete {"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some/path"}`:    {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"resource_id":{"storage_id":"storage-id-1","opaque_id":"opaque-id-1"},"path":"/some/old/path"},"newRef":{"resource_id":{"storage_id":"storage-id-2","opaque_id":"opaque-id-2"},"path":"/some/new/path"},"conflictPolicy":"fail"}`: {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some/path"},"mdKeys":["val1","val2","val3"]}`:                                                                                                            {200, `{"opaque":{},"type":1,"id":{"opaque_id":"fileid-/some/path"},"checksum":{},"etag":"deadbeef","mime_type":"text/plain","mtime":{"seconds":1234567890},"path":"/some/path","permission_set":{},"size":12345,"canonical_metadata":{},"arbitrary_metadata":{"metadata":{"da":"ta","some":"arbi","trary":"meta"}}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/Subdir"},"mdKeys":null}`:                                                                                                                                                                                                   {404, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ResolveCaseInsensitive {"path":"/Subdir"}`:                                                                                                                                                                                                        {200, `/subdir`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/subdir"},"mdKeys":null}`:                                                                                                                                                                                                   {200, `{"type":2,"id":{"opaque_id":"fileid-/subdir"},"etag":"deadbeef","mime_type":"httpd/unix-directory","path":"/subdir"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/Nonexistent"},"mdKeys":null}`:                                                                                                                                                                                              {404, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ResolveCaseInsensitive {"path":"/Nonexistent"}`:                                                                                                                                                                                                   {404, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/in/a/space"},"mdKeys":null}`:                                                                                                                                                                                               {200, `{"type":1,"id":{"opaque_id":"fileid-/in/a/space"},"path":"/in/a/space","space":{"id":{"opaque_id":"some-space"},"root":{"storage_id":"storage-id","opaque_id":"fileid-/"}}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some"},"mdKeys":["val1","val2","val3"]}`:                                                                                                            {200, `[{"opaque":{},"type":1,"id":{"opaque_id":"fileid-/some/path"},"checksum":{},"etag":"deadbeef","mime_type":"text/plain","mtime":{"seconds":1234567890},"path":"/some/path","permission_set":{},"size":12345,"canonical_metadata":{},"arbitrary_metadata":{"metadata":{"da":"ta","some":"arbi","trary":"meta"}}}]`, serverStateEmpty},
 	// `POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some"},"mdKeys":["val1","val2","val3"]}`:                                                                                    {200, `[{"opaque":{},"type":1,"id":{"opaque_id":"fileid-/path"},"checksum":{},"etag":"deadbeef","mime_type":"text/plain","mtime":{"seconds":1234567890},"path":"/path","permission_set":{},"size":12345,"canonical_metadata":{},"arbitrary_metadata":{"metadata":{"da":"ta","some":"arbi","trary":"meta"}}}]`, serverStateEmpty},
 	`POST /apps/sciencemesh/~tester/api/storage/InitiateUpload {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some/path"},"uploadLength":12345,"metadata":{"key1":"val1","key2":"val2","key3":"val3"}}`: {200, `{ "not":"sure", "what": "should be", "returned": "here" }`, serverStateEmpty},
 	`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/some/file/path.txt shiny!`:                                                                                                                                                       {200, ``, serverStateEmpty},
+	`HEAD /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/path.txt `:                                                                                                                                                         {404, ``, serverStateEmpty},
+	`PATCH /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/path.txt shiny!`:                                                                                                                                                  {204, ``, serverStateEmpty},
+	`HEAD /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/resumed.txt `:                                                                                                                                                      {200, ``, serverStateEmpty},
+	`PATCH /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/resumed.txt ny!`:                                                                                                                                                  {200, `{"id":{"storage_id":"storage-id","opaque_id":"fileid-/some/file/resumed.txt"}}`, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/some/file/with-id.txt shiny!`:                                                                                                                                                    {200, `{"id":{"storage_id":"storage-id","opaque_id":"fileid-/some/file/with-id.txt"}}`, serverStateEmpty},
 	`GET /apps/sciencemesh/~tester/api/storage/Download/some/file/path.txt `:                                                                                                                                                                {200, `the contents of the file`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/DownloadArchive {"refs":[{"path":"/some/dir"},{"path":"/some/file.txt"}],"format":"zip"}`:                                                                                                   {200, "PK\x03\x04the zipped contents", serverStateEmpty},
 	`POST /apps/sciencemesh/~tester/api/storage/ListRevisions {"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some/path"}`:                                                                                      {200, `[{"opaque":{"map":{"some":{"value":"ZGF0YQ=="}}},"key":"version-12","size":12345,"mtime":1234567890,"etag":"deadb00f"},{"opaque":{"map":{"different":{"value":"c3R1ZmY="}}},"key":"asdf","size":12345,"mtime":1234567890,"etag":"deadbeef"}]`, serverStateEmpty},
 	`GET /apps/sciencemesh/~tester/api/storage/DownloadRevision/some%2Frevision/some/file/path.txt `:                                                                                                                                        {200, `the contents of that revision`, serverStateEmpty},
 	`POST /apps/sciencemesh/~tester/api/storage/RestoreRevision {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"},"key":"asdf"}`:                                                       {200, ``, serverStateEmpty},
@@ -158,19 +202,225 @@ var responses = map[string]Response{
 	`POST /apps/sciencemesh/~tester/api/storage/RestoreRecycleItem {"key":"asdf","path":"original/location/when/deleted.txt","restoreRef":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"}}`: {200, ``, serverStateEmpty},
 	`POST /apps/sciencemesh/~tester/api/storage/PurgeRecycleItem {"key":"asdf","path":"original/location/when/deleted.txt"}`:                                                                                                                {200, ``, serverStateEmpty},
 	`POST /apps/sciencemesh/~tester/api/storage/EmptyRecycle `:                                                                                                                                                                              {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetRecycleUsage {"spaceId":"tester"}`:                                                                                                                                                       {200, `{"bytes":12345,"items":3}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetRecycleUsage {"spaceId":"project-x"}`:                                                                                                                                                    {200, `{"bytes":678,"items":1}`, serverStateEmpty},
 	`POST /apps/sciencemesh/~tester/api/storage/GetPathByID {"storage_id":"storage-id","opaque_id":"opaque-id"}`:                                                                                                                            {200, `the/path/for/that/id.txt`, serverStateEmpty},
 	`POST /apps/sciencemesh/~tester/api/storage/AddGrant {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"},"g":{"grantee":{"Id":{"UserId":{"idp":"0.0.0.0:19000","opaque_id":"f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c","type":1}}},"permissions":{"add_grant":true,"create_container":true,"delete":true,"get_path":true,"get_quota":true,"initiate_file_download":true,"initiate_file_upload":true,"list_grants":true,"list_container":true,"list_file_versions":true,"list_recycle":true,"move":true,"remove_grant":true,"purge_recycle":true,"restore_file_version":true,"restore_recycle_item":true,"stat":true,"update_grant":true,"deny_grant":true}}}`: {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/AddGrant {"ref":{"path":"some/file/bitmask.txt"},"g":{"grantee":{"Id":{"UserId":{"idp":"0.0.0.0:19000","opaque_id":"f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c","type":1}}},"permissions":1}}`:                                     {200, ``, serverStateEmpty},
 	`POST /apps/sciencemesh/~tester/api/storage/DenyGrant {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"},"g":{"Id":{"UserId":{"idp":"0.0.0.0:19000","opaque_id":"f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c","type":1}}}}`: {200, ``, serverStateEmpty},
 	`POST /apps/sciencemesh/~tester/api/storage/RemoveGrant {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"},"g":{"grantee":{"Id":{"UserId":{"idp":"0.0.0.0:19000","opaque_id":"f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c","type":1}}},"permissions":{"add_grant":true,"create_container":true,"delete":true,"get_path":true,"get_quota":true,"initiate_file_download":true,"initiate_file_upload":true,"list_grants":true,"list_container":true,"list_file_versions":true,"list_recycle":true,"move":true,"remove_grant":true,"purge_recycle":true,"restore_file_version":true,"restore_recycle_item":true,"stat":true,"update_grant":true,"deny_grant":true}}}`: {200, ``, serverStateEmpty},
 	`POST /apps/sciencemesh/~tester/api/storage/UpdateGrant {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"},"g":{"grantee":{"Id":{"UserId":{"idp":"0.0.0.0:19000","opaque_id":"f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c","type":1}}},"permissions":{"add_grant":true,"create_container":true,"delete":true,"get_path":true,"get_quota":true,"initiate_file_download":true,"initiate_file_upload":true,"list_grants":true,"list_container":true,"list_file_versions":true,"list_recycle":true,"move":true,"remove_grant":true,"purge_recycle":true,"restore_file_version":true,"restore_recycle_item":true,"stat":true,"update_grant":true,"deny_grant":true}}}`: {200, ``, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"}`: {200, `[{"grantee":{"type":1,"Id":{"UserId":{"idp":"some-idp","opaque_id":"some-opaque-id","type":1}}},"permissions":{"add_grant":true,"create_container":true,"delete":true,"get_path":true,"get_quota":true,"initiate_file_download":true,"initiate_file_upload":true,"list_grants":true,"list_container":true,"list_file_versions":true,"list_recycle":true,"move":true,"remove_grant":true,"purge_recycle":true,"restore_file_version":true,"restore_recycle_item":true,"stat":true,"update_grant":true,"deny_grant":true}}]`, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/GetQuota `:                                                                             {200, `{"totalBytes":456,"usedBytes":123}`, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/CreateReference {"path":"some/file/path.txt","url":"http://bing.com/search?q=dotnet"}`: {200, ``, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/Shutdown `:                                                                             {200, ``, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"},"md":{"metadata":{"arbi":"trary","meta":"data"}}}`:                                                                                            {200, ``, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/UnsetArbitraryMetadata {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"},"keys":["arbi"]}`:                                                                                                                           {200, ``, serverStateEmpty},
-	`POST /apps/sciencemesh/~tester/api/storage/ListStorageSpaces [{"type":3,"Term":{"Owner":{"idp":"0.0.0.0:19000","opaque_id":"f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c","type":1}}},{"type":2,"Term":{"Id":{"opaque_id":"opaque-id"}}},{"type":4,"Term":{"SpaceType":"home"}}]`:                                            {200, `	[{"opaque":{"map":{"bar":{"value":"c2FtYQ=="},"foo":{"value":"c2FtYQ=="}}},"id":{"opaque_id":"some-opaque-storage-space-id"},"owner":{"id":{"idp":"some-idp","opaque_id":"some-opaque-user-id","type":1}},"root":{"storage_id":"some-storage-ud","opaque_id":"some-opaque-root-id"},"name":"My Storage Space","quota":{"quota_max_bytes":456,"quota_max_files":123},"space_type":"home","mtime":{"seconds":1234567890}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"}`:                                                                                                                    {200, `[{"grantee":{"type":1,"Id":{"UserId":{"idp":"some-idp","opaque_id":"some-opaque-id","type":1}}},"permissions":{"add_grant":true,"create_container":true,"delete":true,"get_path":true,"get_quota":true,"initiate_file_download":true,"initiate_file_upload":true,"list_grants":true,"list_container":true,"list_file_versions":true,"list_recycle":true,"move":true,"remove_grant":true,"purge_recycle":true,"restore_file_version":true,"restore_recycle_item":true,"stat":true,"update_grant":true,"deny_grant":true}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"some/file/bitmask.txt"}`:                                                                                                                                                                                   {200, `[{"grantee":{"type":1,"Id":{"UserId":{"idp":"some-idp","opaque_id":"some-opaque-id","type":1}}},"permissions":9}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ResolvePublicShare {"token":"some-token","password":"correct-password"}`:                                                                                                                                                       {200, `{"type":1,"id":{"opaque_id":"fileid-/some/path"},"etag":"deadbeef","mime_type":"text/plain","path":"/some/path","size":12345}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ResolvePublicShare {"token":"some-token","password":"wrong-password"}`:                                                                                                                                                         {403, `wrong password`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetPermissions {"path":"/some/path"}`:                                                                                                                                                                                          {200, `{"stat":true,"list_container":true,"move":true}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetQuota `:                                                                                                                                                                                                                     {200, `{"totalBytes":456,"usedBytes":123}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/CreateReference {"path":"some/file/path.txt","url":"http://bing.com/search?q=dotnet"}`:                                                                                                                                         {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Shutdown `:                                                                                                                                                                                                                     {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"},"md":{"metadata":{"arbi":"trary","meta":"data"}}}`:                                                 {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/UnsetArbitraryMetadata {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"some/file/path.txt"},"keys":["arbi"]}`:                                                                                {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListStorageSpaces [{"type":3,"Term":{"Owner":{"idp":"0.0.0.0:19000","opaque_id":"f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c","type":1}}},{"type":2,"Term":{"Id":{"opaque_id":"opaque-id"}}},{"type":4,"Term":{"SpaceType":"home"}}]`: {200, `	[{"opaque":{"map":{"bar":{"value":"c2FtYQ=="},"foo":{"value":"c2FtYQ=="}}},"id":{"opaque_id":"some-opaque-storage-space-id"},"owner":{"id":{"idp":"some-idp","opaque_id":"some-opaque-user-id","type":1}},"root":{"storage_id":"some-storage-ud","opaque_id":"some-opaque-root-id"},"name":"My Storage Space","quota":{"quota_max_bytes":456,"quota_max_files":123},"space_type":"home","mtime":{"seconds":1234567890}}]`, serverStateEmpty},
 	`POST /apps/sciencemesh/~tester/api/storage/CreateStorageSpace {"opaque":{"map":{"bar":{"value":"c2FtYQ=="},"foo":{"value":"c2FtYQ=="}}},"owner":{"id":{"idp":"some-idp","opaque_id":"some-opaque-user-id","type":1}},"type":"home","name":"My Storage Space","quota":{"quota_max_bytes":456,"quota_max_files":123}}`: {200, `{"storage_space":{"opaque":{"map":{"bar":{"value":"c2FtYQ=="},"foo":{"value":"c2FtYQ=="}}},"id":{"opaque_id":"some-opaque-storage-space-id"},"owner":{"id":{"idp":"some-idp","opaque_id":"some-opaque-user-id","type":1}},"root":{"storage_id":"some-storage-ud","opaque_id":"some-opaque-root-id"},"name":"My Storage Space","quota":{"quota_max_bytes":456,"quota_max_files":123},"space_type":"home","mtime":{"seconds":1234567890}}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/SetSpaceEnabled {"spaceId":"project-x","enabled":false}`:                                                                                                                                 {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/some/old/path"},"newRef":{"path":"/some/new/path"},"conflictPolicy":"fail"}`:                                                                                    {200, `{"type":1,"id":{"opaque_id":"fileid-/some/new/path"},"etag":"deadb00f","path":"/some/new/path"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/some/old/file"},"newRef":{"path":"/some/new/file"},"conflictPolicy":"fail"}`:                                                                                    {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/some/new/file"},"mdKeys":null}`:                                                                                                                                   {200, `{"type":1,"id":{"opaque_id":"fileid-/some/new/file"},"etag":"deadb00f","path":"/some/new/file"}`, serverStateEmpty},
+	`PATCH /apps/sciencemesh/~tester/api/storage/WriteAt/home/some/file/path.txt [Content-Range: bytes 5-9/*] patch`:                                                                                                                     {204, ``, serverStateEmpty},
+	`PATCH /apps/sciencemesh/~tester/api/storage/WriteAt/home/some/file/legacy.txt [Content-Range: bytes 0-4/*] patch`:                                                                                                                   {501, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/null-metadata"},"mdKeys":null}`:                                                                                                                                   {200, `{"type":1,"path":"/null-metadata","arbitrary_metadata":null}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/wrong-metadata"},"mdKeys":null}`:                                                                                                                                  {200, `{"type":1,"path":"/wrong-metadata","arbitrary_metadata":["not","an","object"]}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/PatchFile {"ref":{"path":"/notes.txt"},"patch":"@@ -1 +1 @@\n-hello\n+hello world\n","baseEtag":"deadbeef"}`:                                                                             {200, `{"etag":"deadb00f"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/PatchFile {"ref":{"path":"/notes.txt"},"patch":"@@ -1 +1 @@\n-hello\n+hello world\n","baseEtag":"stale"}`:                                                                                {412, `etag mismatch`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/big"},"mdKeys":null}`:                                                                                                                                        {200, `[{"type":1,"path":"/big/file0"},{"type":1,"path":"/big/file1"},{"type":1,"path":"/big/file2"},{"type":1,"path":"/big/file3"},{"type":1,"path":"/big/file4"},{"type":1,"path":"/big/file5"},{"type":1,"path":"/big/file6"},{"type":1,"path":"/big/file7"},{"type":1,"path":"/big/file8"},{"type":1,"path":"/big/file9"},{"type":1,"path":"/big/file10"},{"type":1,"path":"/big/file11"},{"type":1,"path":"/big/file12"},{"type":1,"path":"/big/file13"},{"type":1,"path":"/big/file14"},{"type":1,"path":"/big/file15"},{"type":1,"path":"/big/file16"},{"type":1,"path":"/big/file17"},{"type":1,"path":"/big/file18"},{"type":1,"path":"/big/file19"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetRecycleItem {"key":"some-deleted-version","path":"/"}`:                                                                                                                                {200, `{"opaque":{},"key":"some-deleted-version","ref":{"resource_id":{},"path":"/subdir"},"size":12345,"deletion_time":{"seconds":1234567890}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetRecycleItem {"key":"no-such-key","path":"/"}`:                                                                                                                                         {404, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"some/file/readonly.txt"}`:                                                                                                                                            {200, `[{"grantee":{"type":1,"Id":{"UserId":{"idp":"some-idp","opaque_id":"some-opaque-id","type":1}}},"permissions":1}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadataMulti {"refs":[{"path":"/a.txt"},{"path":"/b.txt"},{"path":"/c.txt"}],"md":{"metadata":{"tag":"urgent"}}}`:                                                           {200, `[{"status":200},{"status":404,"message":"not found"},{"status":200}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/flaky"},"mdKeys":null}`:                                                                                                                                           {503, `try again later`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetCapabilities `:                                                                                                                                                                        {200, `{}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~chunker/api/storage/GetCapabilities `:                                                                                                                                                                       {200, `{"chunkSize":3,"minChunkSize":2,"maxChunkSize":4}`, serverStateEmpty},
+	`HEAD /apps/sciencemesh/~chunker/api/storage/TusUpload/home/some/file/chunked.txt `:                                                                                                                                                  {404, ``, serverStateEmpty},
+	`PATCH /apps/sciencemesh/~chunker/api/storage/TusUpload/home/some/file/chunked.txt shi`:                                                                                                                                              {204, ``, serverStateEmpty},
+	`PATCH /apps/sciencemesh/~chunker/api/storage/TusUpload/home/some/file/chunked.txt ny!`:                                                                                                                                              {200, `{"id":{"storage_id":"storage-id","opaque_id":"fileid-/some/file/chunked.txt"}}`, serverStateEmpty},
+	`PATCH /apps/sciencemesh/~chunker/api/storage/TusUpload/home/some/file/chunked.txt shin`:                                                                                                                                             {204, ``, serverStateEmpty},
+	`PATCH /apps/sciencemesh/~chunker/api/storage/TusUpload/home/some/file/chunked.txt y!`:                                                                                                                                               {200, `{"id":{"storage_id":"storage-id","opaque_id":"fileid-/some/file/chunked.txt"}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/RestoreRecycleItem {"key":"asdf"}`:                                                                                                                                                       {200, `{"originalLocation":"/some/original/file.txt"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/PurgeUserData {"userId":{"idp":"some-idp","opaque_id":"sharer","type":1},"force":false}`:                                                                                                 {409, `user has active shares: 2`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/PurgeUserData {"userId":{"idp":"some-idp","opaque_id":"sharer","type":1},"force":true}`:                                                                                                  {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD [Accept-Language: de] {"ref":{"path":"/gone"},"mdKeys":null}`:                                                                                                                      {404, `Nicht gefunden`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD [Accept-Language: fr] {"ref":{"path":"/gone"},"mdKeys":null}`:                                                                                                                      {404, `Introuvable`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListRevisions {"path":"/some/versioned.txt"}`:                                                                                                                                            {200, `[{"key":"v1","size":100,"mtime":1234567890,"etag":"e1"},{"key":"v2","size":200,"mtime":1234567891,"etag":"e2"},{"key":"v3","size":300,"mtime":1234567892,"etag":"e3"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/some/versioned.txt"},"mdKeys":null}`:                                                                                                                              {200, `{"type":1,"id":{"opaque_id":"fileid-/some/versioned.txt"},"etag":"e4","mime_type":"text/plain","mtime":{"seconds":1234567893},"path":"/some/versioned.txt","size":50,"owner":{"opaque_id":"tester","type":1}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/moved"},"mdKeys":null}`:                                                                                                                                           {308, ``, serverStateEmpty},
+	`POST /apps/sciencemesh-moved/~tester/api/storage/GetMD {"ref":{"path":"/moved"},"mdKeys":null}`:                                                                                                                                     {200, `{"type":2,"id":{"opaque_id":"fileid-/moved"},"path":"/moved","owner":{"opaque_id":"tester","type":1}}`, serverStateEmpty},
+	`POST /apps/sciencemesh-moved/~tester/api/storage/ListFolder {"ref":{"path":"/moved"},"mdKeys":null}`:                                                                                                                                {200, `[]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListStaleUploads {"olderThan":86400}`:                                                                                                                                                    {200, `[{"id":"upload-1","size":1024,"age":90000},{"id":"upload-2","size":0,"age":172800}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/AbortUpload {"id":"upload-1"}`:                                                                                                                                                           {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/a/b"},"newRef":{"path":"/a/c"},"conflictPolicy":"fail"}`:                                                                                                        {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListRecycle {"key":"","path":"/expiring"}`:                                                                                                                                               {200, `[{"key":"expiring-version","ref":{"path":"/expiring/file.txt"},"size":10,"deletion_time":{"seconds":1234567890},"purge_after":1237159890},{"key":"kept-version","ref":{"path":"/expiring/other.txt"},"size":20,"deletion_time":{"seconds":1234567890}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/TransferOwnership {"ref":{"path":"/handover.txt"},"newOwner":{"idp":"some-idp","opaque_id":"successor","type":1}}`:                                                                       {200, ``, serverStateTransferred},
+	`POST /apps/sciencemesh/~tester/api/storage/TransferOwnership {"ref":{"path":"/clash.txt"},"newOwner":{"idp":"some-idp","opaque_id":"successor","type":1}}`:                                                                          {409, `successor already has /clash.txt`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/handover.txt"},"mdKeys":null} TRANSFERRED`:                                                                                                                        {200, `{"type":1,"id":{"opaque_id":"fileid-/handover.txt"},"path":"/handover.txt","owner":{"idp":"some-idp","opaque_id":"successor","type":1}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/dir"},"mdKeys":null}`:                                                                                                                                             {200, `{"type":2,"id":{"opaque_id":"fileid-/dir"},"path":"/dir","owner":{"opaque_id":"tester","type":1}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/remote.php/dav/files/marie/api/storage/GetMD {"ref":{"path":"/templated"},"mdKeys":null}`:                                                                                                                    {200, `{"type":1,"path":"/templated"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/users/4c510ada/api/storage/GetMD {"ref":{"path":"/templated"},"mdKeys":null}`:                                                                                                                                {200, `{"type":1,"path":"/templated"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Copy {"srcRef":{"path":"/big.iso"},"dstRef":{"path":"/big-copy.iso"},"reflink":true}`:                                                                                                    {200, `{"reflink":true}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Copy {"srcRef":{"path":"/old.iso"},"dstRef":{"path":"/old-copy.iso"},"reflink":true}`:                                                                                                    {501, `unknown option reflink`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Copy {"srcRef":{"path":"/old.iso"},"dstRef":{"path":"/old-copy.iso"}}`:                                                                                                                   {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetShareSummary {"path":"/shared/report.pdf"}`:                                                                                                                                           {200, `{"userShares":2,"groupShares":1,"linkShares":3,"sharedWithMe":false,"sharedByMe":true}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetShareSummary {"path":"some/file/readonly.txt"}`:                                                                                                                                       {501, `not implemented`, serverStateEmpty},
+	`POST /apps/sciencemesh/~homer/api/storage/GetHome `:                                                                                                                                                                                 {200, `/home/homer`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolderPage {"ref":{"path":"/paged"},"mdKeys":null,"pageSize":2}`:                                                                                                                     {200, `{"entries":[{"type":1,"path":"/paged/a"},{"type":1,"path":"/paged/b"}],"nextPageToken":"page-2"}`, serverStateListingFlaky},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolderPage {"ref":{"path":"/paged"},"mdKeys":null,"pageSize":2,"pageToken":"page-2","after":"/paged/b"} LISTING-FLAKY`:                                                               {503, `try again later`, serverStateListingRecovered},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolderPage {"ref":{"path":"/paged"},"mdKeys":null,"pageSize":2,"pageToken":"page-2","after":"/paged/b"} LISTING-RECOVERED`:                                                           {200, `{"entries":[{"type":1,"path":"/paged/c"},{"type":1,"path":"/paged/d"}],"nextPageToken":"page-3"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolderPage {"ref":{"path":"/paged"},"mdKeys":null,"pageSize":2,"pageToken":"page-3","after":"/paged/d"}`:                                                                             {200, `{"entries":[{"type":1,"path":"/paged/e"}]}`, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/tree/sub/b.txt v1`:                                                                                                                                                            {200, ``, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/tree/sub/b.txt v2`:                                                                                                                                                            {200, ``, serverStateTreeChanged},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/tree"},"mdKeys":null} EMPTY`:                                                                                                                                 {200, `[{"type":1,"path":"/tree/a.txt","etag":"a1"},{"type":2,"path":"/tree/sub","etag":"sub1"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/tree"},"mdKeys":null} TREE-CHANGED`:                                                                                                                          {200, `[{"type":1,"path":"/tree/a.txt","etag":"a1"},{"type":2,"path":"/tree/sub","etag":"sub1"}]`, serverStateTreeChanged},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/tree/sub"},"mdKeys":null} EMPTY`:                                                                                                                             {200, `[{"type":1,"path":"/tree/sub/b.txt","etag":"b1"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/tree/sub"},"mdKeys":null} TREE-CHANGED`:                                                                                                                      {200, `[{"type":1,"path":"/tree/sub/b.txt","etag":"b2"}]`, serverStateTreeChanged},
+	`GET /apps/sciencemesh/~tester/api/storage/Download/some/big.bin `:                                                                                                                                                                   {200, `0123456789abcdefghijklmnopqrstuvwxyz`, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/storage/Download/some/big.bin [Range: bytes=10-] `:                                                                                                                                                {206, `abcdefghijklmnopqrstuvwxyz`, serverStateEmpty},
+	`POST /apps/sciencemesh/~quotee/api/storage/CreateHome {"quota":1000000}`:                                                                                                                                                            {201, ``, serverStateHomeQuota},
+	`POST /apps/sciencemesh/~quotee/api/storage/GetQuota  HOME-QUOTA`:                                                                                                                                                                    {200, `{"totalBytes":1000000,"usedBytes":0}`, serverStateHomeQuota},
+	`POST /apps/sciencemesh/~protocols/api/storage/GetCapabilities `:                                                                                                                                                                     {200, `{"uploadProtocols":["tus","simple"]}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetRecycleUsage {"spaceId":"empty"}`:                                                                                                                                                     {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetRecycleUsage {"spaceId":"garbled"}`:                                                                                                                                                   {200, `{"bytes":`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetRecycleUsage {"spaceId":"broken"}`:                                                                                                                                                    {500, `{"error":"database is gone"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/CompareAndSetMetadata {"ref":{"path":"/counter"},"key":"count","expectedOld":"1","newVal":"2"}`:                                                                                          {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/CompareAndSetMetadata {"ref":{"path":"/counter"},"key":"count","expectedOld":"0","newVal":"1"}`:                                                                                          {412, `current value is 1`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Delete [If-Unmodified-Since: Wed, 21 Oct 2015 07:28:00 GMT] {"path":"/guarded"}`:                                                                                                         {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Delete [If-Unmodified-Since: Tue, 20 Oct 2015 07:28:00 GMT] {"path":"/guarded"}`:                                                                                                         {412, `modified since`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/mounts"},"mdKeys":null}`:                                                                                                                                     {200, `[{"type":1,"path":"/mounts/notes.txt"},{"type":3,"path":"/mounts/cernbox","target":"cs3:cernbox.cern.ch/some-id"},{"type":2,"path":"/mounts/photos"},{"type":3,"path":"/mounts/surf","target":"https://surf.nl/remote.php/dav/files/einstein"}]`, serverStateEmpty},
+	`HEAD /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/cancelled.txt `:                                                                                                                                                 {404, ``, serverStateEmpty},
+	`DELETE /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/cancelled.txt `:                                                                                                                                               {204, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetSystemStats `:                                                                                                                                                                         {200, `{"totalBytes":1000000000,"usedBytes":250000000,"freeBytes":750000000,"users":42}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~homer/api/storage/GetSystemStats `:                                                                                                                                                                          {403, `not an admin`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/huge-error"},"mdKeys":null}`:                                                                                                                                      {500, hugeErrorBody, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/CheckRetentionLocks [{"path":"/reports/2021.pdf"},{"path":"/reports/2022.pdf"},{"path":"/reports/2023.pdf"}]`:                                                                            {200, `[false,true,false]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~retainer/api/storage/CheckRetentionLocks [{"path":"/reports/2021.pdf"},{"path":"/reports/2022.pdf"},{"path":"/reports/2023.pdf"}]`:                                                                          {501, `not implemented`, serverStateEmpty},
+	`POST /apps/sciencemesh/~retainer/api/storage/GetRetention {"path":"/reports/2021.pdf"}`:                                                                                                                                             {200, `{"locked":false}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~retainer/api/storage/GetRetention {"path":"/reports/2022.pdf"}`:                                                                                                                                             {200, `{"locked":true,"until":1893456000}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~retainer/api/storage/GetRetention {"path":"/reports/2023.pdf"}`:                                                                                                                                             {200, `{"locked":false}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~spacer/api/storage/ListStorageSpaces []`:                                                                                                                                                                    {200, `{"spaces":[{"id":{"opaque_id":"space-1"},"name":"One"},{"id":{"opaque_id":"space-2"},"name":"Two"}],"nextCursor":"page-2"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~spacer/api/storage/ListStorageSpacesPage {"filters":[],"cursor":"page-2"}`:                                                                                                                                  {200, `{"spaces":[{"id":{"opaque_id":"space-3"},"name":"Three"}],"nextCursor":""}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~spacer/api/storage/ListStorageSpacesPage {"filters":[],"limit":2}`:                                                                                                                                          {200, `{"spaces":[{"id":{"opaque_id":"space-1"},"name":"One"},{"id":{"opaque_id":"space-2"},"name":"Two"}],"nextCursor":"page-2"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Sync {"path":"/some/file/path.txt"}`:                                                                                                                                                     {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~homer/api/storage/Sync {"path":"/some/file/path.txt"}`:                                                                                                                                                      {501, `not implemented`, serverStateEmpty},
+	`POST /nextcloud2/apps/sciencemesh/~tester/api/storage/GetHome `:                                                                                                                                                                     {200, `/home/tester`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/CreateDir {"path":"/located"}`:                                                                                                                                                           {201, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~nearfull/api/storage/GetQuota `:                                                                                                                                                                             {200, `{"totalBytes":1000,"usedBytes":950}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~overfull/api/storage/GetQuota `:                                                                                                                                                                             {200, `{"totalBytes":1000,"usedBytes":990,"warning":"You have used 99% of your storage"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetIDsByPaths [{"path":"/a.txt"},{"path":"/missing.txt"},{"path":"/dir/b.txt"}]`:                                                                                                         {200, `[{"storage_id":"storage-1","opaque_id":"fileid-1"},null,{"storage_id":"storage-1","opaque_id":"fileid-2"}]`, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/UploadArchive/home/photos?format=zip PK zipped photos`:                                                                                                                                    {201, ``, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/UploadArchive/home/photos?format=tar tarred photos`:                                                                                                                                       {415, `unsupported archive format`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/bin"},"mdKeys":null}`:                                                                                                                                        {200, `[{"type":1,"path":"/bin/kept.txt"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/bin"},"mdKeys":null,"includeTrashed":true}`:                                                                                                                  {200, `[{"type":1,"path":"/bin/kept.txt"},{"type":1,"path":"/bin/deleted.txt","trashed":true}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListRevisions {"path":"/opaque.bin"}`:                                                                                                                                                    {200, `[{"opaque":{"map":{"author":{"decoder":"plain","value":"bWFyaWU="},"blob":{"decoder":"binary","value":"AP8Q"}}},"key":"v1","size":3,"mtime":1234567890,"etag":"e1"}]`, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/JobStatus/job-7  EMPTY`:                                                                                                                                                                           {200, `{"id":"job-7","status":"queued"}`, serverStateJobRunning},
+	`GET /apps/sciencemesh/~tester/api/JobStatus/job-7  JOB-RUNNING`:                                                                                                                                                                     {200, `{"id":"job-7","status":"running"}`, serverStateJobDone},
+	`GET /apps/sciencemesh/~tester/api/JobStatus/job-7  JOB-DONE`:                                                                                                                                                                        {200, `{"id":"job-7","status":"done","result":{"path":"/exports/all.zip"}}`, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/JobStatus/job-8 `:                                                                                                                                                                                 {200, `{"id":"job-8","status":"failed","error":"disk full"}`, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/JobStatus/job-9 `:                                                                                                                                                                                 {200, `{"id":"job-9","status":"running"}`, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/JobStatus/job-0 `:                                                                                                                                                                                 {404, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/Café"},"mdKeys":null}`:                                                                                                                                            {200, `{"type":2,"path":"/Café"}`, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/Caf%C3%A9/menu.txt soup`:                                                                                                                                                      {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/PurgeRevision {"ref":{"path":"/some/versioned.txt"},"key":"v1"}`:                                                                                                                         {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/PurgeRevision {"ref":{"path":"/some/versioned.txt"},"key":"v9"}`:                                                                                                                         {404, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/PurgeRevision {"ref":{"path":"/some/versioned.txt"},"key":"current"}`:                                                                                                                    {409, `this is the current version`, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/notes.txt [X-Reva-Compress: true] lorem ipsum`:                                                                                                                                {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/InitiateUpload {"ref":{"path":"/notes.txt"},"uploadLength":11,"metadata":null,"compress":true}`:                                                                                          {200, `{"simple":"https://nc.example.com/upload/notes"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/notes.txt"},"mdKeys":null}`:                                                                                                                                       {200, `{"type":1,"path":"/notes.txt","size":11,"compressed":true}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~sharer/api/storage/GetMD {"ref":{"path":"/Shares"},"mdKeys":null}`:                                                                                                                                          {200, `{"type":2,"path":"/Shares"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~nosharer/api/storage/GetMD {"ref":{"path":"/Shares"},"mdKeys":null}`:                                                                                                                                        {404, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~nosharer/api/storage/CreateDir {"path":"/Shares"}`:                                                                                                                                                          {201, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~filesharer/api/storage/GetMD {"ref":{"path":"/Shares"},"mdKeys":null}`:                                                                                                                                      {200, `{"type":1,"path":"/Shares"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"path":"/tagged.txt"},"md":{"metadata":{"color":"red"}}}`:                                                                                                   {200, `{"type":1,"path":"/tagged.txt","etag":"etag-after","mtime":{"seconds":1700000000},"arbitrary_metadata":{"metadata":{"color":"red"}}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"path":"/some/versioned.txt"},"md":{"metadata":{"color":"red"}}}`:                                                                                           {200, ``, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/report.txt [X-Reva-Conflict-Policy: overwrite] v2`:                                                                                                                            {200, ``, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/report.txt [X-Reva-Conflict-Policy: rename] v2`:                                                                                                                               {201, `{"id":{"storage_id":"storage-1","opaque_id":"fileid-77"},"path":"/report (2).txt"}`, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/report.txt [X-Reva-Conflict-Policy: fail] v2`:                                                                                                                                 {409, `file exists`, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/report.txt v2`:                                                                                                                                                                {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetEffectivePermissionsExplained {"ref":{"path":"/projects/report/draft.txt"},"grantee":{"Id":{"UserId":{"idp":"some-idp","opaque_id":"einstein","type":1}}}}`:                           {501, `not implemented`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/projects/report/draft.txt"}`:                                                                                                                                        {200, `[{"grantee":{"type":1,"Id":{"UserId":{"idp":"some-idp","opaque_id":"einstein","type":1}}},"permissions":{"add_grant":false,"create_container":false,"delete":false,"get_path":false,"get_quota":false,"initiate_file_download":false,"initiate_file_upload":true,"list_grants":false,"list_container":false,"list_file_versions":false,"list_recycle":false,"move":false,"remove_grant":false,"purge_recycle":false,"restore_file_version":false,"restore_recycle_item":false,"stat":true,"update_grant":false}},{"grantee":{"type":1,"Id":{"UserId":{"idp":"some-idp","opaque_id":"marie","type":1}}},"permissions":{"add_grant":false,"create_container":false,"delete":true,"get_path":false,"get_quota":false,"initiate_file_download":false,"initiate_file_upload":false,"list_grants":false,"list_container":false,"list_file_versions":false,"list_recycle":false,"move":false,"remove_grant":false,"purge_recycle":false,"restore_file_version":false,"restore_recycle_item":false,"stat":false,"update_grant":false}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/projects/report"}`:                                                                                                                                                  {200, `[]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/projects"}`:                                                                                                                                                         {200, `[{"grantee":{"type":1,"Id":{"UserId":{"idp":"some-idp","opaque_id":"einstein","type":1}}},"permissions":{"add_grant":false,"create_container":false,"delete":false,"get_path":false,"get_quota":false,"initiate_file_download":true,"initiate_file_upload":false,"list_grants":false,"list_container":true,"list_file_versions":false,"list_recycle":false,"move":false,"remove_grant":false,"purge_recycle":false,"restore_file_version":false,"restore_recycle_item":false,"stat":true,"update_grant":false}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/"}`:                                                                                                                                                                 {200, `[]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Delete {"path":"/no-content"}`:                                                                                                                                                           {204, ``, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/Logs?since=2023-05-01T12%3A00%3A00Z `:                                                                                                                                                             {200, "12:00:01 INFO upload done\n12:00:02 WARN quota almost full\n", serverStateEmpty},
+	`POST /apps/sciencemesh/~checker/api/storage/GetHome `:                                                                                                                                                                               {200, `/home/checker`, serverStateEmpty},
+	`POST /apps/sciencemesh/~checker/api/storage/GetMD {"ref":{"path":"/"},"mdKeys":null}`:                                                                                                                                               {200, `{"type":2,"path":"/"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~checker/api/storage/GetQuota `:                                                                                                                                                                              {500, `quota backend down`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/inbox/report.txt"},"newRef":{"path":"/archive/report.txt"},"conflictPolicy":"rename"}`:                                                                          {200, `{"type":1,"path":"/archive/report (2).txt"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/inbox/report.txt"},"newRef":{"path":"/archive/report.txt"},"conflictPolicy":"fail"}`:                                                                            {409, `target exists`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/inbox/notes.txt"},"newRef":{"path":"/archive/notes.txt"},"conflictPolicy":"rename"}`:                                                                            {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/drafts/plan.txt"},"newRef":{"path":"/final/plan.txt"},"conflictPolicy":"overwrite"}`:                                                                            {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/drafts/plan.txt"},"newRef":{"path":"/final/plan.txt"},"conflictPolicy":"fail"}`:                                                                                 {409, `target exists`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ShareRecipients {"ref":{"path":"/report.pdf"},"query":"ein","limit":3}`:                                                                                                                  {200, `[{"type":1,"Id":{"UserId":{"idp":"cernbox.cern.ch","opaque_id":"einstein","type":1}}},{"type":2,"Id":{"GroupId":{"idp":"cernbox.cern.ch","opaque_id":"einstein-fans"}}},{"type":1,"Id":{"UserId":{"idp":"cesnet.cz","opaque_id":"einar","type":1}}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ShareRecipients {"ref":{"path":"/report.pdf"},"query":"ein","limit":2}`:                                                                                                                  {200, `[{"type":1,"Id":{"UserId":{"idp":"cernbox.cern.ch","opaque_id":"einstein","type":1}}},{"type":2,"Id":{"GroupId":{"idp":"cernbox.cern.ch","opaque_id":"einstein-fans"}}},{"type":1,"Id":{"UserId":{"idp":"cesnet.cz","opaque_id":"einar","type":1}}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/partial.txt"},"mdKeys":null}`:                                                                                                                                     {200, `{"type":1,"path":"/partial.txt","size":3,"warnings":["arbitrary metadata unavailable","checksum not computed yet"]}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/links/latest"},"mdKeys":null}`:                                                                                                                                    {200, `{"type":4,"path":"/links/latest","target":"releases/v2"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/links/releases/v2"},"mdKeys":null}`:                                                                                                                               {200, `{"type":2,"path":"/links/releases/v2","etag":"v2"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/loop/a"},"mdKeys":null}`:                                                                                                                                          {200, `{"type":4,"path":"/loop/a","target":"b"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/loop/b"},"mdKeys":null}`:                                                                                                                                          {200, `{"type":4,"path":"/loop/b","target":"/loop/a"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/links"},"mdKeys":null}`:                                                                                                                                      {200, `[{"type":4,"path":"/links/latest","target":"releases/v2"},{"type":2,"path":"/links/releases"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/meta"},"mdKeys":null}`:                                                                                                                                            {200, `{"type":2,"path":"/meta","arbitrary_metadata":{"metadata":{"color":"red"}}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/meta"},"mdKeys":null}`:                                                                                                                                       {200, `[{"type":2,"path":"/meta/sub"},{"type":1,"path":"/meta/a.txt","arbitrary_metadata":{"metadata":{"tag":"x"}}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/meta/sub"},"mdKeys":null}`:                                                                                                                                   {200, `[{"type":1,"path":"/meta/sub/b.txt","arbitrary_metadata":{"metadata":{"tag":"y","owner":"z"}}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"path":"/copy"},"md":{"metadata":{"color":"red"}}}`:                                                                                                         {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"path":"/copy/a.txt"},"md":{"metadata":{"tag":"x"}}}`:                                                                                                       {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"path":"/copy/sub/b.txt"},"md":{"metadata":{"owner":"z","tag":"y"}}}`:                                                                                       {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/status/403"},"mdKeys":null}`:                                                                                                                                      {403, `forbidden`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/status/404"},"mdKeys":null}`:                                                                                                                                      {404, `not found`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/status/409"},"mdKeys":null}`:                                                                                                                                      {409, `conflict`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/status/500"},"mdKeys":null}`:                                                                                                                                      {500, `oops`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/status/502"},"mdKeys":null}`:                                                                                                                                      {502, `bad gateway`, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/storage/Download/some/missing.txt `:                                                                                                                                                               {404, `no such file`, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/storage/Download/some/broken.txt `:                                                                                                                                                                {500, `oops`, serverStateEmpty},
+	`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/migrated.txt [X-OC-CTime: 1500000000] shiny!`:                                                                                                                                 {200, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/migrated.txt"},"mdKeys":null}`:                                                                                                                                    {200, `{"type":1,"path":"/migrated.txt","mtime":{"seconds":1700000000},"btime":{"seconds":1500000000}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/CreateDirs {"refs":[{"path":"/project/src/lib"},{"path":"/project"},{"path":"/project/src"},{"path":"/project/docs"}]}`:                                                                  {200, `[{"status":201},{"status":409,"message":"exists"},{"status":201},{"status":201}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/CreateDirs {"refs":[{"path":"/project/tmp"},{"path":"/readonly/new"}]}`:                                                                                                                  {200, `[{"status":201},{"status":403,"message":"read-only"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/empty-folder"},"mdKeys":null}`:                                                                                                                               {200, `[]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/missing-folder"},"mdKeys":null}`:                                                                                                                             {404, `no such folder`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/DeleteMulti {"refs":[{"path":"/bulk/a.txt"},{"path":"/bulk/locked.txt"},{"path":"/bulk/gone.txt"},{"path":"/bulk/readonly.txt"}]}`:                                                       {200, `[{"status":204},{"status":423,"message":"locked by einstein"},{"status":404,"message":"not found"},{"status":403,"message":"read-only share"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/MoveMulti {"moves":[{"oldRef":{"path":"/bulk/b.txt"},"newRef":{"path":"/archive/b.txt"}},{"oldRef":{"path":"/bulk/c.txt"},"newRef":{"path":"/archive/c.txt"}}],"conflictPolicy":"fail"}`: {200, `[{"status":200},{"status":409,"message":"target exists"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/partial-folder"},"mdKeys":null}`:                                                                                                                             {206, `[{"type":1,"path":"/partial-folder/a.txt","etag":"a"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/no-content-folder"},"mdKeys":null}`:                                                                                                                          {204, ``, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/storage/DownloadRevision/gone/some/file/path.txt `:                                                                                                                                                {404, `no such revision`, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/storage/DownloadRevision/broken/some/file/path.txt `:                                                                                                                                              {500, `oops`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Delete {"path":"/gone.txt"}`:                                                                                                                                                             {404, `not found`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/gone.txt"},"newRef":{"path":"/moved.txt"},"conflictPolicy":"fail"}`:                                                                                             {404, `not found`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"path":"/gone.txt"},"md":{"metadata":{"a":"b"}}}`:                                                                                                           {404, `not found`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/UnsetArbitraryMetadata {"ref":{"path":"/gone.txt"},"keys":["a"]}`:                                                                                                                        {404, `not found`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetRecycleUsage {"spaceId":"missing"}`:                                                                                                                                                   {404, `{"bytes":0,"items":0}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/Delete {"path":"/flaky"}`:                                                                                                                                                                {503, `try again later`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetShareSummary {"path":"/shared/team.txt"}`:                                                                                                                                             {404, `no route`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/shared/team.txt"}`:                                                                                                                                                  {200, `[{"grantee":{"type":1,"Id":{"UserId":{"idp":"some-idp","opaque_id":"einstein","type":1}}},"permissions":1},{"grantee":{"type":2,"Id":{"GroupId":{"idp":"some-idp","opaque_id":"physics"}}},"permissions":1},{"grantee":{"type":2,"Id":{"GroupId":{"idp":"some-idp","opaque_id":"chemistry"}}},"permissions":1}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetShareSummary {"path":"/shared/gone.txt"}`:                                                                                                                                             {404, `no route`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/shared/gone.txt"}`:                                                                                                                                                  {404, `not found`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetEffectivePermissionsExplained {"ref":{"path":"/projects"},"grantee":{"Id":{"UserId":{"idp":"some-idp","opaque_id":"einstein","type":1}}}}`:                                            {404, `no route`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD [If-Modified-Since: Mon, 02 Jan 2023 03:04:05 GMT] {"ref":{"path":"/unchanged"},"mdKeys":null}`:                                                                                    {304, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD [If-Modified-Since: Sun, 01 Jan 2023 00:00:00 GMT] {"ref":{"path":"/unchanged"},"mdKeys":null}`:                                                                                    {200, `{"type":1,"id":{"opaque_id":"fileid-/unchanged"},"etag":"deadbeef","mime_type":"text/plain","path":"/unchanged"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~looper/api/storage/ListStorageSpaces []`:                                                                                                                                                                    {200, `{"spaces":[{"id":{"opaque_id":"space-1"},"name":"One"}],"nextCursor":"page-2"}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~looper/api/storage/ListStorageSpacesPage {"filters":[],"cursor":"page-2"}`:                                                                                                                                  {200, `{"spaces":[{"id":{"opaque_id":"space-2"},"name":"Two"}],"nextCursor":"page-2"}`, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/storage/Download/some/shifted.bin `:                                                                                                                                                               {200, `0123456789abcdefghijklmnopqrstuvwxyz`, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/storage/Download/some/shifted.bin [Range: bytes=10-] `:                                                                                                                                            {206, `56789abcdefghijklmnopqrstuvwxyz`, serverStateEmpty},
+	`GET /apps/sciencemesh/~tester/api/storage/Download/some/huge-error.bin `:                                                                                                                                                            {500, `<p>Internal Server Error, with a long story about what went wrong</p>`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/DeleteMulti {"refs":[{"path":"/bulk/d.txt"},{"path":"/bulk/e.txt"}]}`:                                                                                                                    {200, `[{"status":204}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"resource_id":{"storage_id":"project-x","opaque_id":"fileid-/"},"path":"."},"mdKeys":null}`:                                                                                {403, `space is disabled: project-x`, serverStateEmpty},
+	`PATCH /apps/sciencemesh/~tester/api/storage/WriteAt/home/the/path/for/that/id.txt [Content-Range: bytes 0-4/*] patch`:                                                                                                               {201, ``, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetShareSummary {"path":"/shared/received.txt"}`:                                                                                                                                         {404, `no route`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/shared/received.txt"}`:                                                                                                                                              {200, `[{"grantee":{"type":1,"Id":{"UserId":{"idp":"0.0.0.0:19000","opaque_id":"tester","type":1}}},"permissions":1,"creator":{"idp":"0.0.0.0:19000","opaque_id":"marie","type":1}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetShareSummary {"path":"/shared/secret.txt"}`:                                                                                                                                           {404, `no route`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/shared/secret.txt"}`:                                                                                                                                                {403, `not yours`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"tree-id"},"path":"."},"mdKeys":null}`:                                                                           {200, `[{"type":1,"path":"/tree/a.txt","etag":"a1"},{"type":2,"path":"/tree/sub","etag":"sub1"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"tree-id"},"path":"./sub"},"mdKeys":null}`:                                                                       {200, `[{"type":1,"path":"/tree/sub/b.txt","etag":"b1"}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"meta-id"},"path":"."},"mdKeys":null}`:                                                                                {200, `{"type":2,"path":"/meta","arbitrary_metadata":{"metadata":{"color":"red"}}}`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"meta-id"},"path":"."},"mdKeys":null}`:                                                                           {200, `[{"type":2,"path":"/meta/sub"},{"type":1,"path":"/meta/a.txt","arbitrary_metadata":{"metadata":{"tag":"x"}}}]`, serverStateEmpty},
+	`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"meta-id"},"path":"./sub"},"mdKeys":null}`:                                                                       {200, `[{"type":1,"path":"/meta/sub/b.txt","arbitrary_metadata":{"metadata":{"tag":"y","owner":"z"}}}]`, serverStateEmpty},
 }
 
 // GetNextcloudServerMock returns a handler that pretends to be a remote Nextcloud server.
@@ -179,24 +429,41 @@ func GetNextcloudServerMock(called *[]string) http.Handler {
 		buf := new(strings.Builder)
 		_, err := io.Copy(buf, r.Body)
 		if err != nil {
-			panic("Error reading response into buffer")
+			// the client went away, e.g. because it cancelled the request
+			panic(http.ErrAbortHandler)
 		}
-		var key = fmt.Sprintf("%s %s %s", r.Method, r.URL, buf.String())
+		var target = r.URL.String()
+		for _, h := range recordedHeaders {
+			if v := r.Header.Get(h); v != "" {
+				target += fmt.Sprintf(" [%s: %s]", h, v)
+			}
+		}
+		var key = fmt.Sprintf("%s %s %s", r.Method, target, buf.String())
 		fmt.Printf("Server mock is asked for '%s'\n", key)
 		*called = append(*called, key)
 		response := responses[key]
 		if (response == Response{}) {
-			key = fmt.Sprintf("%s %s %s %s", r.Method, r.URL, buf.String(), serverState)
+			key = fmt.Sprintf("%s %s %s %s", r.Method, target, buf.String(), serverState)
 			response = responses[key]
 		}
 		if (response == Response{}) {
-			fmt.Printf("server mock cannot serve '%s %s %s %s'\n", r.Method, r.URL, buf.String(), serverState)
+			fmt.Printf("server mock cannot serve '%s %s %s %s'\n", r.Method, target, buf.String(), serverState)
 			response = Response{500, fmt.Sprintf("response not defined! %s", key), serverStateEmpty}
 		}
 		serverState = responses[key].newServerState
 		if serverState == `` {
 			serverState = serverStateError
 		}
+		for k, v := range responseHeaders[key] {
+			w.Header()[k] = v
+		}
+		if n, ok := droppedResponses[key]; ok {
+			w.Header().Set("Content-Length", fmt.Sprint(len(response.body)))
+			w.WriteHeader(response.code)
+			_, _ = w.Write([]byte(response.body[:n]))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
 		w.WriteHeader(response.code)
 		// w.Header().Set("Etag", "mocker-etag")
 		_, err = w.Write([]byte(responses[key].body))
@@ -20,17 +20,26 @@ package nextcloud_test
 
 import (
 	"context"
+	"encoding/json"
 	// "fmt".
+	"errors"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
+	grouppb "github.com/cs3org/go-cs3apis/cs3/identity/group/v1beta1"
 	userpb "github.com/cs3org/go-cs3apis/cs3/identity/user/v1beta1"
 	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
 	types "github.com/cs3org/go-cs3apis/cs3/types/v1beta1"
+	"github.com/cs3org/reva/internal/http/services/owncloud/ocs/conversions"
 	"github.com/cs3org/reva/pkg/auth/scope"
 	ctxpkg "github.com/cs3org/reva/pkg/ctx"
+	"github.com/cs3org/reva/pkg/errtypes"
 	"github.com/cs3org/reva/pkg/storage/fs/nextcloud"
 	jwt "github.com/cs3org/reva/pkg/token/manager/jwt"
 	. "github.com/onsi/ginkgo"
@@ -39,14 +48,16 @@ import (
 )
 
 func setUpNextcloudServer() (*nextcloud.StorageDriver, *[]string, func()) {
-	var conf *nextcloud.StorageDriverConfig
+	return setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{})
+}
 
+// setUpNextcloudServerWithConfig is like setUpNextcloudServer, but lets the caller
+// set driver options; EndPoint and MockHTTP are filled in here.
+func setUpNextcloudServerWithConfig(conf *nextcloud.StorageDriverConfig) (*nextcloud.StorageDriver, *[]string, func()) {
 	ncHost := os.Getenv("NEXTCLOUD")
 	if len(ncHost) == 0 {
-		conf = &nextcloud.StorageDriverConfig{
-			EndPoint: "http://mock.com/apps/sciencemesh/",
-			MockHTTP: true,
-		}
+		conf.EndPoint = "http://mock.com/apps/sciencemesh/"
+		conf.MockHTTP = true
 		nc, _ := nextcloud.NewStorageDriver(conf)
 		called := make([]string, 0)
 		h := nextcloud.GetNextcloudServerMock(&called)
@@ -54,14 +65,20 @@ func setUpNextcloudServer() (*nextcloud.StorageDriver, *[]string, func()) {
 		nc.SetHTTPClient(mock)
 		return nc, &called, teardown
 	}
-	conf = &nextcloud.StorageDriverConfig{
-		EndPoint: ncHost + "/apps/sciencemesh/",
-		MockHTTP: false,
-	}
+	conf.EndPoint = ncHost + "/apps/sciencemesh/"
+	conf.MockHTTP = false
 	nc, _ := nextcloud.NewStorageDriver(conf)
 	return nc, nil, func() {}
 }
 
+// checkCalls checks that the mock server got exactly these calls, in order.
+func checkCalls(called *[]string, expected ...string) {
+	if called == nil {
+		return
+	}
+	Expect(*called).To(Equal(expected))
+}
+
 func checkCalled(called *[]string, expected string) {
 	if called == nil {
 		return
@@ -70,6 +87,59 @@ func checkCalled(called *[]string, expected string) {
 	Expect((*called)[0]).To(Equal(expected))
 }
 
+// contextWithUser returns ctx with another user than the default tester.
+func contextWithUser(ctx context.Context, opaqueID, username string) context.Context {
+	return ctxpkg.ContextSetUser(ctx, &userpb.User{
+		Id: &userpb.UserId{
+			Idp:      "0.0.0.0:19000",
+			OpaqueId: opaqueID,
+			Type:     userpb.UserType_USER_TYPE_PRIMARY,
+		},
+		Username: username,
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// stallingReader returns its content, then blocks until it is closed, like
+// an upload from a client that stopped sending.
+type stallingReader struct {
+	content string
+	closed  chan struct{}
+}
+
+func newStallingReader(content string) *stallingReader {
+	return &stallingReader{content: content, closed: make(chan struct{})}
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	if r.content != "" {
+		n := copy(p, r.content)
+		r.content = r.content[n:]
+		return n, nil
+	}
+	<-r.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (r *stallingReader) Close() error {
+	select {
+	case <-r.closed:
+	default:
+		close(r.closed)
+	}
+	return nil
+}
+
+func checkNotCalled(called *[]string) {
+	if called == nil {
+		return
+	}
+	Expect(*called).To(BeEmpty())
+}
+
 var _ = Describe("Nextcloud", func() {
 	var (
 		ctx     context.Context
@@ -118,6 +188,39 @@ var _ = Describe("Nextcloud", func() {
 			_, err := nextcloud.New(options)
 			Expect(err).ToNot(HaveOccurred())
 		})
+
+		It("rejects a relative share_folder when enable_home is set", func() {
+			options["enable_home"] = true
+			options["share_folder"] = "MyShares"
+			_, err := nextcloud.New(options)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("accepts an absolute share_folder when enable_home is set", func() {
+			options["enable_home"] = true
+			options["share_folder"] = "/MyShares"
+			_, err := nextcloud.New(options)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("rejects unknown permissions in share_permissions_mapping", func() {
+			options["share_permissions_mapping"] = map[string]int{"deny_grant": 16, "deny_everything": 1}
+			_, err := nextcloud.New(options)
+			Expect(err).To(MatchError(ContainSubstring("unknown permission in 'share_permissions_mapping': deny_everything")))
+		})
+
+		It("accepts known permissions in share_permissions_mapping", func() {
+			options["share_permissions_mapping"] = map[string]int{"deny_grant": 16}
+			_, err := nextcloud.New(options)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("leaves the config it is given alone", func() {
+			conf := &nextcloud.StorageDriverConfig{EndPoint: "http://mock.com/apps/sciencemesh/"}
+			_, err := nextcloud.NewStorageDriver(conf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*conf).To(Equal(nextcloud.StorageDriverConfig{EndPoint: "http://mock.com/apps/sciencemesh/"}))
+		})
 	})
 
 	// 	GetHome(ctx context.Context) (string, error)
@@ -132,6 +235,19 @@ var _ = Describe("Nextcloud", func() {
 		})
 	})
 
+	Describe("GetHome with enable_home", func() {
+		It("returns the root of the storage without asking the server", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				EnableHome: true,
+			})
+			defer teardown()
+			home, err := nc.GetHome(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(home).To(Equal("/"))
+			checkNotCalled(called)
+		})
+	})
+
 	// CreateHome(ctx context.Context) error
 	Describe("CreateHome", func() {
 		It("calls the CreateHome endpoint", func() {
@@ -143,6 +259,22 @@ var _ = Describe("Nextcloud", func() {
 		})
 	})
 
+	Describe("CreateHome with enable_home", func() {
+		It("also creates the share folder", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				EnableHome:  true,
+				ShareFolder: "/MyShares",
+			})
+			defer teardown()
+			err := nc.CreateHome(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/CreateHome `,
+				`POST /apps/sciencemesh/~tester/api/storage/CreateDir {"path":"/MyShares"}`,
+			)
+		})
+	})
+
 	// CreateDir(ctx context.Context, ref *provider.Reference) error
 	Describe("CreateDir", func() {
 		It("calls the CreateDir endpoint", func() {
@@ -203,7 +335,7 @@ var _ = Describe("Nextcloud", func() {
 			}
 			err := nc.Move(ctx, ref1, ref2)
 			Expect(err).ToNot(HaveOccurred())
-			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"resource_id":{"storage_id":"storage-id-1","opaque_id":"opaque-id-1"},"path":"/some/old/path"},"newRef":{"resource_id":{"storage_id":"storage-id-2","opaque_id":"opaque-id-2"},"path":"/some/new/path"}}`)
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"resource_id":{"storage_id":"storage-id-1","opaque_id":"opaque-id-1"},"path":"/some/old/path"},"newRef":{"resource_id":{"storage_id":"storage-id-2","opaque_id":"opaque-id-2"},"path":"/some/new/path"},"conflictPolicy":"fail"}`)
 		})
 	})
 
@@ -302,6 +434,56 @@ var _ = Describe("Nextcloud", func() {
 		})
 	})
 
+	Describe("GetMD with space info", func() {
+		It("surfaces the id of the space root", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			info, err := nc.GetMD(ctx, &provider.Reference{Path: "/in/a/space"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Opaque.Map).To(HaveKey(nextcloud.SpaceRootKey))
+			Expect(info.Opaque.Map[nextcloud.SpaceRootKey].Decoder).To(Equal("json"))
+			var root provider.ResourceId
+			Expect(json.Unmarshal(info.Opaque.Map[nextcloud.SpaceRootKey].Value, &root)).To(Succeed())
+			Expect(root.StorageId).To(Equal("storage-id"))
+			Expect(root.OpaqueId).To(Equal("fileid-/"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/in/a/space"},"mdKeys":null}`)
+		})
+	})
+
+	Describe("GetMD with case_insensitive_paths", func() {
+		It("resolves a path that differs only in case", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				CaseInsensitivePaths: true,
+			})
+			defer teardown()
+			info, err := nc.GetMD(ctx, &provider.Reference{Path: "/Subdir"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Path).To(Equal("/subdir"))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/Subdir"},"mdKeys":null}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ResolveCaseInsensitive {"path":"/Subdir"}`,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/subdir"},"mdKeys":null}`,
+			)
+		})
+
+		It("still returns not found if nothing matches", func() {
+			nc, _, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				CaseInsensitivePaths: true,
+			})
+			defer teardown()
+			_, err := nc.GetMD(ctx, &provider.Reference{Path: "/Nonexistent"}, nil)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.NotFound("")))
+		})
+
+		It("does not retry when the mode is off", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.GetMD(ctx, &provider.Reference{Path: "/Subdir"}, nil)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.NotFound("")))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/Subdir"},"mdKeys":null}`)
+		})
+	})
+
 	// ListFolder(ctx context.Context, ref *provider.Reference, mdKeys []string) ([]*provider.ResourceInfo, error)
 	Describe("ListFolder", func() {
 		It("calls the ListFolder endpoint", func() {
@@ -397,6 +579,36 @@ var _ = Describe("Nextcloud", func() {
 			Expect(err).ToNot(HaveOccurred())
 			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"opaque-id"},"path":"/some"},"mdKeys":["val1","val2","val3"]}`)
 		})
+
+		It("returns an empty list for an empty folder", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			results, err := nc.ListFolder(ctx, &provider.Reference{Path: "/empty-folder"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results).ToNot(BeNil())
+			Expect(results).To(BeEmpty())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/empty-folder"},"mdKeys":null}`)
+		})
+
+		It("reads the entries of any 2xx response", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			results, err := nc.ListFolder(ctx, &provider.Reference{Path: "/partial-folder"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results).To(HaveLen(1))
+			Expect(results[0].Etag).To(Equal("a"))
+			results, err = nc.ListFolder(ctx, &provider.Reference{Path: "/no-content-folder"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results).To(BeEmpty())
+		})
+
+		It("returns NotFound for a missing folder", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.ListFolder(ctx, &provider.Reference{Path: "/missing-folder"}, nil)
+			Expect(err).To(MatchError(errtypes.NotFound("/missing-folder")))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/missing-folder"},"mdKeys":null}`)
+		})
 	})
 
 	// InitiateUpload(ctx context.Context, ref *provider.Reference, uploadLength int64, metadata map[string]string) (map[string]string, error)
@@ -448,7 +660,157 @@ var _ = Describe("Nextcloud", func() {
 			Expect(err).ToNot(HaveOccurred())
 			checkCalled(called, `PUT /apps/sciencemesh/~tester/api/storage/Upload/home/some/file/path.txt shiny!`)
 		})
+
+		It("closes the reader when it cannot send it", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			r := newStallingReader("shiny!")
+			err := nc.Upload(context.Background(), &provider.Reference{Path: "/some/file/path.txt"}, r)
+			Expect(err).To(HaveOccurred())
+			Eventually(r.closed).Should(BeClosed())
+			checkNotCalled(called)
+		})
+	})
+	Describe("UploadWithResourceID", func() {
+		It("returns the id the server assigned", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{
+				Path: "/some/file/with-id.txt",
+			}
+			id, err := nc.UploadWithResourceID(ctx, ref, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id.GetStorageId()).To(Equal("storage-id"))
+			Expect(id.GetOpaqueId()).To(Equal("fileid-/some/file/with-id.txt"))
+			checkCalled(called, `PUT /apps/sciencemesh/~tester/api/storage/Upload/home/some/file/with-id.txt shiny!`)
+		})
+	})
+
+	Describe("UploadTUS", func() {
+		var chunkerCtx context.Context
+
+		BeforeEach(func() {
+			chunkerCtx = contextWithUser(ctx, "chunker", "chunker")
+		})
+
+		It("starts from zero when the server has nothing yet", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{
+				Path: "/some/file/path.txt",
+			}
+			_, err := nc.UploadTUS(ctx, ref, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalls(called,
+				`HEAD /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/path.txt `,
+				`POST /apps/sciencemesh/~tester/api/storage/GetCapabilities `,
+				`PATCH /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/path.txt shiny!`,
+			)
+		})
+
+		It("sends chunks of the size the server advertises", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{
+				Path: "/some/file/chunked.txt",
+			}
+			id, err := nc.UploadTUS(chunkerCtx, ref, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id.GetOpaqueId()).To(Equal("fileid-/some/file/chunked.txt"))
+			checkCalls(called,
+				`HEAD /apps/sciencemesh/~chunker/api/storage/TusUpload/home/some/file/chunked.txt `,
+				`POST /apps/sciencemesh/~chunker/api/storage/GetCapabilities `,
+				`PATCH /apps/sciencemesh/~chunker/api/storage/TusUpload/home/some/file/chunked.txt shi`,
+				`PATCH /apps/sciencemesh/~chunker/api/storage/TusUpload/home/some/file/chunked.txt ny!`,
+			)
+		})
+
+		It("clamps a configured chunk size to the server maximum", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				ChunkSize: 100,
+			})
+			defer teardown()
+			ref := &provider.Reference{
+				Path: "/some/file/chunked.txt",
+			}
+			_, err := nc.UploadTUS(chunkerCtx, ref, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalls(called,
+				`HEAD /apps/sciencemesh/~chunker/api/storage/TusUpload/home/some/file/chunked.txt `,
+				`POST /apps/sciencemesh/~chunker/api/storage/GetCapabilities `,
+				`PATCH /apps/sciencemesh/~chunker/api/storage/TusUpload/home/some/file/chunked.txt shin`,
+				`PATCH /apps/sciencemesh/~chunker/api/storage/TusUpload/home/some/file/chunked.txt y!`,
+			)
+		})
+
+		It("asks for the capabilities once per user", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{
+				Path: "/some/file/chunked.txt",
+			}
+			_, err := nc.UploadTUS(chunkerCtx, ref, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = nc.UploadTUS(chunkerCtx, ref, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			if called != nil {
+				asked := 0
+				for _, c := range *called {
+					if c == `POST /apps/sciencemesh/~chunker/api/storage/GetCapabilities ` {
+						asked++
+					}
+				}
+				Expect(asked).To(Equal(1))
+			}
+		})
+
+		It("resumes from the offset reported by the server", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{
+				Path: "/some/file/resumed.txt",
+			}
+			id, err := nc.UploadTUS(ctx, ref, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id.GetOpaqueId()).To(Equal("fileid-/some/file/resumed.txt"))
+			checkCalls(called,
+				`HEAD /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/resumed.txt `,
+				`POST /apps/sciencemesh/~tester/api/storage/GetCapabilities `,
+				`PATCH /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/resumed.txt ny!`,
+			)
+		})
+	})
+
+	Describe("Upload with allowed_upload_mime_types", func() {
+		It("rejects a disallowed mime type before sending any bytes", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				AllowedUploadMimeTypes: []string{"text/plain"},
+			})
+			defer teardown()
+			ref := &provider.Reference{
+				Path: "/some/file/setup.exe",
+			}
+			_, err := nc.InitiateUpload(ctx, ref, 6, map[string]string{})
+			Expect(err).To(BeAssignableToTypeOf(errtypes.PermissionDenied("")))
+			err = nc.Upload(ctx, ref, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).To(BeAssignableToTypeOf(errtypes.PermissionDenied("")))
+			checkNotCalled(called)
+		})
+
+		It("allows a listed mime type", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				AllowedUploadMimeTypes: []string{"text/plain"},
+			})
+			defer teardown()
+			ref := &provider.Reference{
+				Path: "/some/file/path.txt",
+			}
+			err := nc.Upload(ctx, ref, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `PUT /apps/sciencemesh/~tester/api/storage/Upload/home/some/file/path.txt shiny!`)
+		})
 	})
+
 	// Download(ctx context.Context, ref *provider.Reference) (io.ReadCloser, error)
 	Describe("Download", func() {
 		It("calls the Download endpoint with GET", func() {
@@ -470,6 +832,49 @@ var _ = Describe("Nextcloud", func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(string(body)).To(Equal("the contents of the file"))
 		})
+
+		It("returns NotFound for a missing file", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			reader, err := nc.Download(ctx, &provider.Reference{Path: "some/missing.txt"})
+			Expect(reader).To(BeNil())
+			Expect(err).To(Equal(errtypes.NotFound("some/missing.txt")))
+			checkCalled(called, `GET /apps/sciencemesh/~tester/api/storage/Download/some/missing.txt `)
+		})
+
+		It("returns the error of the server", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			reader, err := nc.Download(ctx, &provider.Reference{Path: "some/broken.txt"})
+			Expect(reader).To(BeNil())
+			Expect(err).To(MatchError(errtypes.InternalError("EFSS API responded 500: oops")))
+		})
+	})
+
+	Describe("DownloadArchive", func() {
+		It("streams the archive", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			refs := []*provider.Reference{
+				{Path: "/some/dir"},
+				{Path: "/some/file.txt"},
+			}
+			reader, err := nc.DownloadArchive(ctx, refs, "zip")
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			body, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal("PK\x03\x04the zipped contents"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/DownloadArchive {"refs":[{"path":"/some/dir"},{"path":"/some/file.txt"}],"format":"zip"}`)
+		})
+
+		It("rejects an unsupported format", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.DownloadArchive(ctx, []*provider.Reference{{Path: "/some/dir"}}, "rar")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			checkNotCalled(called)
+		})
 	})
 
 	// ListRevisions(ctx context.Context, ref *provider.Reference) ([]*provider.FileVersion, error)
@@ -547,6 +952,18 @@ var _ = Describe("Nextcloud", func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(string(body)).To(Equal("the contents of that revision"))
 		})
+
+		It("returns an error instead of a reader when the server fails", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{Path: "some/file/path.txt"}
+			reader, err := nc.DownloadRevision(ctx, ref, "gone")
+			Expect(reader).To(BeNil())
+			Expect(err).To(BeAssignableToTypeOf(errtypes.NotFound("")))
+			reader, err = nc.DownloadRevision(ctx, ref, "broken")
+			Expect(reader).To(BeNil())
+			Expect(err).To(MatchError(errtypes.InternalError("EFSS API responded 500: oops")))
+		})
 	})
 
 	// RestoreRevision(ctx context.Context, ref *provider.Reference, key string) error
@@ -643,6 +1060,28 @@ var _ = Describe("Nextcloud", func() {
 		})
 	})
 
+	Describe("GetRecycleUsage", func() {
+		It("defaults to the personal space", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			bytes, items, err := nc.GetRecycleUsage(ctx, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes).To(Equal(uint64(12345)))
+			Expect(items).To(Equal(uint64(3)))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetRecycleUsage {"spaceId":"tester"}`)
+		})
+
+		It("queries the given space", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			bytes, items, err := nc.GetRecycleUsage(ctx, "project-x")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes).To(Equal(uint64(678)))
+			Expect(items).To(Equal(uint64(1)))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetRecycleUsage {"spaceId":"project-x"}`)
+		})
+	})
+
 	// GetPathByID(ctx context.Context, id *provider.ResourceId) (string, error)
 	Describe("GetPathByID", func() {
 		It("calls the GetPathByID endpoint", func() {
@@ -713,6 +1152,33 @@ var _ = Describe("Nextcloud", func() {
 		})
 	})
 
+	Describe("AddGrant with share_permissions_bitmask", func() {
+		It("sends the permissions as a Nextcloud bitmask", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				SharePermissionsBitmask: true,
+			})
+			defer teardown()
+			ref := &provider.Reference{
+				Path: "some/file/bitmask.txt",
+			}
+			grant := &provider.Grant{
+				Grantee: &provider.Grantee{
+					Id: &provider.Grantee_UserId{
+						UserId: &userpb.UserId{
+							Idp:      "0.0.0.0:19000",
+							OpaqueId: "f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c",
+							Type:     userpb.UserType_USER_TYPE_PRIMARY,
+						},
+					},
+				},
+				Permissions: conversions.NewViewerRole().CS3ResourcePermissions(),
+			}
+			err := nc.AddGrant(ctx, ref, grant)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/AddGrant {"ref":{"path":"some/file/bitmask.txt"},"g":{"grantee":{"Id":{"UserId":{"idp":"0.0.0.0:19000","opaque_id":"f7fbf8c8-139b-4376-b307-cf0a8c2d0d9c","type":1}}},"permissions":1}}`)
+		})
+	})
+
 	// DenyGrant(ctx context.Context, ref *provider.Reference, g *provider.Grantee) error
 	Describe("DenyGrant", func() {
 		It("calls the DenyGrant endpoint", func() {
@@ -867,51 +1333,154 @@ var _ = Describe("Nextcloud", func() {
 		})
 	})
 
-	// GetQuota(ctx context.Context) (uint64, uint64, error)
-	Describe("GetQuota", func() {
-		It("calls the GetQuota endpoint", func() {
+	Describe("ListGrants with a permissions bitmask", func() {
+		It("decodes the bitmask into CS3 permissions", func() {
 			nc, called, teardown := setUpNextcloudServer()
 			defer teardown()
-			maxBytes, maxFiles, err := nc.GetQuota(ctx, nil)
+			ref := &provider.Reference{
+				Path: "some/file/bitmask.txt",
+			}
+			grants, err := nc.ListGrants(ctx, ref)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(maxBytes).To(Equal(uint64(456)))
-			Expect(maxFiles).To(Equal(uint64(123)))
-			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetQuota `)
+			Expect(len(grants)).To(Equal(1))
+			Expect(grants[0].Permissions).To(Equal(conversions.NewLegacyRoleFromOCSPermissions(conversions.PermissionRead | conversions.PermissionDelete).CS3ResourcePermissions()))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"some/file/bitmask.txt"}`)
 		})
 	})
 
-	// CreateReference(ctx context.Context, path string, targetURI *url.URL) error
-	Describe("CreateReference", func() {
-		It("calls the CreateReference endpoint", func() {
-			nc, called, teardown := setUpNextcloudServer()
-			defer teardown()
-			path := "some/file/path.txt"
-			targetURI, err := url.Parse("http://bing.com/search?q=dotnet")
+	Describe("PermissionsMapper", func() {
+		It("round-trips permissions through the bitmask", func() {
+			m := nextcloud.NewPermissionsMapper(nil)
+			for _, bitmask := range []int{0, 1, 3, 4, 5, 8, 15, 17, 31} {
+				perms, err := m.FromBitmask(bitmask)
+				Expect(err).ToNot(HaveOccurred())
+				back, err := m.ToBitmask(perms)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(back).To(Equal(bitmask))
+			}
+		})
+
+		It("maps roles to the expected bitmask", func() {
+			m := nextcloud.NewPermissionsMapper(nil)
+			for perms, bitmask := range map[*provider.ResourcePermissions]int{
+				conversions.NewViewerRole().CS3ResourcePermissions():   1,
+				conversions.NewEditorRole().CS3ResourcePermissions():   15,
+				conversions.NewCoownerRole().CS3ResourcePermissions():  31,
+				conversions.NewUploaderRole().CS3ResourcePermissions(): 4,
+				{}: 0,
+			} {
+				Expect(m.ToBitmask(perms)).To(Equal(bitmask))
+			}
+		})
+
+		It("applies configured edge mappings", func() {
+			m := nextcloud.NewPermissionsMapper(map[string]int{"deny_grant": 16})
+			bitmask, err := m.ToBitmask(&provider.ResourcePermissions{DenyGrant: true})
 			Expect(err).ToNot(HaveOccurred())
-			err = nc.CreateReference(ctx, path, targetURI)
+			Expect(bitmask).To(Equal(16))
+			perms, err := m.FromBitmask(31)
 			Expect(err).ToNot(HaveOccurred())
-			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/CreateReference {"path":"some/file/path.txt","url":"http://bing.com/search?q=dotnet"}`)
+			Expect(perms.DenyGrant).To(BeTrue())
+			Expect(perms.AddGrant).To(BeTrue())
+			perms, err = m.FromBitmask(15)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(perms.DenyGrant).To(BeFalse())
 		})
 	})
 
-	// Shutdown(ctx context.Context) error
-	Describe("Shutdown", func() {
-		It("calls the Shutdown endpoint", func() {
+	Describe("ResolvePublicShare", func() {
+		It("returns the shared resource for the correct password", func() {
 			nc, called, teardown := setUpNextcloudServer()
 			defer teardown()
-			err := nc.Shutdown(ctx)
+			info, err := nc.ResolvePublicShare(ctx, "some-token", "correct-password")
 			Expect(err).ToNot(HaveOccurred())
-			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Shutdown `)
+			Expect(info.Path).To(Equal("/some/path"))
+			Expect(info.Type).To(Equal(provider.ResourceType_RESOURCE_TYPE_FILE))
+			Expect(info.Size).To(Equal(uint64(12345)))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ResolvePublicShare {"token":"some-token","password":"correct-password"}`)
 		})
-	})
 
-	// SetArbitraryMetadata(ctx context.Context, ref *provider.Reference, md *provider.ArbitraryMetadata) error
-	Describe("SetArbitraryMetadata", func() {
-		It("calls the SetArbitraryMetadata endpoint", func() {
+		It("returns permission denied for a wrong password", func() {
 			nc, called, teardown := setUpNextcloudServer()
 			defer teardown()
-			ref := &provider.Reference{
-				ResourceId: &provider.ResourceId{
+			_, err := nc.ResolvePublicShare(ctx, "some-token", "wrong-password")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.PermissionDenied("")))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ResolvePublicShare {"token":"some-token","password":"wrong-password"}`)
+		})
+	})
+
+	Describe("CanPerform", func() {
+		It("allows an action the user has the permission for", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ok, err := nc.CanPerform(ctx, &provider.Reference{Path: "/some/path"}, "move")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetPermissions {"path":"/some/path"}`)
+		})
+
+		It("denies an action the user lacks the permission for", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ok, err := nc.CanPerform(ctx, &provider.Reference{Path: "/some/path"}, "delete")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeFalse())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetPermissions {"path":"/some/path"}`)
+		})
+
+		It("rejects an unknown action", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.CanPerform(ctx, &provider.Reference{Path: "/some/path"}, "fly")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+		})
+	})
+
+	// GetQuota(ctx context.Context) (uint64, uint64, error)
+	Describe("GetQuota", func() {
+		It("calls the GetQuota endpoint", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			maxBytes, maxFiles, err := nc.GetQuota(ctx, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(maxBytes).To(Equal(uint64(456)))
+			Expect(maxFiles).To(Equal(uint64(123)))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetQuota `)
+		})
+	})
+
+	// CreateReference(ctx context.Context, path string, targetURI *url.URL) error
+	Describe("CreateReference", func() {
+		It("calls the CreateReference endpoint", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			path := "some/file/path.txt"
+			targetURI, err := url.Parse("http://bing.com/search?q=dotnet")
+			Expect(err).ToNot(HaveOccurred())
+			err = nc.CreateReference(ctx, path, targetURI)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/CreateReference {"path":"some/file/path.txt","url":"http://bing.com/search?q=dotnet"}`)
+		})
+	})
+
+	// Shutdown(ctx context.Context) error
+	Describe("Shutdown", func() {
+		It("calls the Shutdown endpoint", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.Shutdown(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Shutdown `)
+		})
+	})
+
+	// SetArbitraryMetadata(ctx context.Context, ref *provider.Reference, md *provider.ArbitraryMetadata) error
+	Describe("SetArbitraryMetadata", func() {
+		It("calls the SetArbitraryMetadata endpoint", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{
+				ResourceId: &provider.ResourceId{
 					StorageId: "storage-id",
 					OpaqueId:  "opaque-id",
 				},
@@ -1080,4 +1649,2490 @@ var _ = Describe("Nextcloud", func() {
 		})
 	})
 
+	Describe("SetSpaceEnabled", func() {
+		It("asks the server to disable a space", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.SetSpaceEnabled(ctx, "project-x", false)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/SetSpaceEnabled {"spaceId":"project-x","enabled":false}`)
+		})
+
+		It("reports operations on a disabled space as such", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{
+				ResourceId: &provider.ResourceId{
+					StorageId: "project-x",
+					OpaqueId:  "fileid-/",
+				},
+				Path: ".",
+			}
+			_, err := nc.GetMD(ctx, ref, nil)
+			Expect(err).To(Equal(nextcloud.SpaceDisabled("space is disabled: project-x")))
+			_, isPermissionDenied := err.(errtypes.IsPermissionDenied)
+			Expect(isPermissionDenied).To(BeTrue())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"resource_id":{"storage_id":"project-x","opaque_id":"fileid-/"},"path":"."},"mdKeys":null}`)
+		})
+	})
+
+	Describe("MoveAndStat", func() {
+		It("returns the metadata sent along with the move", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			info, err := nc.MoveAndStat(ctx, &provider.Reference{Path: "/some/old/path"}, &provider.Reference{Path: "/some/new/path"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Path).To(Equal("/some/new/path"))
+			Expect(info.Etag).To(Equal("deadb00f"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/some/old/path"},"newRef":{"path":"/some/new/path"},"conflictPolicy":"fail"}`)
+		})
+
+		It("falls back to GetMD if the server sends no metadata", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			info, err := nc.MoveAndStat(ctx, &provider.Reference{Path: "/some/old/file"}, &provider.Reference{Path: "/some/new/file"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Path).To(Equal("/some/new/file"))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/some/old/file"},"newRef":{"path":"/some/new/file"},"conflictPolicy":"fail"}`,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/some/new/file"},"mdKeys":null}`,
+			)
+		})
+	})
+
+	Describe("GetMDIfModifiedSince", func() {
+		It("reports not-modified on a 304", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			since := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+			_, err := nc.GetMDIfModifiedSince(ctx, &provider.Reference{Path: "/unchanged"}, nil, since)
+			Expect(err).To(Equal(nextcloud.ErrNotModified))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD [If-Modified-Since: Mon, 02 Jan 2023 03:04:05 GMT] {"ref":{"path":"/unchanged"},"mdKeys":null}`)
+		})
+
+		It("fetches the metadata when it changed since the given time", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			since := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+			info, err := nc.GetMDIfModifiedSince(ctx, &provider.Reference{Path: "/unchanged"}, nil, since)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Path).To(Equal("/unchanged"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD [If-Modified-Since: Sun, 01 Jan 2023 00:00:00 GMT] {"ref":{"path":"/unchanged"},"mdKeys":null}`)
+		})
+
+		It("fetches the metadata when no time is given", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			info, err := nc.GetMDIfModifiedSince(ctx, &provider.Reference{Path: "/subdir"}, nil, time.Time{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Path).To(Equal("/subdir"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/subdir"},"mdKeys":null}`)
+		})
+	})
+
+	Describe("WriteAt", func() {
+		It("writes a byte range in the middle of a file", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.WriteAt(ctx, &provider.Reference{Path: "/some/file/path.txt"}, 5, strings.NewReader("patch"))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `PATCH /apps/sciencemesh/~tester/api/storage/WriteAt/home/some/file/path.txt [Content-Range: bytes 5-9/*] patch`)
+		})
+
+		It("looks up a reference by id, and takes any 2xx as success", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{
+				ResourceId: &provider.ResourceId{StorageId: "storage-id", OpaqueId: "opaque-id"},
+			}
+			err := nc.WriteAt(ctx, ref, 0, strings.NewReader("patch"))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetPathByID {"storage_id":"storage-id","opaque_id":"opaque-id"}`,
+				`PATCH /apps/sciencemesh/~tester/api/storage/WriteAt/home/the/path/for/that/id.txt [Content-Range: bytes 0-4/*] patch`,
+			)
+		})
+
+		It("reports servers without range write support", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.WriteAt(ctx, &provider.Reference{Path: "/some/file/legacy.txt"}, 0, strings.NewReader("patch"))
+			Expect(err).To(BeAssignableToTypeOf(errtypes.NotSupported("")))
+			checkCalled(called, `PATCH /apps/sciencemesh/~tester/api/storage/WriteAt/home/some/file/legacy.txt [Content-Range: bytes 0-4/*] patch`)
+		})
+
+		It("does not write with a cancelled context", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			err := nc.WriteAt(cancelled, &provider.Reference{Path: "/some/file/path.txt"}, 5, strings.NewReader("patch"))
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			checkNotCalled(called)
+		})
+	})
+
+	Describe("References", func() {
+		It("round-trips the supported forms", func() {
+			for _, s := range []string{
+				"/some/path",
+				"/",
+				"storage-id!opaque-id",
+				"storage-id!opaque-id/some/relative/path",
+			} {
+				ref, err := nextcloud.ParseReference(s)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nextcloud.FormatReference(ref)).To(Equal(s))
+			}
+		})
+
+		It("parses the shorthand into a resource id and relative path", func() {
+			ref, err := nextcloud.ParseReference("storage-id!opaque-id/some/path")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ref).To(Equal(nextcloud.NewReference("storage-id", "opaque-id", "./some/path")))
+			ref, err = nextcloud.ParseReference("storage-id!opaque-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ref).To(Equal(nextcloud.NewReference("storage-id", "opaque-id", ".")))
+			Expect(nextcloud.NewReference("", "", "/abs").ResourceId).To(BeNil())
+		})
+
+		It("rejects malformed references", func() {
+			for _, s := range []string{"", "relative/path", "!opaque-id", "storage-id!", "storage-id!/path"} {
+				_, err := nextcloud.ParseReference(s)
+				Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			}
+		})
+	})
+
+	Describe("GetMD with malformed arbitrary_metadata", func() {
+		It("tolerates null", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			info, err := nc.GetMD(ctx, &provider.Reference{Path: "/null-metadata"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Path).To(Equal("/null-metadata"))
+			Expect(info.ArbitraryMetadata.Metadata).To(BeEmpty())
+		})
+
+		It("tolerates a non-object", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			info, err := nc.GetMD(ctx, &provider.Reference{Path: "/wrong-metadata"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Path).To(Equal("/wrong-metadata"))
+			Expect(info.ArbitraryMetadata.Metadata).To(BeEmpty())
+		})
+	})
+
+	Describe("PatchFile", func() {
+		patch := []byte("@@ -1 +1 @@\n-hello\n+hello world\n")
+
+		It("applies the patch and returns the new etag", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			etag, err := nc.PatchFile(ctx, &provider.Reference{Path: "/notes.txt"}, patch, "deadbeef")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(etag).To(Equal("deadb00f"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/PatchFile {"ref":{"path":"/notes.txt"},"patch":"@@ -1 +1 @@\n-hello\n+hello world\n","baseEtag":"deadbeef"}`)
+		})
+
+		It("reports a conflict for a stale etag", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.PatchFile(ctx, &provider.Reference{Path: "/notes.txt"}, patch, "stale")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.Aborted("")))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/PatchFile {"ref":{"path":"/notes.txt"},"patch":"@@ -1 +1 @@\n-hello\n+hello world\n","baseEtag":"stale"}`)
+		})
+	})
+
+	Describe("ListFolder with max_list_entries", func() {
+		It("rejects a listing larger than the limit", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				MaxListEntries: 10,
+			})
+			defer teardown()
+			_, err := nc.ListFolder(ctx, &provider.Reference{Path: "/big"}, nil)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			Expect(err.Error()).To(ContainSubstring("use paging"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/big"},"mdKeys":null}`)
+		})
+
+		It("returns everything by default", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			infos, err := nc.ListFolder(ctx, &provider.Reference{Path: "/big"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(infos).To(HaveLen(20))
+		})
+	})
+
+	// GetRecycleItem(ctx context.Context, key, path string) (*provider.RecycleItem, error)
+	Describe("GetRecycleItem", func() {
+		It("calls the GetRecycleItem endpoint", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			item, err := nc.GetRecycleItem(ctx, "some-deleted-version", "/")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(item.Key).To(Equal("some-deleted-version"))
+			Expect(item.Ref.Path).To(Equal("/subdir"))
+			Expect(item.Size).To(Equal(uint64(12345)))
+			Expect(item.DeletionTime.Seconds).To(Equal(uint64(1234567890)))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetRecycleItem {"key":"some-deleted-version","path":"/"}`)
+		})
+
+		It("maps a missing item to not found", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.GetRecycleItem(ctx, "no-such-key", "/")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.NotFound("")))
+		})
+	})
+
+	Describe("ListGrantsWithRoles", func() {
+		It("names a read-only grant Viewer", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			grants, err := nc.ListGrantsWithRoles(ctx, &provider.Reference{Path: "some/file/readonly.txt"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(grants).To(HaveLen(1))
+			Expect(grants[0].Role).To(Equal("Viewer"))
+			Expect(grants[0].Permissions).To(Equal(conversions.NewViewerRole().CS3ResourcePermissions()))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"some/file/readonly.txt"}`)
+		})
+
+		It("falls back to Custom", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			grants, err := nc.ListGrantsWithRoles(ctx, &provider.Reference{Path: "some/file/bitmask.txt"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(grants[0].Role).To(Equal(nextcloud.CustomRole))
+		})
+	})
+
+	Describe("SetArbitraryMetadataMulti", func() {
+		It("reports the resources it failed for", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			refs := []*provider.Reference{
+				{Path: "/a.txt"},
+				{Path: "/b.txt"},
+				{Path: "/c.txt"},
+			}
+			md := &provider.ArbitraryMetadata{
+				Metadata: map[string]string{
+					"tag": "urgent",
+				},
+			}
+			err := nc.SetArbitraryMetadataMulti(ctx, refs, md)
+			Expect(err).To(HaveOccurred())
+			errs, ok := err.(nextcloud.MultiError)
+			Expect(ok).To(BeTrue())
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0]).To(Equal(errtypes.NotFound("/b.txt")))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadataMulti {"refs":[{"path":"/a.txt"},{"path":"/b.txt"},{"path":"/c.txt"}],"md":{"metadata":{"tag":"urgent"}}}`)
+		})
+	})
+
+	Describe("retry budget", func() {
+		It("stops retrying once the budget is exhausted", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				MaxRetries:      3,
+				RetryBackoffMs:  1,
+				RetryBudgetSize: 2,
+				RetryBudgetRate: 0.001,
+			})
+			defer teardown()
+			ref := &provider.Reference{Path: "/flaky"}
+			_, err := nc.GetMD(ctx, ref, nil)
+			Expect(err).To(HaveOccurred())
+			_, err = nc.GetMD(ctx, ref, nil)
+			Expect(err).To(HaveOccurred())
+			if called != nil {
+				// the first call uses up the budget with two retries, the second does not retry
+				Expect(*called).To(HaveLen(4))
+			}
+		})
+
+		It("retries up to max_retries without a budget", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				MaxRetries:     3,
+				RetryBackoffMs: 1,
+			})
+			defer teardown()
+			_, err := nc.GetMD(ctx, &provider.Reference{Path: "/flaky"}, nil)
+			Expect(err).To(HaveOccurred())
+			if called != nil {
+				Expect(*called).To(HaveLen(4))
+			}
+		})
+
+		It("backs off between retries", func() {
+			nc, _, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				MaxRetries:     2,
+				RetryBackoffMs: 40,
+			})
+			defer teardown()
+			start := time.Now()
+			_, err := nc.GetMD(ctx, &provider.Reference{Path: "/flaky"}, nil)
+			Expect(err).To(HaveOccurred())
+			// at least half of 40ms, then half of 80ms
+			Expect(time.Since(start)).To(BeNumerically(">=", 60*time.Millisecond))
+		})
+
+		It("does not retry a call that changes something once it reached the server", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				MaxRetries:     3,
+				RetryBackoffMs: 1,
+			})
+			defer teardown()
+			err := nc.Delete(ctx, &provider.Reference{Path: "/flaky"})
+			Expect(err).To(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Delete {"path":"/flaky"}`)
+			Expect(nc.Stats().Retries).To(BeZero())
+		})
+	})
+
+	Describe("RestoreRecycleItemToOriginal", func() {
+		It("returns the original location tracked by the server", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref, err := nc.RestoreRecycleItemToOriginal(ctx, "asdf")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ref.Path).To(Equal("/some/original/file.txt"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/RestoreRecycleItem {"key":"asdf"}`)
+		})
+	})
+
+	Describe("PurgeUserData", func() {
+		userID := &userpb.UserId{
+			Idp:      "some-idp",
+			OpaqueId: "sharer",
+			Type:     userpb.UserType_USER_TYPE_PRIMARY,
+		}
+
+		It("refuses to purge a user with active shares", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.PurgeUserData(ctx, userID, false)
+			Expect(err).To(BeAssignableToTypeOf(nextcloud.ActiveShares("")))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/PurgeUserData {"userId":{"idp":"some-idp","opaque_id":"sharer","type":1},"force":false}`)
+		})
+
+		It("purges anyway when forced", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.PurgeUserData(ctx, userID, true)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/PurgeUserData {"userId":{"idp":"some-idp","opaque_id":"sharer","type":1},"force":true}`)
+		})
+	})
+
+	Describe("Accept-Language", func() {
+		It("sends the configured language", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				Language: "de",
+			})
+			defer teardown()
+			_, err := nc.GetMD(ctx, &provider.Reference{Path: "/gone"}, nil)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.NotFound("")))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD [Accept-Language: de] {"ref":{"path":"/gone"},"mdKeys":null}`)
+		})
+
+		It("prefers the language from the context", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				Language: "de",
+			})
+			defer teardown()
+			_, err := nc.GetMD(nextcloud.ContextSetLanguage(ctx, "fr"), &provider.Reference{Path: "/gone"}, nil)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.NotFound("")))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD [Accept-Language: fr] {"ref":{"path":"/gone"},"mdKeys":null}`)
+		})
+	})
+
+	Describe("GetVersionsSize", func() {
+		It("sums up the sizes of the versions", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			size, err := nc.GetVersionsSize(ctx, &provider.Reference{Path: "/some/versioned.txt"}, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(Equal(uint64(600)))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListRevisions {"path":"/some/versioned.txt"}`)
+		})
+
+		It("adds the current version if asked to", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			size, err := nc.GetVersionsSize(ctx, &provider.Reference{Path: "/some/versioned.txt"}, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(Equal(uint64(650)))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/ListRevisions {"path":"/some/versioned.txt"}`,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/some/versioned.txt"},"mdKeys":null}`,
+			)
+		})
+	})
+
+	Describe("permanent redirects", func() {
+		It("moves the endpoint for later calls", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{Path: "/moved"}
+			md, err := nc.GetMD(ctx, ref, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(md.Path).To(Equal("/moved"))
+			_, err = nc.ListFolder(ctx, ref, nil)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/moved"},"mdKeys":null}`,
+				`POST /apps/sciencemesh-moved/~tester/api/storage/GetMD {"ref":{"path":"/moved"},"mdKeys":null}`,
+				`POST /apps/sciencemesh-moved/~tester/api/storage/ListFolder {"ref":{"path":"/moved"},"mdKeys":null}`,
+			)
+		})
+	})
+
+	Describe("ListStaleUploads", func() {
+		It("decodes the stale sessions", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			sessions, err := nc.ListStaleUploads(ctx, 24*time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sessions).To(Equal([]nextcloud.UploadSession{
+				{ID: "upload-1", Size: 1024, Age: 25 * time.Hour},
+				{ID: "upload-2", Size: 0, Age: 48 * time.Hour},
+			}))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListStaleUploads {"olderThan":86400}`)
+		})
+	})
+
+	Describe("AbortUpload", func() {
+		It("calls the AbortUpload endpoint", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.AbortUpload(ctx, "upload-1")
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/AbortUpload {"id":"upload-1"}`)
+		})
+	})
+
+	Describe("dial_timeout", func() {
+		It("gives up connecting to an unreachable server", func() {
+			addr, closeListener, err := listenNeverAccepting()
+			if err != nil {
+				Skip(err.Error())
+			}
+			defer closeListener()
+			nc, err := nextcloud.NewStorageDriver(&nextcloud.StorageDriverConfig{
+				EndPoint:    "http://" + addr + "/apps/sciencemesh/",
+				DialTimeout: 1,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			start := time.Now()
+			_, err = nc.GetMD(ctx, &provider.Reference{Path: "/some/path"}, nil)
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			var netErr net.Error
+			Expect(errors.As(err, &netErr)).To(BeTrue())
+			Expect(netErr.Timeout()).To(BeTrue())
+		})
+	})
+
+	Describe("Move into itself", func() {
+		It("rejects moving a folder into its own subfolder", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.Move(ctx, &provider.Reference{Path: "/a"}, &provider.Reference{Path: "/a/b"})
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			checkNotCalled(called)
+		})
+
+		It("rejects moving a folder onto itself", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.Move(ctx, &provider.Reference{Path: "/a"}, &provider.Reference{Path: "/a/"})
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			checkNotCalled(called)
+		})
+
+		It("allows moving to a sibling", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.Move(ctx, &provider.Reference{Path: "/a/b"}, &provider.Reference{Path: "/a/c"})
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/a/b"},"newRef":{"path":"/a/c"},"conflictPolicy":"fail"}`)
+		})
+	})
+
+	Describe("ListRecycle retention expiry", func() {
+		It("decodes purge_after, defaulting to the zero time", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			items, err := nc.ListRecycle(ctx, "/", "", "/expiring")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(items).To(HaveLen(2))
+			Expect(string(items[0].Opaque.Map[nextcloud.PurgeAfterKey].Value)).To(Equal("1237159890"))
+			Expect(nextcloud.PurgeAfter(items[0])).To(Equal(time.Unix(1237159890, 0)))
+			Expect(nextcloud.PurgeAfter(items[1]).IsZero()).To(BeTrue())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListRecycle {"key":"","path":"/expiring"}`)
+		})
+	})
+
+	Describe("TransferOwnership", func() {
+		newOwner := &userpb.UserId{
+			Idp:      "some-idp",
+			OpaqueId: "successor",
+			Type:     userpb.UserType_USER_TYPE_PRIMARY,
+		}
+
+		It("makes GetMD report the new owner", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{Path: "/handover.txt"}
+			err := nc.TransferOwnership(ctx, ref, newOwner)
+			Expect(err).ToNot(HaveOccurred())
+			md, err := nc.GetMD(ctx, ref, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(md.Owner.OpaqueId).To(Equal("successor"))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/TransferOwnership {"ref":{"path":"/handover.txt"},"newOwner":{"idp":"some-idp","opaque_id":"successor","type":1}}`,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/handover.txt"},"mdKeys":null}`,
+			)
+		})
+
+		It("maps a name clash to already exists", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.TransferOwnership(ctx, &provider.Reference{Path: "/clash.txt"}, newOwner)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.AlreadyExists("")))
+		})
+	})
+
+	Describe("trailing slashes", func() {
+		It("treats /dir/ like /dir", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			withSlash, err := nc.GetMD(ctx, &provider.Reference{Path: "/dir/"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			withoutSlash, err := nc.GetMD(ctx, &provider.Reference{Path: "/dir"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(withSlash).To(Equal(withoutSlash))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/dir"},"mdKeys":null}`,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/dir"},"mdKeys":null}`,
+			)
+		})
+
+		It("drops the slash in streaming requests too", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			refs := []*provider.Reference{{Path: "/some/dir/"}, {Path: "/some/file.txt"}}
+			reader, err := nc.DownloadArchive(ctx, refs, "zip")
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			reader, err = nc.Download(ctx, &provider.Reference{Path: "some/file/path.txt/"})
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/DownloadArchive {"refs":[{"path":"/some/dir"},{"path":"/some/file.txt"}],"format":"zip"}`,
+				`GET /apps/sciencemesh/~tester/api/storage/Download/some/file/path.txt `,
+			)
+		})
+
+		It("keeps the slash if configured to", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				KeepTrailingSlash: true,
+			})
+			defer teardown()
+			_, _ = nc.GetMD(ctx, &provider.Reference{Path: "/dir/"}, nil)
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/dir/"},"mdKeys":null}`)
+		})
+	})
+
+	Describe("user_path_template", func() {
+		var marieCtx context.Context
+		BeforeEach(func() {
+			marieCtx = contextWithUser(ctx, "4c510ada", "marie")
+		})
+
+		It("renders a username template", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				UserPathTemplate: "/remote.php/dav/files/{{.Username}}",
+			})
+			defer teardown()
+			_, err := nc.GetMD(marieCtx, &provider.Reference{Path: "/templated"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/remote.php/dav/files/marie/api/storage/GetMD {"ref":{"path":"/templated"},"mdKeys":null}`)
+		})
+
+		It("renders an id template", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				UserPathTemplate: "users/{{.Id.OpaqueId}}",
+			})
+			defer teardown()
+			_, err := nc.GetMD(marieCtx, &provider.Reference{Path: "/templated"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/users/4c510ada/api/storage/GetMD {"ref":{"path":"/templated"},"mdKeys":null}`)
+		})
+
+		It("rejects a broken template", func() {
+			_, err := nextcloud.NewStorageDriver(&nextcloud.StorageDriverConfig{
+				EndPoint:         "http://mock.com/apps/sciencemesh/",
+				UserPathTemplate: "~{{.Username",
+			})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Copy", func() {
+		It("reports when the server made a reflink", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			reflinked, err := nc.Copy(ctx, &provider.Reference{Path: "/big.iso"}, &provider.Reference{Path: "/big-copy.iso"}, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reflinked).To(BeTrue())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Copy {"srcRef":{"path":"/big.iso"},"dstRef":{"path":"/big-copy.iso"},"reflink":true}`)
+		})
+
+		It("falls back to a normal copy", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			reflinked, err := nc.Copy(ctx, &provider.Reference{Path: "/old.iso"}, &provider.Reference{Path: "/old-copy.iso"}, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reflinked).To(BeFalse())
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/Copy {"srcRef":{"path":"/old.iso"},"dstRef":{"path":"/old-copy.iso"},"reflink":true}`,
+				`POST /apps/sciencemesh/~tester/api/storage/Copy {"srcRef":{"path":"/old.iso"},"dstRef":{"path":"/old-copy.iso"}}`,
+			)
+		})
+
+		It("rejects copying a folder into itself", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.Copy(ctx, &provider.Reference{Path: "/a"}, &provider.Reference{Path: "/a/b"}, false)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			checkNotCalled(called)
+		})
+	})
+
+	Describe("GetShareSummary", func() {
+		It("decodes a summary of mixed share types", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			summary, err := nc.GetShareSummary(ctx, &provider.Reference{Path: "/shared/report.pdf"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*summary).To(Equal(nextcloud.ShareSummary{
+				UserShares:  2,
+				GroupShares: 1,
+				LinkShares:  3,
+				SharedByMe:  true,
+			}))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetShareSummary {"path":"/shared/report.pdf"}`)
+		})
+
+		It("derives the summary from ListGrants on older servers", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			summary, err := nc.GetShareSummary(ctx, &provider.Reference{Path: "some/file/readonly.txt"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*summary).To(Equal(nextcloud.ShareSummary{
+				UserShares: 1,
+				SharedByMe: true,
+			}))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetShareSummary {"path":"some/file/readonly.txt"}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"some/file/readonly.txt"}`,
+			)
+		})
+
+		It("counts user and group grants apart when the endpoint is missing", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			summary, err := nc.GetShareSummary(ctx, &provider.Reference{Path: "/shared/team.txt"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*summary).To(Equal(nextcloud.ShareSummary{
+				UserShares:  1,
+				GroupShares: 2,
+				SharedByMe:  true,
+			}))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetShareSummary {"path":"/shared/team.txt"}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/shared/team.txt"}`,
+			)
+		})
+
+		It("tells a received share from one the user made when the endpoint is missing", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			summary, err := nc.GetShareSummary(ctx, &provider.Reference{Path: "/shared/received.txt"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*summary).To(Equal(nextcloud.ShareSummary{
+				UserShares:   1,
+				SharedWithMe: true,
+			}))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetShareSummary {"path":"/shared/received.txt"}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/shared/received.txt"}`,
+			)
+		})
+
+		It("reports a missing resource behind a 404", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.GetShareSummary(ctx, &provider.Reference{Path: "/shared/gone.txt"})
+			Expect(err).To(Equal(errtypes.NotFound("/shared/gone.txt")))
+		})
+
+		It("passes on other ListGrants errors as they are", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.GetShareSummary(ctx, &provider.Reference{Path: "/shared/secret.txt"})
+			Expect(err).To(Equal(errtypes.PermissionDenied("not yours")))
+		})
+	})
+
+	Describe("Stats", func() {
+		It("counts requests, errors and bytes", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			Expect(nc.Stats()).To(Equal(nextcloud.DriverStats{}))
+
+			err := nc.Upload(ctx, &provider.Reference{Path: "/some/file/path.txt"}, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = nc.GetMD(ctx, &provider.Reference{Path: "/flaky"}, nil)
+			Expect(err).To(HaveOccurred())
+
+			stats := nc.Stats()
+			Expect(stats.Requests).To(Equal(int64(2)))
+			Expect(stats.Errors).To(Equal(int64(1)))
+			Expect(stats.Retries).To(Equal(int64(0)))
+			Expect(stats.BytesUploaded).To(BeNumerically(">=", len("shiny!")))
+			Expect(stats.InFlight).To(Equal(int64(0)))
+		})
+
+		It("counts retries", func() {
+			nc, _, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				MaxRetries:     2,
+				RetryBackoffMs: 1,
+			})
+			defer teardown()
+			_, err := nc.GetMD(ctx, &provider.Reference{Path: "/flaky"}, nil)
+			Expect(err).To(HaveOccurred())
+			stats := nc.Stats()
+			Expect(stats.Requests).To(Equal(int64(3)))
+			Expect(stats.Retries).To(Equal(int64(2)))
+			Expect(stats.Errors).To(Equal(int64(3)))
+			Expect(stats.BytesDownloaded).To(Equal(int64(3 * len("try again later"))))
+		})
+	})
+
+	Describe("ConnectionStats", func() {
+		It("tells whether connections are reused over HTTP/2", func() {
+			called := []string{}
+			server := httptest.NewUnstartedServer(nextcloud.GetNextcloudServerMock(&called))
+			server.EnableHTTP2 = true
+			server.StartTLS()
+			defer server.Close()
+			nc, err := nextcloud.NewStorageDriver(&nextcloud.StorageDriverConfig{
+				EndPoint: server.URL + "/apps/sciencemesh/",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			nc.SetHTTPClient(server.Client())
+			Expect(nc.ConnectionStats()).To(Equal(nextcloud.ConnectionStats{}))
+
+			for i := 0; i < 3; i++ {
+				_, err = nc.GetHome(ctx)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			stats := nc.ConnectionStats()
+			Expect(stats.HTTP2).To(BeTrue())
+			Expect(stats.NewConns).To(Equal(int64(1)))
+			Expect(stats.ReusedConns).To(Equal(int64(2)))
+			Expect(stats.ReuseRatio()).To(BeNumerically("~", 2.0/3))
+		})
+
+		It("tells when HTTP/1.1 is used", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.GetHome(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nc.ConnectionStats().HTTP2).To(BeFalse())
+			Expect(nc.ConnectionStats().NewConns + nc.ConnectionStats().ReusedConns).To(Equal(int64(1)))
+		})
+	})
+
+	Describe("WithinHome", func() {
+		var homerCtx context.Context
+		BeforeEach(func() {
+			homerCtx = contextWithUser(ctx, "homer", "homer")
+		})
+
+		It("checks paths against the home", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+
+			within, err := nc.WithinHome(homerCtx, &provider.Reference{Path: "/home/homer/docs/a.txt"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(within).To(BeTrue())
+
+			within, err = nc.WithinHome(homerCtx, &provider.Reference{Path: "/home/homer/../marge/a.txt"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(within).To(BeFalse())
+
+			within, err = nc.WithinHome(homerCtx, &provider.Reference{Path: "/home/homersimpson"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(within).To(BeFalse())
+
+			// without enable_home, the share folder is not part of the home
+			within, err = nc.WithinHome(homerCtx, &provider.Reference{Path: "/Shares/from-marge/b.txt"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(within).To(BeFalse())
+
+			// the home is only asked for once
+			checkCalled(called, `POST /apps/sciencemesh/~homer/api/storage/GetHome `)
+		})
+
+		It("takes the whole storage as the home with enable_home", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				EnableHome: true,
+			})
+			defer teardown()
+			within, err := nc.WithinHome(homerCtx, &provider.Reference{Path: "/Shares/from-marge/b.txt"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(within).To(BeTrue())
+			checkNotCalled(called)
+		})
+	})
+
+	Describe("ListFolderPage", func() {
+		It("resumes a listing that failed midway", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{Path: "/paged"}
+			paths := []string{}
+			cursor := ""
+			failures := 0
+			for {
+				infos, next, err := nc.ListFolderPage(ctx, ref, nil, 2, cursor)
+				if err != nil {
+					failures++
+					Expect(failures).To(BeNumerically("<", 3))
+					continue // retry with the same cursor
+				}
+				for _, info := range infos {
+					paths = append(paths, info.Path)
+				}
+				if next == "" {
+					break
+				}
+				cursor = next
+			}
+			Expect(failures).To(Equal(1))
+			Expect(paths).To(Equal([]string{"/paged/a", "/paged/b", "/paged/c", "/paged/d", "/paged/e"}))
+		})
+
+		It("rejects a malformed cursor", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, _, err := nc.ListFolderPage(ctx, &provider.Reference{Path: "/paged"}, nil, 2, "not a cursor")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			checkNotCalled(called)
+		})
+	})
+
+	Describe("GetRecursiveEtag", func() {
+		It("changes when a descendant changes", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{Path: "/tree"}
+
+			err := nc.Upload(ctx, &provider.Reference{Path: "/tree/sub/b.txt"}, io.NopCloser(strings.NewReader("v1")))
+			Expect(err).ToNot(HaveOccurred())
+			before, err := nc.GetRecursiveEtag(ctx, ref)
+			Expect(err).ToNot(HaveOccurred())
+			again, err := nc.GetRecursiveEtag(ctx, ref)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(again).To(Equal(before))
+
+			err = nc.Upload(ctx, &provider.Reference{Path: "/tree/sub/b.txt"}, io.NopCloser(strings.NewReader("v2")))
+			Expect(err).ToNot(HaveOccurred())
+			after, err := nc.GetRecursiveEtag(ctx, ref)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(after).ToNot(Equal(before))
+		})
+
+		It("walks a folder given by id relative to that id", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.GetRecursiveEtag(ctx, nextcloud.NewReference("storage-id", "tree-id", "."))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"tree-id"},"path":"."},"mdKeys":null}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"tree-id"},"path":"./sub"},"mdKeys":null}`,
+			)
+		})
+	})
+
+	Describe("Download with download_retries", func() {
+		It("resumes after the connection drops", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				DownloadRetries: 1,
+			})
+			defer teardown()
+			reader, err := nc.Download(ctx, &provider.Reference{Path: "some/big.bin"})
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			content, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(content)).To(Equal("0123456789abcdefghijklmnopqrstuvwxyz"))
+			checkCalls(called,
+				`GET /apps/sciencemesh/~tester/api/storage/Download/some/big.bin `,
+				`GET /apps/sciencemesh/~tester/api/storage/Download/some/big.bin [Range: bytes=10-] `,
+			)
+		})
+
+		It("fails when the server resumes at another byte", func() {
+			nc, _, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				DownloadRetries: 1,
+			})
+			defer teardown()
+			reader, err := nc.Download(ctx, &provider.Reference{Path: "some/shifted.bin"})
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			_, err = io.ReadAll(reader)
+			Expect(err).To(MatchError(ContainSubstring(`got Content-Range "bytes 5-35/36"`)))
+		})
+
+		It("reads no more of an error than it keeps", func() {
+			nc, _, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				MaxErrorBodyLog: 10,
+			})
+			defer teardown()
+			_, err := nc.Download(ctx, &provider.Reference{Path: "some/huge-error.bin"})
+			Expect(err).To(MatchError("internal error: EFSS API responded 500: <p>Interna…"))
+		})
+
+		It("fails without retries", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			reader, err := nc.Download(ctx, &provider.Reference{Path: "some/big.bin"})
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			_, err = io.ReadAll(reader)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("SetRoundTripper", func() {
+		It("passes every request through the middleware", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				SharedSecret: "shared-secret",
+			})
+			defer teardown()
+			recorded := []string{}
+			nc.SetRoundTripper(func(next http.RoundTripper) http.RoundTripper {
+				return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					recorded = append(recorded, req.Method+" "+req.URL.Path+" "+req.Header.Get("X-Reva-Secret"))
+					return next.RoundTrip(req)
+				})
+			})
+			_, err := nc.GetHome(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			err = nc.Upload(ctx, &provider.Reference{Path: "/some/file/path.txt"}, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			if called != nil {
+				Expect(recorded).To(Equal([]string{
+					"POST /apps/sciencemesh/~tester/api/storage/GetHome shared-secret",
+					"PUT /apps/sciencemesh/~tester/api/storage/Upload/home/some/file/path.txt shared-secret",
+				}))
+				Expect(*called).To(HaveLen(2))
+			}
+		})
+	})
+
+	Describe("CreateHome with a quota", func() {
+		It("gives the home that quota", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			quoteeCtx := contextWithUser(ctx, "quotee", "quotee")
+			err := nc.CreateHomeWithQuota(quoteeCtx, 1000000)
+			Expect(err).ToNot(HaveOccurred())
+			total, used, err := nc.GetQuota(quoteeCtx, &provider.Reference{Path: "/"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(total).To(Equal(uint64(1000000)))
+			Expect(used).To(Equal(uint64(0)))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~quotee/api/storage/CreateHome {"quota":1000000}`,
+				`POST /apps/sciencemesh/~quotee/api/storage/GetQuota `,
+			)
+		})
+
+		It("uses home_quota in CreateHome", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				HomeQuota: 1000000,
+			})
+			defer teardown()
+			err := nc.CreateHome(contextWithUser(ctx, "quotee", "quotee"))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~quotee/api/storage/CreateHome {"quota":1000000}`)
+		})
+	})
+
+	Describe("SupportedUploadProtocols", func() {
+		It("returns the protocols in the server's order of preference", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			protocolsCtx := contextWithUser(ctx, "protocols", "protocols")
+			protocols, err := nc.SupportedUploadProtocols(protocolsCtx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(protocols).To(Equal([]string{"tus", "simple"}))
+			protocols, err = nc.SupportedUploadProtocols(protocolsCtx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(protocols).To(Equal([]string{"tus", "simple"}))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~protocols/api/storage/GetCapabilities `,
+			)
+		})
+
+		It("defaults to simple uploads", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			protocols, err := nc.SupportedUploadProtocols(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(protocols).To(Equal([]string{"simple"}))
+		})
+	})
+
+	Describe("JSON responses", func() {
+		It("fails on an empty body", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, _, err := nc.GetRecycleUsage(ctx, "empty")
+			Expect(err).To(MatchError(errtypes.InternalError("nextcloud storage driver: empty GetRecycleUsage response")))
+		})
+
+		It("fails with NotFound on a 404, even with a JSON body", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, _, err := nc.GetRecycleUsage(ctx, "missing")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.NotFound("")))
+		})
+
+		It("fails on a body it cannot decode", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, _, err := nc.GetRecycleUsage(ctx, "garbled")
+			Expect(err).To(MatchError(ContainSubstring("could not decode GetRecycleUsage response")))
+		})
+
+		It("fails on an error response without decoding it", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, _, err := nc.GetRecycleUsage(ctx, "broken")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).ToNot(ContainSubstring("could not decode"))
+		})
+	})
+
+	Describe("CompareAndSetMetadata", func() {
+		It("sets the value if it did not change", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.CompareAndSetMetadata(ctx, &provider.Reference{Path: "/counter"}, "count", "1", "2")
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/CompareAndSetMetadata {"ref":{"path":"/counter"},"key":"count","expectedOld":"1","newVal":"2"}`)
+		})
+
+		It("reports a conflict if the value changed", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.CompareAndSetMetadata(ctx, &provider.Reference{Path: "/counter"}, "count", "0", "1")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.Aborted("")))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/CompareAndSetMetadata {"ref":{"path":"/counter"},"key":"count","expectedOld":"0","newVal":"1"}`)
+		})
+	})
+
+	Describe("ContextSetUnmodifiedSince", func() {
+		It("applies the write if the resource was not modified", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			since, err := http.ParseTime("Wed, 21 Oct 2015 07:28:00 GMT")
+			Expect(err).ToNot(HaveOccurred())
+			err = nc.Delete(nextcloud.ContextSetUnmodifiedSince(ctx, since), &provider.Reference{Path: "/guarded"})
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Delete [If-Unmodified-Since: Wed, 21 Oct 2015 07:28:00 GMT] {"path":"/guarded"}`)
+		})
+
+		It("reports a failed precondition if the resource was modified", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			since := time.Date(2015, time.October, 20, 9, 28, 0, 0, time.FixedZone("CEST", 2*60*60))
+			err := nc.Delete(nextcloud.ContextSetUnmodifiedSince(ctx, since), &provider.Reference{Path: "/guarded"})
+			Expect(err).To(BeAssignableToTypeOf(errtypes.Aborted("")))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Delete [If-Unmodified-Since: Tue, 20 Oct 2015 07:28:00 GMT] {"path":"/guarded"}`)
+		})
+	})
+
+	Describe("ListReferences", func() {
+		It("returns only the references in a folder", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			refs, err := nc.ListReferences(ctx, &provider.Reference{Path: "/mounts"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(refs)).To(Equal(2))
+			Expect(refs[0].Path).To(Equal("/mounts/cernbox"))
+			target, err := nextcloud.ReferenceTarget(refs[0])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target.Scheme).To(Equal("cs3"))
+			Expect(refs[1].Path).To(Equal("/mounts/surf"))
+			target, err = nextcloud.ReferenceTarget(refs[1])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target.Host).To(Equal("surf.nl"))
+			Expect(target.Path).To(Equal("/remote.php/dav/files/einstein"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/mounts"},"mdKeys":null}`)
+		})
+	})
+
+	Describe("cancelling an upload", func() {
+		It("aborts a simple upload", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			r := newStallingReader("shi")
+			defer r.Close()
+			cancelCtx, cancel := context.WithCancel(ctx)
+			time.AfterFunc(100*time.Millisecond, cancel)
+			start := time.Now()
+			err := nc.Upload(cancelCtx, &provider.Reference{Path: "/some/file/cancelled.txt"}, r)
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		})
+
+		It("aborts a TUS upload and throws away what the server got", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			r := newStallingReader("shi")
+			defer r.Close()
+			cancelCtx, cancel := context.WithCancel(ctx)
+			time.AfterFunc(100*time.Millisecond, cancel)
+			start := time.Now()
+			_, err := nc.UploadTUS(cancelCtx, &provider.Reference{Path: "/some/file/cancelled.txt"}, r)
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			if called != nil {
+				Expect(*called).To(ContainElement(`DELETE /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/cancelled.txt `))
+			}
+		})
+	})
+
+	Describe("GetSystemStats", func() {
+		It("returns the usage of the whole server to an admin", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				AdminUsers: []string{"tester", "homer"},
+			})
+			defer teardown()
+			stats, err := nc.GetSystemStats(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*stats).To(Equal(nextcloud.SystemStats{
+				TotalBytes: 1000000000,
+				UsedBytes:  250000000,
+				FreeBytes:  750000000,
+				Users:      42,
+			}))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetSystemStats `)
+		})
+
+		It("refuses users who are not admins", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.GetSystemStats(ctx)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.PermissionDenied("")))
+			checkNotCalled(called)
+		})
+
+		It("reports it when the server refuses", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				AdminUsers: []string{"tester", "homer"},
+			})
+			defer teardown()
+			_, err := nc.GetSystemStats(contextWithUser(ctx, "homer", "homer"))
+			Expect(err).To(BeAssignableToTypeOf(errtypes.PermissionDenied("")))
+			checkCalled(called, `POST /apps/sciencemesh/~homer/api/storage/GetSystemStats `)
+		})
+	})
+
+	Describe("max_error_body_log", func() {
+		It("cuts off a huge error body", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.GetMD(ctx, &provider.Reference{Path: "/huge-error"}, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HaveSuffix("…"))
+			Expect(len(err.Error())).To(BeNumerically("<", 1100))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/huge-error"},"mdKeys":null}`)
+		})
+
+		It("cuts off at the configured size", func() {
+			nc, _, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				MaxErrorBodyLog: 10,
+			})
+			defer teardown()
+			_, err := nc.GetMD(ctx, &provider.Reference{Path: "/huge-error"}, nil)
+			Expect(err).To(MatchError("internal error: EFSS API responded 500: <p>Interna…"))
+		})
+
+		It("can keep the whole body", func() {
+			nc, _, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				MaxErrorBodyLog: -1,
+			})
+			defer teardown()
+			_, err := nc.GetMD(ctx, &provider.Reference{Path: "/huge-error"}, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HaveSuffix("</p>"))
+		})
+	})
+
+	Describe("CheckRetentionLocks", func() {
+		refs := []*provider.Reference{
+			{Path: "/reports/2021.pdf"},
+			{Path: "/reports/2022.pdf"},
+			{Path: "/reports/2023.pdf"},
+		}
+
+		It("returns the items under retention", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			locked, err := nc.CheckRetentionLocks(ctx, refs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(locked).To(Equal([]*provider.Reference{refs[1]}))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/CheckRetentionLocks [{"path":"/reports/2021.pdf"},{"path":"/reports/2022.pdf"},{"path":"/reports/2023.pdf"}]`)
+		})
+
+		It("asks about each item if the server cannot do it in one go", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			locked, err := nc.CheckRetentionLocks(contextWithUser(ctx, "retainer", "retainer"), refs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(locked).To(Equal([]*provider.Reference{refs[1]}))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~retainer/api/storage/CheckRetentionLocks [{"path":"/reports/2021.pdf"},{"path":"/reports/2022.pdf"},{"path":"/reports/2023.pdf"}]`,
+				`POST /apps/sciencemesh/~retainer/api/storage/GetRetention {"path":"/reports/2021.pdf"}`,
+				`POST /apps/sciencemesh/~retainer/api/storage/GetRetention {"path":"/reports/2022.pdf"}`,
+				`POST /apps/sciencemesh/~retainer/api/storage/GetRetention {"path":"/reports/2023.pdf"}`,
+			)
+		})
+	})
+
+	Describe("paged ListStorageSpaces", func() {
+		It("fetches all pages when the server pages the listing", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			spaces, err := nc.ListStorageSpaces(contextWithUser(ctx, "spacer", "spacer"), []*provider.ListStorageSpacesRequest_Filter{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(spaces)).To(Equal(3))
+			Expect(spaces[0].Name).To(Equal("One"))
+			Expect(spaces[2].Id.OpaqueId).To(Equal("space-3"))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~spacer/api/storage/ListStorageSpaces []`,
+				`POST /apps/sciencemesh/~spacer/api/storage/ListStorageSpacesPage {"filters":[],"cursor":"page-2"}`,
+			)
+		})
+
+		It("lists a page at a time with ListStorageSpacesPage", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			spacerCtx := contextWithUser(ctx, "spacer", "spacer")
+			filters := []*provider.ListStorageSpacesRequest_Filter{}
+			spaces, cursor, err := nc.ListStorageSpacesPage(spacerCtx, filters, 2, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(spaces)).To(Equal(2))
+			Expect(cursor).To(Equal("page-2"))
+			spaces, cursor, err = nc.ListStorageSpacesPage(spacerCtx, filters, 0, cursor)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(spaces)).To(Equal(1))
+			Expect(spaces[0].Name).To(Equal("Three"))
+			Expect(cursor).To(Equal(""))
+		})
+
+		It("stops when the server keeps sending the same cursor", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.ListStorageSpaces(contextWithUser(ctx, "looper", "looper"), []*provider.ListStorageSpacesRequest_Filter{})
+			Expect(err).To(BeAssignableToTypeOf(errtypes.InternalError("")))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~looper/api/storage/ListStorageSpaces []`,
+				`POST /apps/sciencemesh/~looper/api/storage/ListStorageSpacesPage {"filters":[],"cursor":"page-2"}`,
+			)
+		})
+	})
+
+	Describe("Sync", func() {
+		It("asks the server to commit an uploaded file", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ref := &provider.Reference{Path: "/some/file/path.txt"}
+			err := nc.Upload(ctx, ref, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			err = nc.Sync(ctx, ref)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalls(called,
+				`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/some/file/path.txt shiny!`,
+				`POST /apps/sciencemesh/~tester/api/storage/Sync {"path":"/some/file/path.txt"}`,
+			)
+		})
+
+		It("does nothing if the server does not support it", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.Sync(contextWithUser(ctx, "homer", "homer"), &provider.Reference{Path: "/some/file/path.txt"})
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~homer/api/storage/Sync {"path":"/some/file/path.txt"}`)
+		})
+	})
+
+	Describe("GetUploadOffset", func() {
+		It("returns how much of the upload the server has", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			offset, err := nc.GetUploadOffset(ctx, "~tester/api/storage/TusUpload/home/some/file/resumed.txt")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(offset).To(Equal(int64(3)))
+			checkCalled(called, `HEAD /apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/resumed.txt `)
+		})
+
+		It("takes absolute upload urls", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			offset, err := nc.GetUploadOffset(ctx, "http://mock.com/apps/sciencemesh/~tester/api/storage/TusUpload/home/some/file/resumed.txt")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(offset).To(Equal(int64(3)))
+		})
+
+		It("reports an unknown upload", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.GetUploadOffset(ctx, "~tester/api/storage/TusUpload/home/some/file/cancelled.txt")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.NotFound("")))
+		})
+	})
+
+	Describe("WithEndpoint", func() {
+		It("talks to the new endpoint, leaving the original alone", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			if called == nil {
+				Skip("needs the mock server")
+			}
+			clone, err := nc.WithEndpoint("http://mock2.com/nextcloud2/apps/sciencemesh")
+			Expect(err).ToNot(HaveOccurred())
+			home, err := clone.GetHome(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(home).To(Equal("/home/tester"))
+			home, err = nc.GetHome(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(home).To(Equal("yes we are"))
+			checkCalls(called,
+				`POST /nextcloud2/apps/sciencemesh/~tester/api/storage/GetHome `,
+				`POST /apps/sciencemesh/~tester/api/storage/GetHome `,
+			)
+			Expect(clone.Stats().Requests).To(Equal(int64(1)))
+			Expect(nc.Stats().Requests).To(Equal(int64(1)))
+		})
+
+		It("rejects an invalid endpoint", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.WithEndpoint("mock2.com/apps/sciencemesh/")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+		})
+	})
+
+	Describe("CreateDirWithResourceID", func() {
+		It("reads the id of the new folder from a relative Location header", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			id, err := nc.CreateDirWithResourceID(ctx, &provider.Reference{Path: "/located"})
+			Expect(err).ToNot(HaveOccurred())
+			if called != nil {
+				Expect(id).To(Equal(&provider.ResourceId{StorageId: "storage-1", OpaqueId: "fileid-42"}))
+			}
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/CreateDir {"path":"/located"}`)
+		})
+
+		It("returns no id if the server sends no Location header", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			id, err := nc.CreateDirWithResourceID(ctx, &provider.Reference{Path: "/MyShares"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(BeNil())
+		})
+	})
+
+	Describe("disabled_operations", func() {
+		It("refuses a disabled operation without asking the server", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				DisabledOperations: []string{"Delete", "Move"},
+			})
+			defer teardown()
+			err := nc.Delete(ctx, &provider.Reference{Path: "/some/path"})
+			Expect(err).To(BeAssignableToTypeOf(nextcloud.OperationDisabled("")))
+			_, err = nc.MoveAndStat(ctx, &provider.Reference{Path: "/a"}, &provider.Reference{Path: "/b"})
+			Expect(err).To(BeAssignableToTypeOf(nextcloud.OperationDisabled("")))
+			_, err = nc.DeleteMulti(ctx, []*provider.Reference{{Path: "/a"}})
+			Expect(err).To(BeAssignableToTypeOf(nextcloud.OperationDisabled("")))
+			checkNotCalled(called)
+		})
+
+		It("does not fall back to another way of doing a disabled operation", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				DisabledOperations: []string{"Sync", "GetShareSummary"},
+			})
+			defer teardown()
+			err := nc.Sync(ctx, &provider.Reference{Path: "/some/path"})
+			Expect(err).To(BeAssignableToTypeOf(nextcloud.OperationDisabled("")))
+			_, err = nc.GetShareSummary(ctx, &provider.Reference{Path: "/some/path"})
+			Expect(err).To(BeAssignableToTypeOf(nextcloud.OperationDisabled("")))
+			checkNotCalled(called)
+		})
+
+		It("rejects unknown operations", func() {
+			for _, op := range []string{"DeleteStorageSpace", "Stats", "SetHTTPClient"} {
+				_, err := nextcloud.NewStorageDriver(&nextcloud.StorageDriverConfig{
+					EndPoint:           "http://mock.com/apps/sciencemesh/",
+					DisabledOperations: []string{op},
+				})
+				Expect(err).To(MatchError(ContainSubstring("unknown operation in 'disabled_operations': " + op)))
+			}
+		})
+	})
+
+	Describe("GetQuotaWithWarning", func() {
+		It("returns the warning from the X-Quota-Warning header", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			total, used, warning, err := nc.GetQuotaWithWarning(contextWithUser(ctx, "nearfull", "nearfull"), &provider.Reference{Path: "/"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(total).To(Equal(uint64(1000)))
+			Expect(used).To(Equal(uint64(950)))
+			Expect(warning).To(Equal("You have used 95% of your storage"))
+			checkCalled(called, `POST /apps/sciencemesh/~nearfull/api/storage/GetQuota `)
+		})
+
+		It("returns the warning from the response body", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, _, warning, err := nc.GetQuotaWithWarning(contextWithUser(ctx, "overfull", "overfull"), &provider.Reference{Path: "/"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(warning).To(Equal("You have used 99% of your storage"))
+		})
+	})
+
+	Describe("GetIDsByPaths", func() {
+		It("resolves many paths in one call, leaving out missing ones", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ids, err := nc.GetIDsByPaths(ctx, []*provider.Reference{
+				{Path: "/a.txt"},
+				{Path: "/missing.txt"},
+				{Path: "/dir/b.txt"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(ids)).To(Equal(2))
+			Expect(ids["/a.txt"].OpaqueId).To(Equal("fileid-1"))
+			Expect(ids["/dir/b.txt"].OpaqueId).To(Equal("fileid-2"))
+			Expect(ids).ToNot(HaveKey("/missing.txt"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetIDsByPaths [{"path":"/a.txt"},{"path":"/missing.txt"},{"path":"/dir/b.txt"}]`)
+		})
+	})
+
+	Describe("UploadArchive", func() {
+		It("uploads an archive for the server to extract", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.UploadArchive(ctx, &provider.Reference{Path: "/photos"}, "zip", io.NopCloser(strings.NewReader("PK zipped photos")))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `PUT /apps/sciencemesh/~tester/api/storage/UploadArchive/home/photos?format=zip PK zipped photos`)
+		})
+
+		It("reports a format the server cannot extract", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.UploadArchive(ctx, &provider.Reference{Path: "/photos"}, "tar", io.NopCloser(strings.NewReader("tarred photos")))
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			Expect(err.Error()).To(ContainSubstring("cannot extract tar archives"))
+			checkCalled(called, `PUT /apps/sciencemesh/~tester/api/storage/UploadArchive/home/photos?format=tar tarred photos`)
+		})
+
+		It("rejects unknown formats without asking the server", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.UploadArchive(ctx, &provider.Reference{Path: "/photos"}, "rar", io.NopCloser(strings.NewReader("rarred photos")))
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			checkNotCalled(called)
+		})
+	})
+
+	Describe("ListFolder with ContextSetIncludeTrashed", func() {
+		It("leaves out trashed children by default", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			infos, err := nc.ListFolder(ctx, &provider.Reference{Path: "/bin"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(infos).To(HaveLen(1))
+			Expect(nextcloud.IsTrashed(infos[0])).To(BeFalse())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/bin"},"mdKeys":null}`)
+		})
+
+		It("includes trashed children and marks them", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			infos, err := nc.ListFolder(nextcloud.ContextSetIncludeTrashed(ctx), &provider.Reference{Path: "/bin"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(infos).To(HaveLen(2))
+			Expect(infos[0].Path).To(Equal("/bin/kept.txt"))
+			Expect(nextcloud.IsTrashed(infos[0])).To(BeFalse())
+			Expect(infos[1].Path).To(Equal("/bin/deleted.txt"))
+			Expect(nextcloud.IsTrashed(infos[1])).To(BeTrue())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/bin"},"mdKeys":null,"includeTrashed":true}`)
+		})
+	})
+
+	Describe("ListRevisions opaque map", func() {
+		It("decodes the base64 values and encodes them back unchanged", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			revs, err := nc.ListRevisions(ctx, &provider.Reference{Path: "/opaque.bin"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(revs).To(HaveLen(1))
+			Expect(revs[0].Opaque.Map["author"]).To(Equal(&types.OpaqueEntry{Decoder: "plain", Value: []byte("marie")}))
+			Expect(revs[0].Opaque.Map["blob"]).To(Equal(&types.OpaqueEntry{Decoder: "binary", Value: []byte{0x00, 0xff, 0x10}}))
+			encoded, err := json.Marshal(revs[0].Opaque)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(encoded).To(MatchJSON(`{"map":{"author":{"decoder":"plain","value":"bWFyaWU="},"blob":{"decoder":"binary","value":"AP8Q"}}}`))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ListRevisions {"path":"/opaque.bin"}`)
+		})
+	})
+
+	Describe("WaitForJob", func() {
+		It("polls until the job is done", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			job, err := nc.WaitForJob(ctx, "job-7", time.Millisecond)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(job.Status).To(Equal(nextcloud.JobDone))
+			Expect(job.Result).To(MatchJSON(`{"path":"/exports/all.zip"}`))
+			checkCalls(called,
+				`GET /apps/sciencemesh/~tester/api/JobStatus/job-7 `,
+				`GET /apps/sciencemesh/~tester/api/JobStatus/job-7 `,
+				`GET /apps/sciencemesh/~tester/api/JobStatus/job-7 `,
+			)
+		})
+
+		It("returns an error for a failed job", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			job, err := nc.WaitForJob(ctx, "job-8", time.Millisecond)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("disk full"))
+			Expect(job.Status).To(Equal(nextcloud.JobFailed))
+		})
+
+		It("stops waiting when the context ends", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			_, err := nc.WaitForJob(waitCtx, "job-9", 10*time.Millisecond)
+			Expect(err).To(Equal(context.DeadlineExceeded))
+		})
+
+		It("returns NotFound for an unknown job", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.WaitForJob(ctx, "job-0", time.Millisecond)
+			Expect(err).To(Equal(errtypes.NotFound("job-0")))
+		})
+	})
+
+	Describe("unicode_normalization", func() {
+		nfd := "/Cafe\u0301"
+
+		It("sends paths as they come by default", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, _ = nc.GetMD(ctx, &provider.Reference{Path: nfd}, nil)
+			if called != nil {
+				Expect((*called)[0]).To(ContainSubstring(nfd))
+			}
+		})
+
+		It("normalizes NFD paths to NFC", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				UnicodeNormalization: "nfc",
+			})
+			defer teardown()
+			md, err := nc.GetMD(ctx, &provider.Reference{Path: nfd}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(md.Path).To(Equal("/Caf\u00e9"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/Café"},"mdKeys":null}`)
+		})
+
+		It("normalizes upload paths too", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				UnicodeNormalization: "nfc",
+			})
+			defer teardown()
+			err := nc.Upload(ctx, &provider.Reference{Path: nfd + "/menu.txt"}, io.NopCloser(strings.NewReader("soup")))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `PUT /apps/sciencemesh/~tester/api/storage/Upload/home/Caf%C3%A9/menu.txt soup`)
+		})
+
+		It("rejects unknown forms", func() {
+			_, err := nextcloud.NewStorageDriver(&nextcloud.StorageDriverConfig{
+				EndPoint:             "http://mock.com/apps/sciencemesh/",
+				UnicodeNormalization: "nfkc",
+			})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("PurgeRevision", func() {
+		ref := &provider.Reference{Path: "/some/versioned.txt"}
+
+		It("purges an old version", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.PurgeRevision(ctx, ref, "v1")
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/PurgeRevision {"ref":{"path":"/some/versioned.txt"},"key":"v1"}`)
+		})
+
+		It("returns NotFound for an unknown version", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.PurgeRevision(ctx, ref, "v9")
+			Expect(err).To(Equal(errtypes.NotFound("v9")))
+		})
+
+		It("refuses to purge the current version", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.PurgeRevision(ctx, ref, "current")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+		})
+
+		It("refuses an empty key without asking the server", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.PurgeRevision(ctx, ref, "")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			checkNotCalled(called)
+		})
+	})
+
+	Describe("request_server_compression", func() {
+		conf := func() *nextcloud.StorageDriverConfig {
+			return &nextcloud.StorageDriverConfig{RequestServerCompression: true}
+		}
+
+		It("sends the hint with Upload", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(conf())
+			defer teardown()
+			err := nc.Upload(ctx, &provider.Reference{Path: "/notes.txt"}, io.NopCloser(strings.NewReader("lorem ipsum")))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `PUT /apps/sciencemesh/~tester/api/storage/Upload/home/notes.txt [X-Reva-Compress: true] lorem ipsum`)
+		})
+
+		It("sends the hint with InitiateUpload", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(conf())
+			defer teardown()
+			_, err := nc.InitiateUpload(ctx, &provider.Reference{Path: "/notes.txt"}, 11, nil)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/InitiateUpload {"ref":{"path":"/notes.txt"},"uploadLength":11,"metadata":null,"compress":true}`)
+		})
+
+		It("reports in GetMD that the file is stored compressed", func() {
+			nc, _, teardown := setUpNextcloudServerWithConfig(conf())
+			defer teardown()
+			md, err := nc.GetMD(ctx, &provider.Reference{Path: "/notes.txt"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nextcloud.IsCompressed(md)).To(BeTrue())
+		})
+
+		It("reports uncompressed files as such", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			md, err := nc.GetMD(ctx, &provider.Reference{Path: "/some/versioned.txt"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nextcloud.IsCompressed(md)).To(BeFalse())
+		})
+	})
+
+	Describe("ValidateShareFolder", func() {
+		It("accepts an existing share folder", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.ValidateShareFolder(contextWithUser(ctx, "sharer", "sharer"))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~sharer/api/storage/GetMD {"ref":{"path":"/Shares"},"mdKeys":null}`)
+		})
+
+		It("creates a missing share folder with auto_create_share_folder", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				AutoCreateShareFolder: true,
+			})
+			defer teardown()
+			err := nc.ValidateShareFolder(contextWithUser(ctx, "nosharer", "nosharer"))
+			Expect(err).ToNot(HaveOccurred())
+			checkCalls(called,
+				`POST /apps/sciencemesh/~nosharer/api/storage/GetMD {"ref":{"path":"/Shares"},"mdKeys":null}`,
+				`POST /apps/sciencemesh/~nosharer/api/storage/CreateDir {"path":"/Shares"}`,
+			)
+		})
+
+		It("reports a missing share folder without auto_create_share_folder", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.ValidateShareFolder(contextWithUser(ctx, "nosharer", "nosharer"))
+			Expect(err).To(Equal(nextcloud.InvalidShareFolder("/Shares does not exist")))
+			checkCalled(called, `POST /apps/sciencemesh/~nosharer/api/storage/GetMD {"ref":{"path":"/Shares"},"mdKeys":null}`)
+		})
+
+		It("reports a share folder that is not a folder", func() {
+			nc, _, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				AutoCreateShareFolder: true,
+			})
+			defer teardown()
+			err := nc.ValidateShareFolder(contextWithUser(ctx, "filesharer", "filesharer"))
+			Expect(err).To(Equal(nextcloud.InvalidShareFolder("/Shares is not a folder")))
+		})
+	})
+
+	Describe("SetArbitraryMetadataAndStat", func() {
+		md := &provider.ArbitraryMetadata{Metadata: map[string]string{"color": "red"}}
+
+		It("returns the new etag and mtime the server sends along", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			info, err := nc.SetArbitraryMetadataAndStat(ctx, &provider.Reference{Path: "/tagged.txt"}, md)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Etag).To(Equal("etag-after"))
+			Expect(info.Mtime.Seconds).To(Equal(uint64(1700000000)))
+			Expect(info.ArbitraryMetadata.Metadata).To(Equal(map[string]string{"color": "red"}))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"path":"/tagged.txt"},"md":{"metadata":{"color":"red"}}}`)
+		})
+
+		It("falls back to GetMD if the server sends nothing", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			info, err := nc.SetArbitraryMetadataAndStat(ctx, &provider.Reference{Path: "/some/versioned.txt"}, md)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Path).To(Equal("/some/versioned.txt"))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"path":"/some/versioned.txt"},"md":{"metadata":{"color":"red"}}}`,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/some/versioned.txt"},"mdKeys":null}`,
+			)
+		})
+	})
+
+	Describe("upload_conflict_policy", func() {
+		upload := func(policy string) (string, *[]string, error) {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				UploadConflictPolicy: policy,
+			})
+			defer teardown()
+			p, err := nc.UploadWithFinalPath(ctx, &provider.Reference{Path: "/report.txt"}, io.NopCloser(strings.NewReader("v2")))
+			return p, called, err
+		}
+
+		It("overwrites by default", func() {
+			p, called, err := upload("")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p).To(Equal("/report.txt"))
+			checkCalled(called, `PUT /apps/sciencemesh/~tester/api/storage/Upload/home/report.txt v2`)
+		})
+
+		It("overwrites", func() {
+			p, called, err := upload("overwrite")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p).To(Equal("/report.txt"))
+			checkCalled(called, `PUT /apps/sciencemesh/~tester/api/storage/Upload/home/report.txt [X-Reva-Conflict-Policy: overwrite] v2`)
+		})
+
+		It("returns the new name of a renamed upload", func() {
+			p, called, err := upload("rename")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p).To(Equal("/report (2).txt"))
+			checkCalled(called, `PUT /apps/sciencemesh/~tester/api/storage/Upload/home/report.txt [X-Reva-Conflict-Policy: rename] v2`)
+		})
+
+		It("fails on an existing file", func() {
+			_, called, err := upload("fail")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.AlreadyExists("")))
+			checkCalled(called, `PUT /apps/sciencemesh/~tester/api/storage/Upload/home/report.txt [X-Reva-Conflict-Policy: fail] v2`)
+		})
+
+		It("rejects unknown policies", func() {
+			_, err := nextcloud.NewStorageDriver(&nextcloud.StorageDriverConfig{
+				EndPoint:             "http://mock.com/apps/sciencemesh/",
+				UploadConflictPolicy: "merge",
+			})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("GetEffectivePermissionsExplained", func() {
+		It("explains direct and inherited permissions from the grants on the ancestors", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			grantee := &provider.Grantee{
+				Id: &provider.Grantee_UserId{
+					UserId: &userpb.UserId{
+						Idp:      "some-idp",
+						OpaqueId: "einstein",
+						Type:     userpb.UserType_USER_TYPE_PRIMARY,
+					},
+				},
+			}
+			explanation, err := nc.GetEffectivePermissionsExplained(ctx, &provider.Reference{Path: "/projects/report/draft.txt"}, grantee)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(explanation.Permissions).To(Equal(&provider.ResourcePermissions{
+				Stat:                 true,
+				InitiateFileUpload:   true,
+				InitiateFileDownload: true,
+				ListContainer:        true,
+			}))
+			Expect(explanation.Sources).To(Equal(map[string][]string{
+				"stat":                   {"/projects/report/draft.txt", "/projects"},
+				"initiate_file_upload":   {"/projects/report/draft.txt"},
+				"initiate_file_download": {"/projects"},
+				"list_container":         {"/projects"},
+			}))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetEffectivePermissionsExplained {"ref":{"path":"/projects/report/draft.txt"},"grantee":{"Id":{"UserId":{"idp":"some-idp","opaque_id":"einstein","type":1}}}}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/projects/report/draft.txt"}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/projects/report"}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/projects"}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/"}`,
+			)
+		})
+
+		It("falls back to the grants when the server has no route for it", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			grantee := &provider.Grantee{
+				Id: &provider.Grantee_UserId{
+					UserId: &userpb.UserId{
+						Idp:      "some-idp",
+						OpaqueId: "einstein",
+						Type:     userpb.UserType_USER_TYPE_PRIMARY,
+					},
+				},
+			}
+			explanation, err := nc.GetEffectivePermissionsExplained(ctx, &provider.Reference{Path: "/projects"}, grantee)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(explanation.Sources).To(HaveKeyWithValue("list_container", []string{"/projects"}))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetEffectivePermissionsExplained {"ref":{"path":"/projects"},"grantee":{"Id":{"UserId":{"idp":"some-idp","opaque_id":"einstein","type":1}}}}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/projects"}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListGrants {"path":"/"}`,
+			)
+		})
+	})
+
+	Describe("GetAncestors", func() {
+		It("lists the resource and its ancestors, nearest first", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ancestors, err := nc.GetAncestors(ctx, &provider.Reference{Path: "/projects/report/draft.txt"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ancestors).To(Equal([]string{"/projects/report/draft.txt", "/projects/report", "/projects", "/"}))
+			checkNotCalled(called)
+		})
+	})
+
+	Describe("do", func() {
+		It("accepts any 2xx response", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.Delete(ctx, &provider.Reference{Path: "/no-content"})
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Delete {"path":"/no-content"}`)
+		})
+
+		It("needs a user in the context", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.Delete(context.Background(), &provider.Reference{Path: "/no-content"})
+			var userRequired errtypes.UserRequired
+			Expect(errors.As(err, &userRequired)).To(BeTrue())
+			checkNotCalled(called)
+		})
+
+		It("needs the user in the context to have an id", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			noID := ctxpkg.ContextSetUser(context.Background(), &userpb.User{Username: "anonymous"})
+			err := nc.Delete(noID, &provider.Reference{Path: "/no-content"})
+			var userRequired errtypes.UserRequired
+			Expect(errors.As(err, &userRequired)).To(BeTrue())
+			checkNotCalled(called)
+		})
+
+		It("does not send, nor retry, requests with a cancelled context", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				MaxRetries: 3,
+			})
+			defer teardown()
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			err := nc.Delete(cancelled, &provider.Reference{Path: "/no-content"})
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			checkNotCalled(called)
+			Expect(nc.Stats().Retries).To(BeZero())
+		})
+	})
+
+	Describe("StreamServerLogs", func() {
+		It("streams the log lines to an admin", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				AdminUsers: []string{"tester"},
+			})
+			defer teardown()
+			logs, err := nc.StreamServerLogs(ctx, time.Date(2023, 5, 1, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60)))
+			Expect(err).ToNot(HaveOccurred())
+			defer logs.Close()
+			lines, err := io.ReadAll(logs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(strings.Split(strings.TrimSpace(string(lines)), "\n")).To(Equal([]string{
+				"12:00:01 INFO upload done",
+				"12:00:02 WARN quota almost full",
+			}))
+			checkCalled(called, `GET /apps/sciencemesh/~tester/api/Logs?since=2023-05-01T12%3A00%3A00Z `)
+		})
+
+		It("refuses users who are not admins", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.StreamServerLogs(ctx, time.Time{})
+			Expect(err).To(BeAssignableToTypeOf(errtypes.PermissionDenied("")))
+			checkNotCalled(called)
+		})
+	})
+
+	Describe("DeepCheck", func() {
+		It("reports the outcome of each check", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			report, err := nc.DeepCheck(contextWithUser(ctx, "checker", "checker"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.Healthy()).To(BeFalse())
+			Expect(report.Checks).To(HaveLen(3))
+			Expect(report.Checks[0].Name).To(Equal("GetHome"))
+			Expect(report.Checks[0].Err).ToNot(HaveOccurred())
+			Expect(report.Checks[1].Name).To(Equal("GetMD"))
+			Expect(report.Checks[1].Err).ToNot(HaveOccurred())
+			Expect(report.Checks[2].Name).To(Equal("GetQuota"))
+			Expect(report.Checks[2].Err).To(MatchError(ContainSubstring("quota backend down")))
+			for _, c := range report.Checks {
+				Expect(c.Latency).To(BeNumerically(">", 0))
+			}
+			checkCalls(called,
+				`POST /apps/sciencemesh/~checker/api/storage/GetHome `,
+				`POST /apps/sciencemesh/~checker/api/storage/GetMD {"ref":{"path":"/"},"mdKeys":null}`,
+				`POST /apps/sciencemesh/~checker/api/storage/GetQuota `,
+			)
+		})
+	})
+
+	Describe("MoveWithConflictPolicy", func() {
+		It("returns the new name when the server renamed the moved file", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			p, err := nc.MoveWithConflictPolicy(ctx, &provider.Reference{Path: "/inbox/report.txt"}, &provider.Reference{Path: "/archive/report.txt"}, "rename")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p).To(Equal("/archive/report (2).txt"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/inbox/report.txt"},"newRef":{"path":"/archive/report.txt"},"conflictPolicy":"rename"}`)
+		})
+
+		It("returns the requested name when there was no conflict", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			p, err := nc.MoveWithConflictPolicy(ctx, &provider.Reference{Path: "/inbox/notes.txt"}, &provider.Reference{Path: "/archive/notes.txt"}, "rename")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p).To(Equal("/archive/notes.txt"))
+		})
+
+		It("fails on a conflict with the fail policy", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.MoveWithConflictPolicy(ctx, &provider.Reference{Path: "/inbox/report.txt"}, &provider.Reference{Path: "/archive/report.txt"}, "fail")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.AlreadyExists("")))
+		})
+
+		It("rejects unknown policies without asking the server", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.MoveWithConflictPolicy(ctx, &provider.Reference{Path: "/inbox/report.txt"}, &provider.Reference{Path: "/archive/report.txt"}, "merge")
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			checkNotCalled(called)
+		})
+	})
+
+	Describe("MoveWithOverwrite", func() {
+		oldRef := &provider.Reference{Path: "/drafts/plan.txt"}
+		newRef := &provider.Reference{Path: "/final/plan.txt"}
+
+		It("replaces an existing target with overwrite", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.MoveWithOverwrite(ctx, oldRef, newRef, true)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/drafts/plan.txt"},"newRef":{"path":"/final/plan.txt"},"conflictPolicy":"overwrite"}`)
+		})
+
+		It("fails on an existing target without overwrite", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.MoveWithOverwrite(ctx, oldRef, newRef, false)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.AlreadyExists("")))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/Move {"oldRef":{"path":"/drafts/plan.txt"},"newRef":{"path":"/final/plan.txt"},"conflictPolicy":"fail"}`)
+		})
+
+		It("does not overwrite with a plain Move", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.Move(ctx, oldRef, newRef)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.AlreadyExists("")))
+		})
+	})
+
+	Describe("access token", func() {
+		It("forwards the token of the caller with every request", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			tkn, _ := ctxpkg.ContextGetToken(ctx)
+			recorded := []string{}
+			nc.SetRoundTripper(func(next http.RoundTripper) http.RoundTripper {
+				return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					recorded = append(recorded, req.Method+" "+req.URL.Path+" "+req.Header.Get("X-Access-Token")+" "+req.Header.Get("X-Reva-Token"))
+					return next.RoundTrip(req)
+				})
+			})
+			_, err := nc.GetHome(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			err = nc.Upload(ctx, &provider.Reference{Path: "/some/file/path.txt"}, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			if called != nil {
+				Expect(recorded).To(Equal([]string{
+					"POST /apps/sciencemesh/~tester/api/storage/GetHome " + tkn + " " + tkn,
+					"PUT /apps/sciencemesh/~tester/api/storage/Upload/home/some/file/path.txt " + tkn + " " + tkn,
+				}))
+			}
+		})
+
+		It("leaves out X-Reva-Secret without a shared secret", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			sent := false
+			nc.SetRoundTripper(func(next http.RoundTripper) http.RoundTripper {
+				return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					_, ok := req.Header["X-Reva-Secret"]
+					sent = sent || ok
+					return next.RoundTrip(req)
+				})
+			})
+			_, err := nc.GetHome(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			if called != nil {
+				Expect(sent).To(BeFalse())
+			}
+		})
+
+		It("fails fast without a token", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			noToken := ctxpkg.ContextSetUser(context.Background(), user)
+			_, err := nc.GetHome(noToken)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.InvalidCredentials("")))
+			err = nc.Upload(noToken, &provider.Reference{Path: "/some/file/path.txt"}, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).To(BeAssignableToTypeOf(errtypes.InvalidCredentials("")))
+			checkNotCalled(called)
+		})
+	})
+
+	Describe("GetShareRecipientSuggestions", func() {
+		It("decodes the suggested users and groups", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			grantees, err := nc.GetShareRecipientSuggestions(ctx, &provider.Reference{Path: "/report.pdf"}, "ein", 3)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(grantees).To(Equal([]*provider.Grantee{
+				{
+					Type: provider.GranteeType_GRANTEE_TYPE_USER,
+					Id:   &provider.Grantee_UserId{UserId: &userpb.UserId{Idp: "cernbox.cern.ch", OpaqueId: "einstein", Type: userpb.UserType_USER_TYPE_PRIMARY}},
+				},
+				{
+					Type: provider.GranteeType_GRANTEE_TYPE_GROUP,
+					Id:   &provider.Grantee_GroupId{GroupId: &grouppb.GroupId{Idp: "cernbox.cern.ch", OpaqueId: "einstein-fans"}},
+				},
+				{
+					Type: provider.GranteeType_GRANTEE_TYPE_USER,
+					Id:   &provider.Grantee_UserId{UserId: &userpb.UserId{Idp: "cesnet.cz", OpaqueId: "einar", Type: userpb.UserType_USER_TYPE_PRIMARY}},
+				},
+			}))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/ShareRecipients {"ref":{"path":"/report.pdf"},"query":"ein","limit":3}`)
+		})
+
+		It("returns no more than limit suggestions", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			grantees, err := nc.GetShareRecipientSuggestions(ctx, &provider.Reference{Path: "/report.pdf"}, "ein", 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(grantees).To(HaveLen(2))
+		})
+	})
+
+	Describe("ContextSetWarnings", func() {
+		It("collects the warnings sent along with a successful response", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			warnings := &nextcloud.Warnings{}
+			md, err := nc.GetMD(nextcloud.ContextSetWarnings(ctx, warnings), &provider.Reference{Path: "/partial.txt"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(md.Size).To(Equal(uint64(3)))
+			Expect(warnings.List()).To(Equal([]string{"arbitrary metadata unavailable", "checksum not computed yet"}))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/partial.txt"},"mdKeys":null}`)
+		})
+
+		It("collects nothing from responses without warnings", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			warnings := &nextcloud.Warnings{}
+			_, err := nc.GetMD(nextcloud.ContextSetWarnings(ctx, warnings), &provider.Reference{Path: "/some/versioned.txt"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(warnings.List()).To(BeEmpty())
+		})
+	})
+
+	Describe("CheckQuotaForUpload", func() {
+		It("accepts an upload that fits", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			fits, err := nc.CheckQuotaForUpload(contextWithUser(ctx, "nearfull", "nearfull"), &provider.Reference{Path: "/big.iso"}, 50)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fits).To(BeTrue())
+			checkCalled(called, `POST /apps/sciencemesh/~nearfull/api/storage/GetQuota `)
+		})
+
+		It("refuses an upload that does not fit, saying how much room is left", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			fits, err := nc.CheckQuotaForUpload(contextWithUser(ctx, "nearfull", "nearfull"), &provider.Reference{Path: "/big.iso"}, 51)
+			Expect(fits).To(BeFalse())
+			Expect(err).To(BeAssignableToTypeOf(errtypes.InsufficientStorage("")))
+			Expect(err.Error()).To(ContainSubstring("50 bytes available"))
+		})
+	})
+
+	Describe("follow_symlinks", func() {
+		It("returns a symlink as such by default", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			md, err := nc.GetMD(ctx, &provider.Reference{Path: "/links/latest"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(md.Type).To(Equal(provider.ResourceType_RESOURCE_TYPE_SYMLINK))
+			Expect(md.Target).To(Equal("releases/v2"))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/links/latest"},"mdKeys":null}`)
+		})
+
+		It("lists symlinks as such", func() {
+			nc, _, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				FollowSymlinks: true,
+			})
+			defer teardown()
+			infos, err := nc.ListFolder(ctx, &provider.Reference{Path: "/links"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(infos[0].Type).To(Equal(provider.ResourceType_RESOURCE_TYPE_SYMLINK))
+			Expect(infos[0].Target).To(Equal("releases/v2"))
+		})
+
+		It("resolves a symlink to its target", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				FollowSymlinks: true,
+			})
+			defer teardown()
+			md, err := nc.GetMD(ctx, &provider.Reference{Path: "/links/latest"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(md.Type).To(Equal(provider.ResourceType_RESOURCE_TYPE_CONTAINER))
+			Expect(md.Path).To(Equal("/links/releases/v2"))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/links/latest"},"mdKeys":null}`,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/links/releases/v2"},"mdKeys":null}`,
+			)
+		})
+
+		It("detects symlink loops", func() {
+			nc, called, teardown := setUpNextcloudServerWithConfig(&nextcloud.StorageDriverConfig{
+				FollowSymlinks: true,
+			})
+			defer teardown()
+			_, err := nc.GetMD(ctx, &provider.Reference{Path: "/loop/a"}, nil)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")))
+			if called != nil {
+				Expect(*called).To(HaveLen(3))
+			}
+		})
+	})
+
+	Describe("ExportMetadata and ImportMetadata", func() {
+		It("copies the metadata of a subtree to another folder", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			doc, err := nc.ExportMetadata(ctx, &provider.Reference{Path: "/meta"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(doc)).To(Equal(`{"version":1,"entries":[{"path":".","metadata":{"color":"red"}},{"path":"a.txt","metadata":{"tag":"x"}},{"path":"sub/b.txt","metadata":{"owner":"z","tag":"y"}}]}`))
+			err = nc.ImportMetadata(ctx, &provider.Reference{Path: "/copy"}, doc)
+			Expect(err).ToNot(HaveOccurred())
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/meta"},"mdKeys":null}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/meta"},"mdKeys":null}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"path":"/meta/sub"},"mdKeys":null}`,
+				`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"path":"/copy"},"md":{"metadata":{"color":"red"}}}`,
+				`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"path":"/copy/a.txt"},"md":{"metadata":{"tag":"x"}}}`,
+				`POST /apps/sciencemesh/~tester/api/storage/SetArbitraryMetadata {"ref":{"path":"/copy/sub/b.txt"},"md":{"metadata":{"owner":"z","tag":"y"}}}`,
+			)
+		})
+
+		It("exports a folder given by id relative to that id", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			doc, err := nc.ExportMetadata(ctx, nextcloud.NewReference("storage-id", "meta-id", "."))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(doc)).To(Equal(`{"version":1,"entries":[{"path":".","metadata":{"color":"red"}},{"path":"a.txt","metadata":{"tag":"x"}},{"path":"sub/b.txt","metadata":{"owner":"z","tag":"y"}}]}`))
+			checkCalls(called,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"meta-id"},"path":"."},"mdKeys":null}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"meta-id"},"path":"."},"mdKeys":null}`,
+				`POST /apps/sciencemesh/~tester/api/storage/ListFolder {"ref":{"resource_id":{"storage_id":"storage-id","opaque_id":"meta-id"},"path":"./sub"},"mdKeys":null}`,
+			)
+		})
+
+		It("rejects an invalid document without setting anything", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			for _, doc := range []string{
+				`not json`,
+				`{"version":2,"entries":[]}`,
+				`{"version":1,"entries":[{"path":"../escape.txt","metadata":{"a":"b"}}]}`,
+				`{"version":1,"entries":[{"path":"/abs.txt","metadata":{"a":"b"}}]}`,
+				`{"version":1,"entries":[{"path":"a.txt","metadata":{"a":"b"}},{"path":"a.txt","metadata":{"c":"d"}}]}`,
+				`{"version":1,"entries":[{"path":"a.txt","metadata":{}}]}`,
+				`{"version":1,"entries":[],"extra":true}`,
+			} {
+				err := nc.ImportMetadata(ctx, &provider.Reference{Path: "/copy"}, []byte(doc))
+				Expect(err).To(BeAssignableToTypeOf(errtypes.BadRequest("")), doc)
+			}
+			checkNotCalled(called)
+		})
+	})
+
+	Describe("status codes", func() {
+		It("give NotFound for a missing resource", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			gone := &provider.Reference{Path: "/gone.txt"}
+			err := nc.Delete(ctx, gone)
+			Expect(err).To(BeAssignableToTypeOf(errtypes.NotFound("")))
+			err = nc.Move(ctx, gone, &provider.Reference{Path: "/moved.txt"})
+			Expect(err).To(BeAssignableToTypeOf(errtypes.NotFound("")))
+			err = nc.SetArbitraryMetadata(ctx, gone, &provider.ArbitraryMetadata{Metadata: map[string]string{"a": "b"}})
+			Expect(err).To(MatchError(errtypes.NotFound("/gone.txt")))
+		})
+
+		It("let UnsetArbitraryMetadata succeed for a missing resource", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.UnsetArbitraryMetadata(ctx, &provider.Reference{Path: "/gone.txt"}, []string{"a"})
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/UnsetArbitraryMetadata {"ref":{"path":"/gone.txt"},"keys":["a"]}`)
+		})
+
+		It("are mapped to errtypes", func() {
+			for status, expected := range map[string]error{
+				"403": errtypes.PermissionDenied("forbidden"),
+				"404": errtypes.NotFound("/status/404"),
+				"409": errtypes.AlreadyExists("conflict"),
+				"500": errtypes.InternalError("EFSS API responded 500: oops"),
+				"502": errtypes.InternalError("EFSS API responded 502: bad gateway"),
+			} {
+				nc, called, teardown := setUpNextcloudServer()
+				_, err := nc.GetMD(ctx, &provider.Reference{Path: "/status/" + status}, nil)
+				Expect(err).To(MatchError(expected), status)
+				checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/status/`+status+`"},"mdKeys":null}`)
+				teardown()
+			}
+		})
+	})
+
+	Describe("ContextSetCreationTime", func() {
+		It("uploads a file with the given creation time", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			ctime := time.Unix(1500000000, 0)
+			err := nc.Upload(nextcloud.ContextSetCreationTime(ctx, ctime), &provider.Reference{Path: "/migrated.txt"}, io.NopCloser(strings.NewReader("shiny!")))
+			Expect(err).ToNot(HaveOccurred())
+			md, err := nc.GetMD(ctx, &provider.Reference{Path: "/migrated.txt"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			btime, ok := nextcloud.CreationTime(md)
+			Expect(ok).To(BeTrue())
+			Expect(btime).To(BeTemporally("==", ctime))
+			checkCalls(called,
+				`PUT /apps/sciencemesh/~tester/api/storage/Upload/home/migrated.txt [X-OC-CTime: 1500000000] shiny!`,
+				`POST /apps/sciencemesh/~tester/api/storage/GetMD {"ref":{"path":"/migrated.txt"},"mdKeys":null}`,
+			)
+		})
+
+		It("reports no creation time when the server does not", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			md, err := nc.GetMD(ctx, &provider.Reference{Path: "/links/releases/v2"}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, ok := nextcloud.CreationTime(md)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("fallback_endpoint", func() {
+		// closedEndPoint returns an endpoint on a port nothing listens on.
+		closedEndPoint := func() string {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer l.Close()
+			return "http://" + l.Addr().String() + "/apps/sciencemesh/"
+		}
+
+		It("sends the request to the fallback when the endpoint is down", func() {
+			called := []string{}
+			server := httptest.NewServer(nextcloud.GetNextcloudServerMock(&called))
+			defer server.Close()
+			nc, err := nextcloud.NewStorageDriver(&nextcloud.StorageDriverConfig{
+				EndPoint:         closedEndPoint(),
+				FallbackEndPoint: server.URL + "/apps/sciencemesh/",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = nc.GetHome(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(called).To(Equal([]string{`POST /apps/sciencemesh/~tester/api/storage/GetHome `}))
+		})
+
+		It("does not fall back on an error response", func() {
+			called := []string{}
+			server := httptest.NewServer(nextcloud.GetNextcloudServerMock(&called))
+			defer server.Close()
+			nc, err := nextcloud.NewStorageDriver(&nextcloud.StorageDriverConfig{
+				EndPoint:         server.URL + "/apps/sciencemesh/",
+				FallbackEndPoint: closedEndPoint(),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = nc.GetMD(ctx, &provider.Reference{Path: "/status/500"}, nil)
+			Expect(err).To(MatchError(errtypes.InternalError("EFSS API responded 500: oops")))
+			Expect(called).To(HaveLen(1))
+		})
+
+		It("is not used by a driver for another endpoint", func() {
+			called := []string{}
+			server := httptest.NewServer(nextcloud.GetNextcloudServerMock(&called))
+			defer server.Close()
+			nc, err := nextcloud.NewStorageDriver(&nextcloud.StorageDriverConfig{
+				EndPoint:         closedEndPoint(),
+				FallbackEndPoint: server.URL + "/apps/sciencemesh/",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			clone, err := nc.WithEndpoint(closedEndPoint())
+			Expect(err).ToNot(HaveOccurred())
+			_, err = clone.GetHome(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(called).To(BeEmpty())
+		})
+
+		It("fails when both are down", func() {
+			nc, err := nextcloud.NewStorageDriver(&nextcloud.StorageDriverConfig{
+				EndPoint:         closedEndPoint(),
+				FallbackEndPoint: closedEndPoint(),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = nc.GetHome(ctx)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("CreateDirs", func() {
+		It("creates a tree of folders in one call", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.CreateDirs(ctx, []*provider.Reference{
+				{Path: "/project/src/lib"},
+				{Path: "/project"},
+				{Path: "/project/src"},
+				{Path: "/project/docs"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/CreateDirs {"refs":[{"path":"/project/src/lib"},{"path":"/project"},{"path":"/project/src"},{"path":"/project/docs"}]}`)
+		})
+
+		It("reports the folders it could not create", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			err := nc.CreateDirs(ctx, []*provider.Reference{
+				{Path: "/project/tmp"},
+				{Path: "/readonly/new"},
+			})
+			errs, ok := err.(nextcloud.MultiError)
+			Expect(ok).To(BeTrue())
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Error()).To(ContainSubstring("/readonly/new"))
+			Expect(errors.Is(errs[0], errtypes.PermissionDenied("read-only"))).To(BeTrue())
+		})
+	})
+
+	Describe("DeleteMulti and MoveMulti", func() {
+		It("returns the resources that could not be deleted, and why", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			blockers, err := nc.DeleteMulti(ctx, []*provider.Reference{
+				{Path: "/bulk/a.txt"},
+				{Path: "/bulk/locked.txt"},
+				{Path: "/bulk/gone.txt"},
+				{Path: "/bulk/readonly.txt"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(blockers).To(Equal([]nextcloud.Blocker{
+				{Ref: &provider.Reference{Path: "/bulk/locked.txt"}, Reason: nextcloud.BlockedLocked, Message: "locked by einstein"},
+				{Ref: &provider.Reference{Path: "/bulk/gone.txt"}, Reason: nextcloud.BlockedNotFound, Message: "not found"},
+				{Ref: &provider.Reference{Path: "/bulk/readonly.txt"}, Reason: nextcloud.BlockedPermission, Message: "read-only share"},
+			}))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/DeleteMulti {"refs":[{"path":"/bulk/a.txt"},{"path":"/bulk/locked.txt"},{"path":"/bulk/gone.txt"},{"path":"/bulk/readonly.txt"}]}`)
+		})
+
+		It("returns the resources that could not be moved, and why", func() {
+			nc, called, teardown := setUpNextcloudServer()
+			defer teardown()
+			blockers, err := nc.MoveMulti(ctx, []nextcloud.MoveItem{
+				{OldRef: &provider.Reference{Path: "/bulk/b.txt"}, NewRef: &provider.Reference{Path: "/archive/b.txt"}},
+				{OldRef: &provider.Reference{Path: "/bulk/c.txt"}, NewRef: &provider.Reference{Path: "/archive/c.txt"}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(blockers).To(Equal([]nextcloud.Blocker{
+				{Ref: &provider.Reference{Path: "/bulk/c.txt"}, Reason: nextcloud.BlockedConflict, Message: "target exists"},
+			}))
+			checkCalled(called, `POST /apps/sciencemesh/~tester/api/storage/MoveMulti {"moves":[{"oldRef":{"path":"/bulk/b.txt"},"newRef":{"path":"/archive/b.txt"}},{"oldRef":{"path":"/bulk/c.txt"},"newRef":{"path":"/archive/c.txt"}}],"conflictPolicy":"fail"}`)
+		})
+
+		It("fails when the server does not report on every resource", func() {
+			nc, _, teardown := setUpNextcloudServer()
+			defer teardown()
+			_, err := nc.DeleteMulti(ctx, []*provider.Reference{
+				{Path: "/bulk/d.txt"},
+				{Path: "/bulk/e.txt"},
+			})
+			Expect(err).To(MatchError(errtypes.InternalError("nextcloud storage driver: sent 2 resources, got 1 results")))
+		})
+	})
+
 })
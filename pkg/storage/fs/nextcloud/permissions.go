@@ -0,0 +1,144 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package nextcloud
+
+import (
+	"encoding/json"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/internal/http/services/owncloud/ocs/conversions"
+)
+
+// PermissionsMapper translates between CS3 resource permissions and the
+// integer bitmask Nextcloud uses for share permissions
+// (1=read, 2=update, 4=create, 8=delete, 16=share).
+type PermissionsMapper struct {
+	// extra maps a CS3 permission, by its json name (e.g. "deny_grant"),
+	// to the Nextcloud bits it corresponds to, on top of the default mapping.
+	extra map[string]conversions.Permissions
+}
+
+// NewPermissionsMapper returns a PermissionsMapper using the default OCS mapping,
+// extended with the given CS3 permission name to bitmask entries.
+func NewPermissionsMapper(extra map[string]int) *PermissionsMapper {
+	m := &PermissionsMapper{
+		extra: make(map[string]conversions.Permissions, len(extra)),
+	}
+	for name, bits := range extra {
+		m.extra[name] = conversions.Permissions(bits)
+	}
+	return m
+}
+
+// ToBitmask converts CS3 resource permissions into a Nextcloud bitmask.
+func (m *PermissionsMapper) ToBitmask(rp *provider.ResourcePermissions) (int, error) {
+	bits := conversions.RoleFromResourcePermissions(rp).OCSPermissions()
+	if len(m.extra) == 0 || rp == nil {
+		return int(bits), nil
+	}
+	set, err := permissionsToMap(rp)
+	if err != nil {
+		return 0, err
+	}
+	for name, extraBits := range m.extra {
+		if set[name] {
+			bits |= extraBits
+		}
+	}
+	return int(bits), nil
+}
+
+// FromBitmask converts a Nextcloud bitmask into CS3 resource permissions.
+func (m *PermissionsMapper) FromBitmask(bitmask int) (*provider.ResourcePermissions, error) {
+	bits := conversions.Permissions(bitmask)
+	rp := conversions.NewLegacyRoleFromOCSPermissions(bits).CS3ResourcePermissions()
+	if len(m.extra) == 0 {
+		return rp, nil
+	}
+	set, err := permissionsToMap(rp)
+	if err != nil {
+		return nil, err
+	}
+	for name, extraBits := range m.extra {
+		if extraBits != conversions.PermissionInvalid && bits.Contain(extraBits) {
+			set[name] = true
+		}
+	}
+	return permissionsFromMap(set)
+}
+
+// CustomRole is the role name of permissions that match no known share role.
+const CustomRole = "Custom"
+
+// roleNames maps the share roles known to the OCS conversions to the
+// names shown to users.
+var roleNames = map[string]string{
+	conversions.RoleViewer:     "Viewer",
+	conversions.RoleEditor:     "Editor",
+	conversions.RoleFileEditor: "Editor",
+	conversions.RoleCoowner:    "Co-owner",
+	conversions.RoleUploader:   "Uploader",
+	conversions.RoleManager:    "Manager",
+}
+
+// RoleName returns the name of the share role matching the given permissions,
+// or CustomRole if there is none.
+func RoleName(rp *provider.ResourcePermissions) string {
+	if name, ok := roleNames[conversions.RoleFromResourcePermissions(rp).Name]; ok {
+		return name
+	}
+	return CustomRole
+}
+
+// isKnownPermission tells whether name is the json name of a CS3 permission.
+func isKnownPermission(name string) bool {
+	rp, err := permissionsFromMap(map[string]bool{name: true})
+	if err != nil {
+		return false
+	}
+	set, err := permissionsToMap(rp)
+	if err != nil {
+		return false
+	}
+	return set[name]
+}
+
+func permissionsToMap(rp *provider.ResourcePermissions) (map[string]bool, error) {
+	set := map[string]bool{}
+	j, err := json.Marshal(rp)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(j, &set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+func permissionsFromMap(set map[string]bool) (*provider.ResourcePermissions, error) {
+	j, err := json.Marshal(set)
+	if err != nil {
+		return nil, err
+	}
+	rp := &provider.ResourcePermissions{}
+	if err := json.Unmarshal(j, rp); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
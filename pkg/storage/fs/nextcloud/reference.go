@@ -0,0 +1,141 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package nextcloud
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	provider "github.com/cs3org/go-cs3apis/cs3/storage/provider/v1beta1"
+	"github.com/cs3org/reva/pkg/errtypes"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NewReference returns a reference to path. If storageID or opaqueID are given,
+// path is relative to that resource, otherwise it is an absolute path.
+func NewReference(storageID, opaqueID, path string) *provider.Reference {
+	ref := &provider.Reference{
+		Path: path,
+	}
+	if storageID != "" || opaqueID != "" {
+		ref.ResourceId = &provider.ResourceId{
+			StorageId: storageID,
+			OpaqueId:  opaqueID,
+		}
+	}
+	return ref
+}
+
+// childReference returns a reference to the entry at childPath, as the server
+// reported it, in the folder at parent. If parent is relative to a resource
+// id, so is the child reference, and otherwise it is childPath itself.
+func childReference(parent *provider.Reference, childPath string) *provider.Reference {
+	id := parent.GetResourceId()
+	if id == nil {
+		return NewReference("", "", childPath)
+	}
+	return NewReference(id.GetStorageId(), id.GetOpaqueId(), "./"+path.Join(parent.GetPath(), path.Base(childPath)))
+}
+
+// ParseReference parses either an absolute path, like "/some/path", or the
+// "storageid!opaqueid/relative/path" shorthand, where the path is optional.
+func ParseReference(s string) (*provider.Reference, error) {
+	if strings.HasPrefix(s, "/") {
+		return NewReference("", "", s), nil
+	}
+	storageID, rest, ok := strings.Cut(s, "!")
+	if !ok {
+		return nil, errtypes.BadRequest("nextcloud storage driver: malformed reference " + s)
+	}
+	opaqueID, path, _ := strings.Cut(rest, "/")
+	if storageID == "" || opaqueID == "" {
+		return nil, errtypes.BadRequest("nextcloud storage driver: malformed reference " + s)
+	}
+	if path == "" {
+		return NewReference(storageID, opaqueID, "."), nil
+	}
+	return NewReference(storageID, opaqueID, "./"+path), nil
+}
+
+// FormatReference is the inverse of ParseReference.
+func FormatReference(ref *provider.Reference) string {
+	if ref.GetResourceId() == nil {
+		return ref.GetPath()
+	}
+	s := ref.GetResourceId().GetStorageId() + "!" + ref.GetResourceId().GetOpaqueId()
+	path := strings.TrimPrefix(strings.TrimPrefix(ref.GetPath(), "."), "/")
+	if path != "" {
+		s += "/" + path
+	}
+	return s
+}
+
+// trimTrailingSlash returns ref without trailing slashes on its path, so that
+// "/dir/" and "/dir" (or "./dir/" and "./dir") refer to the same resource.
+// The root, "/", is left alone. ref itself is not modified.
+func trimTrailingSlash(ref *provider.Reference) *provider.Reference {
+	p := ref.GetPath()
+	if len(p) < 2 || !strings.HasSuffix(p, "/") {
+		return ref
+	}
+	trimmed := strings.TrimRight(p, "/")
+	if trimmed == "" {
+		trimmed = "/"
+	}
+	return &provider.Reference{
+		ResourceId: ref.GetResourceId(),
+		Path:       trimmed,
+	}
+}
+
+// normalizeUnicode returns ref with its path in the unicode normalization form
+// "nfc" or "nfd". Any other form leaves ref as it is.
+func normalizeUnicode(ref *provider.Reference, form string) *provider.Reference {
+	var f norm.Form
+	switch form {
+	case "nfc":
+		f = norm.NFC
+	case "nfd":
+		f = norm.NFD
+	default:
+		return ref
+	}
+	p := ref.GetPath()
+	if f.IsNormalString(p) {
+		return ref
+	}
+	return &provider.Reference{
+		ResourceId: ref.GetResourceId(),
+		Path:       f.String(p),
+	}
+}
+
+// ReferenceTarget returns the URI a reference resource points to, as set with
+// CreateReference.
+func ReferenceTarget(ri *provider.ResourceInfo) (*url.URL, error) {
+	if ri.GetType() != provider.ResourceType_RESOURCE_TYPE_REFERENCE {
+		return nil, errtypes.BadRequest("nextcloud storage driver: " + ri.GetPath() + " is not a reference")
+	}
+	target, err := url.Parse(ri.GetTarget())
+	if err != nil {
+		return nil, errtypes.InternalError("nextcloud storage driver: reference " + ri.GetPath() + " has a malformed target: " + err.Error())
+	}
+	return target, nil
+}
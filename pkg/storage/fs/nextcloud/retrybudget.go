@@ -0,0 +1,77 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package nextcloud
+
+import (
+	"sync"
+	"time"
+)
+
+// retryBudget is a token bucket shared by all calls of a driver, limiting how
+// often they may retry in total. This keeps retries from multiplying the load
+// on a server that is already struggling.
+type retryBudget struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	size   float64 // maximum number of tokens
+	tokens float64
+	last   time.Time
+}
+
+// newRetryBudget returns a full budget of size retries, refilled at rate
+// retries per second. A size of zero or less means retries are unlimited.
+func newRetryBudget(rate float64, size int) *retryBudget {
+	if size <= 0 {
+		return nil
+	}
+	return &retryBudget{
+		rate:   rate,
+		size:   float64(size),
+		tokens: float64(size),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token from the budget, and tells whether there was one.
+func (b *retryBudget) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.size {
+		b.tokens = b.size
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// fresh returns a full budget with the same rate and size as b.
+func (b *retryBudget) fresh() *retryBudget {
+	if b == nil {
+		return nil
+	}
+	return newRetryBudget(b.rate, int(b.size))
+}
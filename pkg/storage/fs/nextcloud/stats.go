@@ -0,0 +1,168 @@
+// Copyright 2018-2023 CERN
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// In applying this license, CERN does not waive the privileges and immunities
+// granted to it by virtue of its status as an Intergovernmental Organization
+// or submit itself to any jurisdiction.
+
+package nextcloud
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cs3org/reva/pkg/appctx"
+)
+
+// DriverStats are counters of the requests a driver sent to the server.
+type DriverStats struct {
+	Requests        int64 // requests sent, including retries
+	Errors          int64 // requests that failed, or got a 4xx or 5xx response
+	Retries         int64
+	BytesUploaded   int64 // bytes of request bodies, including those of API calls
+	BytesDownloaded int64 // bytes of response bodies, including those of API calls
+	InFlight        int64 // requests whose response body was not closed yet
+}
+
+type stats struct {
+	requests        atomic.Int64
+	errors          atomic.Int64
+	retries         atomic.Int64
+	bytesUploaded   atomic.Int64
+	bytesDownloaded atomic.Int64
+	inFlight        atomic.Int64
+	newConns        atomic.Int64
+	reusedConns     atomic.Int64
+	idleConns       atomic.Int64
+	http2           atomic.Bool
+}
+
+// ConnectionStats tell how the requests of a driver used connections, to see
+// whether keep-alive and HTTP/2 work out as they should.
+type ConnectionStats struct {
+	HTTP2       bool  // the last response came over HTTP/2
+	NewConns    int64 // requests for which a connection was opened
+	ReusedConns int64 // requests sent over a connection opened before
+	IdleConns   int64 // of the reused connections, those taken from the idle pool
+}
+
+// ReuseRatio returns the share of requests sent over a reused connection.
+func (s ConnectionStats) ReuseRatio() float64 {
+	if s.NewConns+s.ReusedConns == 0 {
+		return 0
+	}
+	return float64(s.ReusedConns) / float64(s.NewConns+s.ReusedConns)
+}
+
+// ConnectionStats returns a snapshot of the connection counters of the driver.
+func (nc *StorageDriver) ConnectionStats() ConnectionStats {
+	return ConnectionStats{
+		HTTP2:       nc.stats.http2.Load(),
+		NewConns:    nc.stats.newConns.Load(),
+		ReusedConns: nc.stats.reusedConns.Load(),
+		IdleConns:   nc.stats.idleConns.Load(),
+	}
+}
+
+// withConnTrace returns req with a trace that counts, in s, how it got its
+// connection.
+func (s *stats) withConnTrace(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				s.reusedConns.Add(1)
+			} else {
+				s.newConns.Add(1)
+			}
+			if info.WasIdle {
+				s.idleConns.Add(1)
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// Stats returns a snapshot of the counters of the driver.
+func (nc *StorageDriver) Stats() DriverStats {
+	return DriverStats{
+		Requests:        nc.stats.requests.Load(),
+		Errors:          nc.stats.errors.Load(),
+		Retries:         nc.stats.retries.Load(),
+		BytesUploaded:   nc.stats.bytesUploaded.Load(),
+		BytesDownloaded: nc.stats.bytesDownloaded.Load(),
+		InFlight:        nc.stats.inFlight.Load(),
+	}
+}
+
+// doRequest sends req with the http client of the driver, keeping the stats.
+func (nc *StorageDriver) doRequest(req *http.Request) (*http.Response, error) {
+	nc.stats.requests.Add(1)
+	nc.stats.inFlight.Add(1)
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &countingBody{ReadCloser: req.Body, n: &nc.stats.bytesUploaded}
+	}
+	resp, err := nc.client.Do(nc.stats.withConnTrace(req))
+	servedBy := req.URL
+	if err != nil {
+		if fallbackReq := nc.fallbackRequest(req, err); fallbackReq != nil {
+			if fallbackReq.Body != nil && fallbackReq.Body != http.NoBody {
+				fallbackReq.Body = &countingBody{ReadCloser: fallbackReq.Body, n: &nc.stats.bytesUploaded}
+			}
+			resp, err = nc.client.Do(nc.stats.withConnTrace(fallbackReq))
+			servedBy = fallbackReq.URL
+		}
+	}
+	if err == nil {
+		appctx.GetLogger(req.Context()).Debug().Msgf("nextcloud storage driver: %s %s served by %s", req.Method, req.URL.Path, servedBy.Host)
+	}
+	if err != nil {
+		nc.stats.errors.Add(1)
+		nc.stats.inFlight.Add(-1)
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		nc.stats.errors.Add(1)
+	}
+	nc.stats.http2.Store(resp.ProtoMajor == 2)
+	resp.Body = &countingBody{
+		ReadCloser: resp.Body,
+		n:          &nc.stats.bytesDownloaded,
+		onClose:    func() { nc.stats.inFlight.Add(-1) },
+	}
+	return resp, nil
+}
+
+// countingBody adds the number of bytes read from it to n.
+type countingBody struct {
+	io.ReadCloser
+	n       *atomic.Int64
+	onClose func()
+	once    sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	if b.onClose != nil {
+		b.once.Do(b.onClose)
+	}
+	return b.ReadCloser.Close()
+}